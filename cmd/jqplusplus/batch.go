@@ -0,0 +1,136 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/dakusui/jqplusplus/internal"
+)
+
+// manifest describes the files written by a run with --out-dir.
+type manifest struct {
+	Targets []manifestTarget `json:"targets"`
+}
+
+type manifestTarget struct {
+	Input string `json:"input"`
+	// Output is the file the target is written to. It is empty if the target failed.
+	Output string `json:"output,omitempty"`
+	// SHA256 is the hash of the content of Output.
+	SHA256       string               `json:"sha256,omitempty"`
+	Dependencies []manifestDependency `json:"dependencies"`
+	Error        string               `json:"error,omitempty"`
+}
+
+type manifestDependency struct {
+	File string `json:"file"`
+	// SHA256 is the hash of the content of File. It is empty if File cannot be read.
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+func newManifestTarget(nodeEntryKey internal.NodeEntryKey, dependencies []string) manifestTarget {
+	return manifestTarget{
+		Input: nodeEntryKey.String(),
+		Dependencies: internal.Map(dependencies, func(each string) manifestDependency {
+			ret := manifestDependency{File: displayPath(each)}
+			if data, err := os.ReadFile(each); err == nil {
+				ret.SHA256 = sha256Hex(data)
+			}
+			return ret
+		}),
+	}
+}
+
+func (t *manifestTarget) setOutput(path string, content string) {
+	t.Output = path
+	t.SHA256 = sha256Hex([]byte(content + "\n"))
+}
+
+func (m manifest) write(path string) error {
+	if m.Targets == nil {
+		m.Targets = []manifestTarget{}
+	}
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0o644)
+}
+
+// outputPaths returns the files under opts.outDir the targets are written to.
+// A target is written at the same path relative to opts.outDir as it is relative to the deepest directory containing
+// all the targets, with its extension replaced with opts.outExt, or the output format's if it is not given.
+func outputPaths(in []internal.NodeEntryKey, opts *options) ([]string, error) {
+	targets := make([]string, 0, len(in))
+	for _, each := range in {
+		target, err := filepath.Abs(each.String())
+		if err != nil {
+			return nil, err
+		}
+		targets = append(targets, target)
+	}
+	root := commonDirectory(targets)
+	ext := opts.outExt
+	if ext == "" {
+		ext = opts.outputFormat.Extension()
+	}
+	ret := make([]string, 0, len(targets))
+	seen := map[string]string{}
+	for _, each := range targets {
+		rel, err := filepath.Rel(root, each)
+		if err != nil {
+			return nil, err
+		}
+		out := filepath.Join(opts.outDir, strings.TrimSuffix(rel, filepath.Ext(rel))+"."+ext)
+		if other, ok := seen[out]; ok {
+			return nil, fmt.Errorf("targets %s and %s are both written to %s", other, each, out)
+		}
+		seen[out] = each
+		ret = append(ret, out)
+	}
+	return ret, nil
+}
+
+// commonDirectory returns the deepest directory that contains all the given absolute paths.
+func commonDirectory(paths []string) string {
+	ret := filepath.Dir(paths[0])
+	for _, each := range paths[1:] {
+		for ret != filepath.Dir(ret) && !strings.HasPrefix(each, strings.TrimSuffix(ret, string(filepath.Separator))+string(filepath.Separator)) {
+			ret = filepath.Dir(ret)
+		}
+	}
+	return ret
+}
+
+func writeOutput(path string, content string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, []byte(content+"\n"), 0o644)
+}
+
+// displayPath returns path relative to the working directory if it is under it, otherwise path itself.
+func displayPath(path string) string {
+	wd, err := os.Getwd()
+	if err != nil {
+		return path
+	}
+	rel, err := filepath.Rel(wd, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return path
+	}
+	return rel
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
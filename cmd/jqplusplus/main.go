@@ -2,118 +2,460 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/dakusui/jqplusplus/internal"
+	"io"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
 )
 
-func main() {
-	if len(os.Args) > 1 && (os.Args[1] == "-h" || os.Args[1] == "--help") {
-		help := `Usage: <program> [options] [files...]
+const help = `Usage: <program> [options] [files...]
 
 Options:
-  -h, --help   Show this help message
+  -h, --help                          Show this help message
+  --validation=no|strict|lenient      Validate rendered objects against the schema named by their "$schema" key.
+                                      "strict" fails on violations, "lenient" only warns. Default: no
+  -o, --output=FORMAT                 Print rendered objects in FORMAT, one of json, yaml, toml, json5, hocon, and env.
+                                      Default: json
+  -q, --query=FILTER                  Apply a jq FILTER to the rendered object and print its results instead.
+                                      Modules (.jq files) found during inheritance are available to FILTER.
+  -r, --raw-output                    Print string results without quotes.
+  -c, --compact-output                Print JSON on a single line.
+  --arg NAME VALUE                    Make VALUE available to templates and FILTER as $NAME, a string.
+  --argjson NAME JSON                 Make JSON available to templates and FILTER as $NAME, a JSON value.
+  --slurpfile NAME FILE               Make the JSON values in FILE available to templates and FILTER as $NAME, an array.
+  --allow-env=NAME[,NAME...]          Make the environment variables NAME visible through $ENV and env. NAME may be a
+                                      glob such as APP_*. No environment variable is visible by default.
+  --watch                             Keep running, and render a target again whenever a file it depends on changes.
+                                      Errors are printed without exiting.
+  --out-dir=DIR, --out=DIR            Write each target to DIR instead of stdout, at the same path relative to DIR as
+                                      the target's relative to the directory common to all targets.
+  --out-ext=EXT                       Extension of the files written to DIR. Default: the one of the output format
+  -j, --jobs=N                        Render up to N targets in parallel. Results are printed in the order of the
+                                      targets. Default: 1
+  --keep-going                        Render the remaining targets even after one fails.
+  --manifest=FILE                     With --out-dir, write a JSON manifest of inputs, outputs, dependencies, and their
+                                      SHA-256 hashes to FILE.
+  --explain=PATH                      Print the files (and lines) the values at PATH (e.g. ".a.b") come from,
+                                      instead of the rendered object.
+  --input-format=FORMAT               Format of stdin, one of json, yaml, toml, json5, hocon, and hcl.
+                                      Default: told from the content
+  --base-dir=DIR                      Directory against which files stdin inherits from are resolved.
+                                      Default: the working directory
+  --cache-dir=DIR                     Store resolved files in DIR, and reuse them in later runs while the files they
+                                      depend on are unchanged. Default: JF_CACHE_DIR
+  --no-cache                          Do not store or reuse resolved files across runs.
+  --key-order=POLICY                  Order of keys in rendered objects, one of inherited-first, child-first, and
+                                      sorted. Keys are printed in the order they are written, with the ones inherited
+                                      from parents before the child's own ones, or after them. Default: inherited-first
+  --sort-keys                         Print keys of rendered objects sorted. Same as --key-order=sorted.
+  --nested-templating-levels=N        Apply templating to a value up to N times, failing if it does not finish.
+                                      Default: 5
 
-If no files are provided, input is read from stdin.
+A file "-" is stdin. If no files are provided, input is read from stdin.
 `
+
+func main() {
+	opts, err := parseOptions(os.Args[1:])
+	if err != nil {
+		_, _ = os.Stderr.WriteString("Error processing arguments: " + err.Error() + "\n")
+		os.Exit(1)
+	}
+	if opts.help {
 		_, _ = os.Stdout.WriteString(help)
 		os.Exit(0)
 	}
+	if _, err := internal.ScriptTimeout(); err != nil {
+		_, _ = os.Stderr.WriteString("Warning: " + err.Error() + "\n")
+	}
 
-	in, d, err := inputFiles(os.Args)
-	defer d()
+	in, err := inputFiles(opts.files, opts.baseDir)
 	if err != nil {
 		_, _ = os.Stderr.WriteString("Error processing arguments: " + err.Error() + "\n")
 		os.Exit(1)
 	}
-	exitCode := processNodeEntryKeys(in)
+	if slices.ContainsFunc(in, isStdin) {
+		if opts.watch || opts.outDir != "" {
+			_, _ = os.Stderr.WriteString("Error processing arguments: --watch and --out-dir cannot be used with stdin\n")
+			os.Exit(1)
+		}
+		if opts.stdin, err = io.ReadAll(os.Stdin); err != nil {
+			_, _ = os.Stderr.WriteString("Error reading from stdin: " + err.Error() + "\n")
+			os.Exit(1)
+		}
+	}
+	if opts.watch {
+		if err := watch(in, opts, os.Stdout, os.Stderr, nil); err != nil {
+			_, _ = os.Stderr.WriteString("Error watching files: " + err.Error() + "\n")
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	exitCode := processNodeEntryKeys(in, opts)
 	os.Exit(exitCode)
 }
 
-func inputFiles(args []string) ([]internal.NodeEntryKey, func(), error) {
+// inputFiles makes the targets from the files given on the command line, where "-" is stdin, which is resolved
+// against baseDir, or the working directory if baseDir is empty. If no files are given, stdin is the target.
+func inputFiles(files []string, baseDir string) ([]internal.NodeEntryKey, error) {
+	if len(files) == 0 {
+		files = []string{stdinFilename}
+	}
+	if baseDir == "" {
+		baseDir = "."
+	}
+	absBaseDir, err := filepath.Abs(baseDir)
+	if err != nil {
+		return nil, err
+	}
 	var in []internal.NodeEntryKey
-	exit := func() {}
-	if len(args) == 1 {
-		tempFile, err := os.CreateTemp("", "input-*")
-		if err != nil {
-			_, _ = os.Stderr.WriteString("Error creating temporary file: " + err.Error() + "\n")
-			return nil, exit, err
+	for _, each := range files {
+		if each != stdinFilename {
+			in = append(in, internal.NewNodeEntry(filepath.Dir(each), filepath.Base(each)))
+			continue
 		}
-		exit = func() {
-			err := os.Remove(tempFile.Name())
-			if err != nil {
-				_, _ = fmt.Fprintf(os.Stderr, "\n")
-			}
+		if slices.ContainsFunc(in, isStdin) {
+			return nil, errors.New("stdin can be given only once")
 		}
+		in = append(in, internal.NewNodeEntry(absBaseDir, stdinFilename))
+	}
+	return in, nil
+}
 
-		if _, err := tempFile.ReadFrom(os.Stdin); err != nil {
-			_, _ = os.Stderr.WriteString("Error reading from stdin: " + err.Error() + "\n")
-			return nil, exit, err
-		}
+// stdinFilename is the name of stdin among targets.
+const stdinFilename = "-"
 
-		if err := tempFile.Close(); err != nil {
-			_, _ = os.Stderr.WriteString("Error closing temporary file: " + err.Error() + "\n")
-			return nil, exit, err
-		}
-		absolutePath, err := filepath.Abs(tempFile.Name())
-		if err != nil {
-			_, _ = os.Stderr.WriteString("Error getting absolute path: " + err.Error() + "\n")
-			return nil, exit, err
-		}
+func isStdin(nodeEntryKey internal.NodeEntryKey) bool {
+	return nodeEntryKey.Filename() == stdinFilename
+}
 
-		in = []internal.NodeEntryKey{
-			internal.NewNodeEntry("", absolutePath),
+func processNodeEntryKeys(in []internal.NodeEntryKey, opts *options) int {
+	session := newSession(opts)
+	var outputs []string
+	if opts.outDir != "" {
+		var err error
+		if outputs, err = outputPaths(in, opts); err != nil {
+			_, _ = os.Stderr.WriteString("Error processing arguments: " + err.Error() + "\n")
+			return 1
 		}
-	} else {
-		in = internal.Map(args[1:], func(t string) internal.NodeEntryKey {
-			return internal.NewNodeEntry(filepath.Dir(t), filepath.Base(t))
-		})
 	}
-	return in, exit, nil
-}
-
-func processNodeEntryKeys(in []internal.NodeEntryKey) int {
 	ret := 0
-	for _, eachNodeEntryKey := range in {
-		v, err := processNodeEntryKey(eachNodeEntryKey)
+	var m manifest
+	stop := make(chan struct{})
+	results, wait := renderNodeEntryKeys(session, in, opts, stop)
+	// Renders in progress are waited for, since they use the session.
+	defer func() {
+		close(stop)
+		wait()
+	}()
+	for i, eachNodeEntryKey := range in {
+		r := <-results[i]
+		v, err := r.output, r.err
+		entry := newManifestTarget(eachNodeEntryKey, r.dependencies)
+		if err == nil {
+			if outputs == nil {
+				_, err = os.Stdout.WriteString(v + "\n")
+			} else if err = writeOutput(outputs[i], v); err == nil {
+				entry.setOutput(outputs[i], v)
+			}
+		}
 		if err != nil {
-			_, _ = os.Stderr.WriteString("Error processing file " + eachNodeEntryKey.String() + ": " + err.Error() + "\n")
+			_, _ = os.Stderr.WriteString(formatError(eachNodeEntryKey, err) + "\n")
+			entry.Error = err.Error()
 			ret = 1
+		}
+		m.Targets = append(m.Targets, entry)
+		if err != nil && !opts.keepGoing {
 			break
 		}
-		_, err = os.Stdout.WriteString(v + "\n")
-		if err != nil {
+	}
+	if opts.manifest != "" {
+		if err := m.write(opts.manifest); err != nil {
+			_, _ = os.Stderr.WriteString("Error writing manifest: " + err.Error() + "\n")
 			ret = 1
-			break
 		}
 	}
 	return ret
 }
 
-func processNodeEntryKey(nodeEntryKey internal.NodeEntryKey) (string, error) {
-	nodeEntryValue, err := internal.LoadAndResolveInheritances(nodeEntryKey.BaseDir(), nodeEntryKey.Filename(), internal.SearchPaths())
+// renderResult is the result of rendering a target.
+type renderResult struct {
+	output       string
+	dependencies []string
+	err          error
+}
+
+// renderNodeEntryKeys renders targets with opts.jobs goroutines, and returns channels that receive the results in the
+// same order as in, so that they can be printed in a deterministic order, and a function that waits for the renders
+// to finish.
+// Targets not started yet when stop is closed are not rendered, and their channels never receive.
+func renderNodeEntryKeys(session *internal.Session, in []internal.NodeEntryKey, opts *options, stop <-chan struct{}) ([]chan renderResult, func()) {
+	ret := make([]chan renderResult, len(in))
+	for i := range ret {
+		ret[i] = make(chan renderResult, 1)
+	}
+	jobs := make(chan int)
+	go func() {
+		defer close(jobs)
+		for i := range in {
+			select {
+			case jobs <- i:
+			case <-stop:
+				return
+			}
+		}
+	}()
+	var wg sync.WaitGroup
+	for range max(opts.jobs, 1) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				v, dependencies, err := renderNodeEntryKey(session, in[i], opts)
+				ret[i] <- renderResult{output: v, dependencies: dependencies, err: err}
+			}
+		}()
+	}
+	return ret, wg.Wait
+}
+
+// formatError renders an error in a compiler-like format, i.e., "<location>: error: <detail>", if it tells where it
+// occurred.
+func formatError(nodeEntryKey internal.NodeEntryKey, err error) string {
+	var located internal.LocatedError
+	if errors.As(err, &located) {
+		return located.Location() + ": error: " + located.Detail()
+	}
+	return "Error processing file " + nodeEntryKey.String() + ": " + err.Error()
+}
+
+func processNodeEntryKey(nodeEntryKey internal.NodeEntryKey, opts *options) (string, error) {
+	session := newSession(opts)
+	ret, _, err := renderNodeEntryKey(session, nodeEntryKey, opts)
+	return ret, err
+}
+
+// newSession creates a Session configured by opts.
+func newSession(opts *options) *internal.Session {
+	cacheDir := opts.cacheDir
+	if cacheDir == "" {
+		cacheDir = internal.CacheDirectory()
+	}
+	if opts.noCache {
+		cacheDir = ""
+	}
+	return internal.NewSession(internal.SearchPaths(), internal.SessionOptions{
+		TracksProvenance: opts.explain != "",
+		CacheDirectory:   cacheDir,
+		KeyOrderPolicy:   opts.keyOrderPolicy,
+	})
+}
+
+// renderNodeEntryKey renders a target and returns the result together with the files it depends on.
+// Dependencies are returned even on failure, as far as they are known.
+func renderNodeEntryKey(session *internal.Session, nodeEntryKey internal.NodeEntryKey, opts *options) (string, []string, error) {
+	var nodeEntryValue *internal.NodeEntryValue
+	var dependencies []string
+	var err error
+	if isStdin(nodeEntryKey) {
+		nodeEntryValue, dependencies, err = loadStdin(session, nodeEntryKey, opts)
+	} else {
+		nodeEntryValue, dependencies, err = session.LoadAndResolveInheritances(nodeEntryKey.BaseDir(), nodeEntryKey.Filename())
+	}
 	if err != nil {
-		return "", err
+		return "", dependencies, err
+	}
+	ret, err := renderNodeEntryValue(nodeEntryKey, nodeEntryValue, opts)
+	return ret, dependencies, err
+}
+
+// loadStdin loads stdin, read into opts.stdin beforehand, as if it were a file at nodeEntryKey.
+func loadStdin(session *internal.Session, nodeEntryKey internal.NodeEntryKey, opts *options) (*internal.NodeEntryValue, []string, error) {
+	ft := opts.inputFormat
+	if ft == "" {
+		var ok bool
+		if ft, ok = internal.SniffFileType(opts.stdin); !ok {
+			return nil, nil, errors.New("cannot tell the format of stdin, use --input-format")
+		}
 	}
+	return session.LoadAndResolveInheritancesOfData(nodeEntryKey.String(), opts.stdin, ft)
+}
+
+func renderNodeEntryValue(nodeEntryKey internal.NodeEntryKey, nodeEntryValue *internal.NodeEntryValue, opts *options) (string, error) {
+	var err error
 	obj := nodeEntryValue.Obj
+	keyOrder := nodeEntryValue.KeyOrder
+	levels := opts.nestedTemplatingLevels
+	if levels == 0 {
+		levels = internal.DefaultNestedTemplatingLevels
+	}
 	{
-		invocationSpec := internal.NewInvocationSpecBuilder().AddModules(nodeEntryValue.CompilerOptions...).Build()
-		obj, err = internal.ProcessKeySide(obj, 7, *invocationSpec)
+		invocationSpec, err := newInvocationSpec(nodeEntryValue, opts)
 		if err != nil {
 			return "", err
 		}
+		obj, keyOrder, err = internal.ProcessKeySideWithKeyOrder(obj, keyOrder, levels, *invocationSpec)
+		if err != nil {
+			return "", internal.WithSourceFile(err, nodeEntryKey.String())
+		}
 	}
 	{
-		invocationSpec := internal.NewInvocationSpecBuilder().AddModules(nodeEntryValue.CompilerOptions...).Build()
-		obj, err = internal.ProcessValueSide(obj, 7, *invocationSpec)
+		invocationSpec, err := newInvocationSpec(nodeEntryValue, opts)
 		if err != nil {
 			return "", err
 		}
+		obj, err = internal.ProcessValueSide(obj, levels, *invocationSpec)
+		if err != nil {
+			return "", internal.WithSourceFile(err, nodeEntryKey.String())
+		}
+	}
+	if err := validate(obj, nodeEntryKey, opts.validationMode); err != nil {
+		return "", err
+	}
+	// A target that is not an object is rendered, queried, and explained as it is.
+	document, root := internal.UnwrapDocument(obj)
+	if opts.explain != "" {
+		return explain(document, nodeEntryValue.Provenance.Subtree(root), opts.explain)
 	}
-	data, err := json.MarshalIndent(obj, "", "  ")
+	if opts.query == "" {
+		return render(keyOrder.Subtree(root).Ordered(document), opts)
+	}
+	invocationSpec, err := newInvocationSpec(nodeEntryValue, opts)
 	if err != nil {
 		return "", err
 	}
-	return string(data), nil
+	results, err := internal.ApplyJQFilter(document, opts.query, *invocationSpec)
+	if err != nil {
+		return "", fmt.Errorf("failed to apply query %q: %w", opts.query, err)
+	}
+	rendered := make([]string, 0, len(results))
+	for _, each := range results {
+		// Results of the query are new values, whose keys are sorted.
+		v, err := render(each, opts)
+		if err != nil {
+			return "", err
+		}
+		rendered = append(rendered, v)
+	}
+	return strings.Join(rendered, "\n"), nil
+}
+
+// newInvocationSpec creates an InvocationSpec with the modules collected during inheritance, the variables given on
+// the command line, and the allowed environment variables.
+func newInvocationSpec(nodeEntryValue *internal.NodeEntryValue, opts *options) (*internal.InvocationSpec, error) {
+	environ, err := internal.AllowedEnviron(os.Environ(), opts.allowedEnv)
+	if err != nil {
+		return nil, err
+	}
+	builder := internal.NewInvocationSpecBuilder().AddModules(nodeEntryValue.CompilerOptions...).SetEnviron(environ)
+	for k, v := range opts.args {
+		builder.AddVariable("$"+k, v)
+	}
+	return builder.Build(), nil
+}
+
+// render prints a value in the output format. The keys of its objects are sorted, unless it is made by
+// KeyOrder.Ordered.
+// Some formats can only render objects, and the JSON-specific options, -r and -c, only affect JSON.
+func render(v any, opts *options) (string, error) {
+	format := opts.outputFormat
+	if format == "" {
+		format = internal.OutputJSON
+	}
+	if s, ok := v.(string); ok && opts.rawOutput {
+		return s, nil
+	}
+	if format == internal.OutputJSON {
+		var data []byte
+		var err error
+		if opts.compactOutput {
+			data, err = json.Marshal(v)
+		} else {
+			data, err = json.MarshalIndent(v, "", "  ")
+		}
+		if err != nil {
+			return "", err
+		}
+		return string(data), nil
+	}
+	return format.Encode(v)
+}
+
+// validate runs the validation stage over a rendered object.
+// Violations are returned as an error in strict mode and printed to stderr as warnings in lenient mode.
+// The object is left as it is in every mode.
+func validate(obj map[string]any, nodeEntryKey internal.NodeEntryKey, mode internal.ValidationMode) error {
+	if mode == internal.ValidationNo {
+		return nil
+	}
+	violations, err := internal.ValidateWithSchemaKey(obj, nodeEntryKey.BaseDir(), internal.SearchPaths())
+	if errors.Is(err, internal.ErrSchemaNotLocal) {
+		_, _ = os.Stderr.WriteString("Warning: validation skipped for " + nodeEntryKey.String() + ": " + err.Error() + "\n")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if len(violations) == 0 {
+		return nil
+	}
+	if mode == internal.ValidationStrict {
+		return fmt.Errorf("validation failed:\n%s", internal.FormatViolations(violations, "  "))
+	}
+	_, _ = os.Stderr.WriteString("Warning: validation failed for " + nodeEntryKey.String() + ":\n" + internal.FormatViolations(violations, "  ") + "\n")
+	return nil
+}
+
+// explain renders the origins of the leaves at or under the path given as a path expression, one leaf per paragraph.
+// The first origin of each leaf is the one that defines its value, and the rest are the ones it overrides.
+func explain(obj any, provenance *internal.Provenance, pathExpression string) (string, error) {
+	p, err := internal.PathExpressionToPathArray(pathExpression)
+	if err != nil {
+		return "", err
+	}
+	if _, ok := internal.GetAtPath(obj, p); !ok {
+		return "", fmt.Errorf("path not found: %s", pathExpression)
+	}
+	entries := provenance.EntriesUnder(p)
+	if len(entries) == 0 {
+		// The value may have been made by templating from a leaf at one of its ancestors.
+		if origins, ok := provenance.Lookup(p); ok {
+			entries = []internal.ProvenanceEntry{{Path: p, Origins: origins}}
+		}
+	}
+	var b strings.Builder
+	for _, e := range entries {
+		v, ok := internal.GetAtPath(obj, e.Path)
+		if !ok {
+			continue
+		}
+		pe, err := internal.PathArrayToPathExpression(e.Path)
+		if err != nil {
+			return "", err
+		}
+		if !strings.HasPrefix(pe, ".") {
+			// e.g. "[0]" for an element of an array document.
+			pe = "." + pe
+		}
+		data, err := json.Marshal(v)
+		if err != nil {
+			return "", err
+		}
+		b.WriteString(pe + " = " + string(data) + "\n")
+		for i, o := range e.Origins {
+			if i == 0 {
+				b.WriteString("  defined at " + o.String() + "\n")
+			} else {
+				b.WriteString("  overrides " + o.String() + "\n")
+			}
+		}
+	}
+	if b.Len() == 0 {
+		return pathExpression + ": no origin recorded", nil
+	}
+	return strings.TrimSuffix(b.String(), "\n"), nil
 }
@@ -1,13 +1,17 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"github.com/dakusui/jqplusplus/internal"
 	"github.com/dakusui/jqplusplus/internal/testutil"
+	"os"
 	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestProcessNodeEntry(t *testing.T) {
@@ -26,7 +30,7 @@ func TestLoadAndResolveInheritances_SingleExtendsForJqFile(t *testing.T) {
   "store": "Hello",
   "key": "eval:object:parent::custom_func"
 }`)
-	result, err := processNodeEntryKey((internal.NewNodeEntryKey(filepath.Dir(child), filepath.Base(child))))
+	result, err := processNodeEntryKey(internal.NewNodeEntryKey(filepath.Dir(child), filepath.Base(child)), &options{keyOrderPolicy: internal.KeyOrderSorted})
 
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
@@ -36,3 +40,664 @@ func TestLoadAndResolveInheritances_SingleExtendsForJqFile(t *testing.T) {
 		t.Errorf("expected %v, got %v", expected, result)
 	}
 }
+
+func TestProcessNodeEntryKey_StrictValidation_ThenFail(t *testing.T) {
+	dir := t.TempDir()
+	_ = testutil.WriteTempJSON(t, dir, "schema.json", `{"type": "object", "properties": {"port": {"type": "integer"}}}`)
+	child := testutil.WriteTempJSON(t, dir, "child.json", `{"$schema": "schema.json", "port": "eval:string:\"80\""}`)
+	_, err := processNodeEntryKey(internal.NewNodeEntryKey(filepath.Dir(child), filepath.Base(child)), &options{validationMode: internal.ValidationStrict})
+	if err == nil || !strings.Contains(err.Error(), ".port: ") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestProcessNodeEntryKey_LenientValidation(t *testing.T) {
+	dir := t.TempDir()
+	_ = testutil.WriteTempJSON(t, dir, "schema.json", `{"type": "object", "properties": {"port": {"type": "integer"}}}`)
+	child := testutil.WriteTempJSON(t, dir, "child.json", `{"$schema": "schema.json", "port": "80"}`)
+	result, err := processNodeEntryKey(internal.NewNodeEntryKey(filepath.Dir(child), filepath.Base(child)), &options{validationMode: internal.ValidationLenient})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected, _ := json.MarshalIndent(map[string]any{"$schema": "schema.json", "port": "80"}, "", "  ")
+	if result != string(expected) {
+		t.Errorf("expected %v, got %v", string(expected), result)
+	}
+}
+
+func TestProcessNodeEntryKey_NoValidation_ThenSchemaKept(t *testing.T) {
+	dir := t.TempDir()
+	child := testutil.WriteTempJSON(t, dir, "child.json", `{"$schema": "schema.json", "port": "80"}`)
+	result, err := processNodeEntryKey(internal.NewNodeEntryKey(filepath.Dir(child), filepath.Base(child)), &options{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected, _ := json.MarshalIndent(map[string]any{"$schema": "schema.json", "port": "80"}, "", "  ")
+	if result != string(expected) {
+		t.Errorf("expected %v, got %v", string(expected), result)
+	}
+}
+
+func TestProcessNodeEntryKey_StrictValidationWithSchemaURL_ThenSkipped(t *testing.T) {
+	dir := t.TempDir()
+	child := testutil.WriteTempJSON(t, dir, "child.json", `{"$schema": "https://example.com/schema.json", "port": "80"}`)
+	result, err := processNodeEntryKey(internal.NewNodeEntryKey(filepath.Dir(child), filepath.Base(child)), &options{validationMode: internal.ValidationStrict})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected, _ := json.MarshalIndent(map[string]any{"$schema": "https://example.com/schema.json", "port": "80"}, "", "  ")
+	if result != string(expected) {
+		t.Errorf("expected %v, got %v", string(expected), result)
+	}
+}
+
+func TestProcessNodeEntryKey_BrokenExpression_ThenCompilerLikeError(t *testing.T) {
+	dir := t.TempDir()
+	child := testutil.WriteTempJSON(t, dir, "child.json", `{"a": {"b": "eval:.x | foo"}}`)
+	nodeEntryKey := internal.NewNodeEntryKey(filepath.Dir(child), filepath.Base(child))
+	_, err := processNodeEntryKey(nodeEntryKey, &options{})
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	expected := child + `: .a.b: error: "eval:.x | foo": `
+	if msg := formatError(nodeEntryKey, err); !strings.HasPrefix(msg, expected) {
+		t.Errorf("expected a message starting with %q, got %q", expected, msg)
+	}
+}
+
+func TestProcessNodeEntryKey_Explain(t *testing.T) {
+	dir := t.TempDir()
+	parent := testutil.WriteTempJSON(t, dir, "parent.json", `{"a": {"b": 1, "c": 2}}`)
+	child := testutil.WriteTempJSON(t, dir, "child.json", "{\n  \"$extends\": [\"parent.json\"],\n  \"a\": {\"b\": \"eval:number:10\"}\n}")
+	result, err := processNodeEntryKey(internal.NewNodeEntryKey(filepath.Dir(child), filepath.Base(child)), &options{explain: ".a"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := `.a.b = 10
+  defined at ` + child + `:3
+  overrides ` + parent + `:1
+.a.c = 2
+  defined at ` + parent + `:1`
+	if result != expected {
+		t.Errorf("expected %v, got %v", expected, result)
+	}
+}
+
+func TestProcessNodeEntryKey_OutputYAML(t *testing.T) {
+	dir := t.TempDir()
+	child := testutil.WriteTempJSON(t, dir, "child.json", `{"b": [1, "x"], "a": {"c": true}}`)
+	result, err := processNodeEntryKey(internal.NewNodeEntryKey(filepath.Dir(child), filepath.Base(child)), &options{outputFormat: internal.OutputYAML})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := `b:
+  - 1
+  - x
+a:
+  c: true`
+	if result != expected {
+		t.Errorf("expected %v, got %v", expected, result)
+	}
+}
+
+func TestProcessNodeEntryKey_KeyOrder(t *testing.T) {
+	dir := t.TempDir()
+	_ = testutil.WriteTempJSON(t, dir, "parent.yaml", "name: base\nreplicas: 1\nlabels:\n  tier: web\n  app: base\n")
+	child := testutil.WriteTempJSON(t, dir, "child.json", `{
+  "$extends": ["parent.yaml"],
+  "zone": "eu",
+  "labels": {"owner": "me", "app": "child"},
+  "replicas": 3
+}`)
+	for _, c := range []struct {
+		args     []string
+		expected string
+	}{
+		{[]string{}, `{"name":"base","replicas":3,"labels":{"tier":"web","app":"child","owner":"me"},"zone":"eu"}`},
+		{[]string{"--key-order=child-first"}, `{"zone":"eu","labels":{"owner":"me","app":"child","tier":"web"},"replicas":3,"name":"base"}`},
+		{[]string{"--sort-keys"}, `{"labels":{"app":"child","owner":"me","tier":"web"},"name":"base","replicas":3,"zone":"eu"}`},
+	} {
+		opts, err := parseOptions(append(c.args, "-c", child))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		result, err := processNodeEntryKey(internal.NewNodeEntryKey(filepath.Dir(child), filepath.Base(child)), opts)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if result != c.expected {
+			t.Errorf("%v: expected %v, got %v", c.args, c.expected, result)
+		}
+	}
+}
+
+func TestProcessNodeEntryKey_Query(t *testing.T) {
+	dir := t.TempDir()
+	_ = testutil.WriteTempJSON(t, dir, "parent.jq",
+		`def greet(name):
+  "Hello, " + name;
+`)
+	child := testutil.WriteTempJSON(t, dir, "child.json",
+		`{
+  "$extends": ["parent.jq"],
+  "services": [{"name": "a"}, {"name": "b"}]
+}`)
+	result, err := processNodeEntryKey(internal.NewNodeEntryKey(filepath.Dir(child), filepath.Base(child)), &options{
+		query:     `.services[] | parent::greet(.name) + $suffix`,
+		rawOutput: true,
+		args:      map[string]any{"suffix": "!"},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := "Hello, a!\nHello, b!"
+	if result != expected {
+		t.Errorf("expected %v, got %v", expected, result)
+	}
+}
+
+func TestProcessNodeEntryKey_QueryCompact(t *testing.T) {
+	dir := t.TempDir()
+	child := testutil.WriteTempJSON(t, dir, "child.json", `{"a": {"b": [1, 2]}, "c": "x"}`)
+	result, err := processNodeEntryKey(internal.NewNodeEntryKey(filepath.Dir(child), filepath.Base(child)), &options{
+		query:         `.a, .c`,
+		compactOutput: true,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := `{"b":[1,2]}` + "\n" + `"x"`
+	if result != expected {
+		t.Errorf("expected %v, got %v", expected, result)
+	}
+}
+
+func TestProcessNodeEntryKey_Variables(t *testing.T) {
+	dir := t.TempDir()
+	child := testutil.WriteTempJSON(t, dir, "child.json", `{
+  "eval:$name": "eval:number:$conf.port",
+  "home": "eval:$ENV.HOME // \"hidden\"",
+  "app": "eval:env.JQPP_TEST_APP"
+}`)
+	t.Setenv("JQPP_TEST_APP", "demo")
+	result, err := processNodeEntryKey(internal.NewNodeEntryKey(filepath.Dir(child), filepath.Base(child)), &options{
+		args:       map[string]any{"name": "server", "conf": map[string]any{"port": float64(8080)}},
+		allowedEnv: []string{"JQPP_TEST_*"},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// A key made by a key-side expression takes the place of the expression.
+	expected := `{
+  "server": 8080,
+  "home": "hidden",
+  "app": "demo"
+}`
+	if result != expected {
+		t.Errorf("expected %v, got %v", expected, result)
+	}
+}
+
+func TestWatch_RerendersOnParentChange(t *testing.T) {
+	dir := t.TempDir()
+	outDir := filepath.Join(dir, "out")
+	parent := testutil.WriteTempJSON(t, dir, "parent.json", `{"a": 1}`)
+	child := testutil.WriteTempJSON(t, dir, "child.json", `{"$extends": ["parent.json"], "b": 2}`)
+	other := testutil.WriteTempJSON(t, dir, "other.json", `{"c": 3}`)
+	opts := &options{watch: true, outDir: outDir, outputFormat: internal.OutputJSON, compactOutput: true}
+	in := []internal.NodeEntryKey{
+		internal.NewNodeEntryKey(filepath.Dir(child), filepath.Base(child)),
+		internal.NewNodeEntryKey(filepath.Dir(other), filepath.Base(other)),
+	}
+	var stderr bytes.Buffer
+	stop := make(chan struct{})
+	done := make(chan error)
+	go func() { done <- watch(in, opts, &bytes.Buffer{}, &stderr, stop) }()
+	defer func() {
+		close(stop)
+		if err := <-done; err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	}()
+
+	// waitFor polls a rendered file until it has the expected content.
+	waitFor := func(name string, expected string) {
+		t.Helper()
+		var actual string
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+			data, _ := os.ReadFile(filepath.Join(outDir, name))
+			if actual = string(data); actual == expected {
+				return
+			}
+		}
+		t.Fatalf("expected %q in %s, got %q", expected, name, actual)
+	}
+	waitFor("child.json", `{"a":1,"b":2}`+"\n")
+	waitFor("other.json", `{"c":3}`+"\n")
+
+	otherInfo, err := os.Stat(filepath.Join(outDir, "other.json"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	_ = testutil.WriteTempJSON(t, dir, "parent.json", `{"a": 5}`)
+	waitFor("child.json", `{"a":5,"b":2}`+"\n")
+	if info, err := os.Stat(filepath.Join(outDir, "other.json")); err != nil || !info.ModTime().Equal(otherInfo.ModTime()) {
+		t.Errorf("unaffected target was rendered again")
+	}
+
+	// A broken parent is reported without stopping, and fixing it renders the target again.
+	if err := os.WriteFile(parent, []byte(`{"a": `), 0o644); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	time.Sleep(3 * watchDebounce)
+	_ = testutil.WriteTempJSON(t, dir, "parent.json", `{"a": 7}`)
+	waitFor("child.json", `{"a":7,"b":2}`+"\n")
+}
+
+func TestWatch_RerendersOnFileAddedToPattern(t *testing.T) {
+	dir := t.TempDir()
+	outDir := filepath.Join(dir, "out")
+	if err := os.MkdirAll(filepath.Join(dir, "conf.d"), 0o755); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	_ = testutil.WriteTempJSON(t, dir, "conf.d/a.json", `{"a": 1}`)
+	child := testutil.WriteTempJSON(t, dir, "child.json", `{"$extends": ["conf.d/*.json"]}`)
+	opts := &options{watch: true, outDir: outDir, outputFormat: internal.OutputJSON, compactOutput: true}
+	in := []internal.NodeEntryKey{internal.NewNodeEntryKey(filepath.Dir(child), filepath.Base(child))}
+	stop := make(chan struct{})
+	done := make(chan error)
+	go func() { done <- watch(in, opts, &bytes.Buffer{}, &bytes.Buffer{}, stop) }()
+	defer func() {
+		close(stop)
+		if err := <-done; err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	}()
+
+	waitFor := func(expected string) {
+		t.Helper()
+		var actual string
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+			data, _ := os.ReadFile(filepath.Join(outDir, "child.json"))
+			if actual = string(data); actual == expected {
+				return
+			}
+		}
+		t.Fatalf("expected %q, got %q", expected, actual)
+	}
+	waitFor(`{"a":1}` + "\n")
+	_ = testutil.WriteTempJSON(t, dir, "conf.d/b.json", `{"b": 2}`)
+	waitFor(`{"b":2,"a":1}` + "\n")
+}
+
+func TestProcessNodeEntryKeys_OutDirKeepGoingManifest(t *testing.T) {
+	dir := t.TempDir()
+	for _, each := range []string{"base", filepath.Join("envs", "prod"), filepath.Join("envs", "dev")} {
+		if err := os.MkdirAll(filepath.Join(dir, each), 0o755); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	_ = testutil.WriteTempJSON(t, filepath.Join(dir, "base"), "common.json", `{"a": 1}`)
+	prod := testutil.WriteTempJSON(t, filepath.Join(dir, "envs", "prod"), "app.json", `{"$extends": ["../../base/common.json"], "env": "prod"}`)
+	broken := testutil.WriteTempJSON(t, filepath.Join(dir, "envs", "dev"), "app.json", `{"$extends": ["missing.json"]}`)
+	dev := testutil.WriteTempJSON(t, filepath.Join(dir, "envs", "dev"), "db.json", `{"$extends": ["../../base/common.json"]}`)
+	outDir := filepath.Join(dir, "dist")
+	opts := &options{outDir: outDir, outExt: "out", outputFormat: internal.OutputJSON, compactOutput: true, keepGoing: true, manifest: filepath.Join(outDir, "manifest.json")}
+	in := internal.Map([]string{prod, broken, dev}, func(each string) internal.NodeEntryKey {
+		return internal.NewNodeEntryKey(filepath.Dir(each), filepath.Base(each))
+	})
+	if exitCode := processNodeEntryKeys(in, opts); exitCode != 1 {
+		t.Errorf("expected exit code 1, got %d", exitCode)
+	}
+	for name, expected := range map[string]string{
+		filepath.Join("prod", "app.out"): `{"a":1,"env":"prod"}` + "\n",
+		filepath.Join("dev", "db.out"):   `{"a":1}` + "\n",
+	} {
+		data, err := os.ReadFile(filepath.Join(outDir, name))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if string(data) != expected {
+			t.Errorf("expected %q in %s, got %q", expected, name, string(data))
+		}
+	}
+	data, err := os.ReadFile(opts.manifest)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var m manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(m.Targets) != 3 {
+		t.Fatalf("expected 3 targets, got %+v", m.Targets)
+	}
+	if m.Targets[0].Output != filepath.Join(outDir, "prod", "app.out") || m.Targets[0].SHA256 != sha256Hex([]byte(`{"a":1,"env":"prod"}`+"\n")) || len(m.Targets[0].Dependencies) != 2 {
+		t.Errorf("unexpected manifest entry: %+v", m.Targets[0])
+	}
+	if m.Targets[1].Output != "" || m.Targets[1].Error == "" {
+		t.Errorf("unexpected manifest entry: %+v", m.Targets[1])
+	}
+	if m.Targets[2].Dependencies[0].SHA256 != sha256Hex([]byte(`{"a": 1}`)) {
+		t.Errorf("unexpected manifest entry: %+v", m.Targets[2])
+	}
+}
+
+func TestProcessNodeEntryKeys_StopsAtFirstFailure(t *testing.T) {
+	dir := t.TempDir()
+	broken := testutil.WriteTempJSON(t, dir, "a.json", `{"$extends": ["missing.json"]}`)
+	ok := testutil.WriteTempJSON(t, dir, "b.json", `{}`)
+	outDir := filepath.Join(dir, "dist")
+	in := internal.Map([]string{broken, ok}, func(each string) internal.NodeEntryKey {
+		return internal.NewNodeEntryKey(filepath.Dir(each), filepath.Base(each))
+	})
+	if exitCode := processNodeEntryKeys(in, &options{outDir: outDir, outputFormat: internal.OutputJSON}); exitCode != 1 {
+		t.Errorf("expected exit code 1, got %d", exitCode)
+	}
+	if _, err := os.Stat(filepath.Join(outDir, "b.json")); err == nil {
+		t.Errorf("expected no output after the first failure")
+	}
+}
+
+func TestProcessNodeEntryKeys_Jobs(t *testing.T) {
+	dir := t.TempDir()
+	_ = testutil.WriteTempJSON(t, dir, "parent.json", `{"a": 1}`)
+	var files []string
+	for i := 0; i < 8; i++ {
+		files = append(files, testutil.WriteTempJSON(t, dir, fmt.Sprintf("t%d.json", i), fmt.Sprintf(`{"$extends": ["parent.json"], "i": %d}`, i)))
+	}
+	outDir := filepath.Join(dir, "dist")
+	opts := &options{outDir: outDir, outputFormat: internal.OutputJSON, compactOutput: true, jobs: 4, manifest: filepath.Join(dir, "manifest.json")}
+	in := internal.Map(files, func(each string) internal.NodeEntryKey {
+		return internal.NewNodeEntryKey(filepath.Dir(each), filepath.Base(each))
+	})
+	if exitCode := processNodeEntryKeys(in, opts); exitCode != 0 {
+		t.Fatalf("expected exit code 0, got %d", exitCode)
+	}
+	data, err := os.ReadFile(opts.manifest)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var m manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for i, each := range m.Targets {
+		if each.Input != files[i] {
+			t.Errorf("expected %s at %d, got %s", files[i], i, each.Input)
+		}
+		data, err := os.ReadFile(each.Output)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if expected := fmt.Sprintf(`{"a":1,"i":%d}`+"\n", i); string(data) != expected {
+			t.Errorf("expected %q, got %q", expected, string(data))
+		}
+	}
+}
+
+func TestParseOptions(t *testing.T) {
+	opts, err := parseOptions([]string{"--validation=strict", "a.json", "b.json"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if opts.validationMode != internal.ValidationStrict || !reflect.DeepEqual(opts.files, []string{"a.json", "b.json"}) {
+		t.Errorf("unexpected options: %+v", opts)
+	}
+	if _, err := parseOptions([]string{"--validation", "sometimes"}); err == nil {
+		t.Errorf("expected error for unknown validation mode")
+	}
+}
+
+func TestParseOptions_Query(t *testing.T) {
+	opts, err := parseOptions([]string{"-q", ".a", "-r", "-c", "--arg", "x", "1", "--argjson", "y", `{"z": 1}`, "a.json"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if opts.query != ".a" || !opts.rawOutput || !opts.compactOutput || !reflect.DeepEqual(opts.files, []string{"a.json"}) {
+		t.Errorf("unexpected options: %+v", opts)
+	}
+	if !reflect.DeepEqual(opts.args, map[string]any{"x": "1", "y": map[string]any{"z": json.Number("1")}}) {
+		t.Errorf("unexpected args: %+v", opts.args)
+	}
+	if _, err := parseOptions([]string{"--argjson", "y", "{"}); err == nil {
+		t.Errorf("expected error for invalid JSON")
+	}
+	if _, err := parseOptions([]string{"--arg", "x"}); err == nil {
+		t.Errorf("expected error for missing value")
+	}
+}
+
+func TestParseOptions_SlurpfileAndAllowEnv(t *testing.T) {
+	dir := t.TempDir()
+	file := testutil.WriteTempJSON(t, dir, "values.json", `1 {"a": 2}`)
+	opts, err := parseOptions([]string{"--slurpfile", "s", file, "--allow-env=HOME,APP_*", "--allow-env", "USER"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(opts.args, map[string]any{"s": []any{json.Number("1"), map[string]any{"a": json.Number("2")}}}) {
+		t.Errorf("unexpected args: %+v", opts.args)
+	}
+	if !reflect.DeepEqual(opts.allowedEnv, []string{"HOME", "APP_*", "USER"}) {
+		t.Errorf("unexpected allowed env: %+v", opts.allowedEnv)
+	}
+	if _, err := parseOptions([]string{"--slurpfile", "s", filepath.Join(dir, "missing.json")}); err == nil {
+		t.Errorf("expected error for missing file")
+	}
+	if _, err := parseOptions([]string{"--allow-env", "["}); err == nil {
+		t.Errorf("expected error for invalid pattern")
+	}
+}
+
+func TestParseOptions_Watch(t *testing.T) {
+	opts, err := parseOptions([]string{"--watch", "--out", "dist", "a.json"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !opts.watch || opts.outDir != "dist" {
+		t.Errorf("unexpected options: %+v", opts)
+	}
+	if _, err := parseOptions([]string{"--manifest", "m.json", "a.json"}); err == nil {
+		t.Errorf("expected error for --manifest without --out-dir")
+	}
+	if _, err := parseOptions([]string{"--watch", "--out", "dist", "--manifest", "m.json", "a.json"}); err == nil || !strings.Contains(err.Error(), "--manifest cannot be used with --watch") {
+		t.Errorf("unexpected error for --manifest with --watch: %v", err)
+	}
+	if _, err := parseOptions([]string{"--watch", "-j", "4", "a.json"}); err == nil || !strings.Contains(err.Error(), "--jobs cannot be used with --watch") {
+		t.Errorf("unexpected error for --jobs with --watch: %v", err)
+	}
+}
+
+func TestParseOptions_Jobs(t *testing.T) {
+	opts, err := parseOptions([]string{"a.json"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if opts.jobs != 1 {
+		t.Errorf("expected 1 job by default, got %d", opts.jobs)
+	}
+	if opts, err = parseOptions([]string{"-j", "4", "a.json"}); err != nil || opts.jobs != 4 {
+		t.Errorf("unexpected result: %+v, %v", opts, err)
+	}
+	if _, err := parseOptions([]string{"--jobs=0"}); err == nil {
+		t.Errorf("expected error for zero jobs")
+	}
+}
+
+func TestParseOptions_Output(t *testing.T) {
+	opts, err := parseOptions([]string{"a.json"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if opts.outputFormat != internal.OutputJSON {
+		t.Errorf("expected json by default, got %q", opts.outputFormat)
+	}
+	opts, err = parseOptions([]string{"-o", "toml", "a.json"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if opts.outputFormat != internal.OutputTOML {
+		t.Errorf("expected toml, got %q", opts.outputFormat)
+	}
+	if _, err := parseOptions([]string{"--output=xml"}); err == nil {
+		t.Errorf("expected error for unknown output format")
+	}
+}
+
+func TestProcessNodeEntryKey_Stdin(t *testing.T) {
+	dir := t.TempDir()
+	_ = testutil.WriteTempJSON(t, dir, "parent.json", `{"a": 1}`)
+	nodeEntryKey := internal.NewNodeEntryKey(dir, stdinFilename)
+	for _, each := range []struct {
+		inputFormat internal.FileType
+		stdin       string
+	}{
+		{"", "$extends: [parent.json]\nb: 2\n"},
+		{internal.TOML, "\"$extends\" = [\"parent.json\"]\nb = 2\n"},
+	} {
+		result, err := processNodeEntryKey(nodeEntryKey, &options{inputFormat: each.inputFormat, stdin: []byte(each.stdin), compactOutput: true})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if expected := `{"a":1,"b":2}`; result != expected {
+			t.Errorf("expected %s, got %s", expected, result)
+		}
+	}
+}
+
+func TestInputFiles(t *testing.T) {
+	dir := t.TempDir()
+	in, err := inputFiles([]string{"a/b.json", "-"}, dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := []internal.NodeEntryKey{internal.NewNodeEntryKey("a", "b.json"), internal.NewNodeEntryKey(dir, "-")}
+	if !reflect.DeepEqual(in, expected) {
+		t.Errorf("expected %v, got %v", expected, in)
+	}
+	if in, err = inputFiles(nil, ""); err != nil || len(in) != 1 || !isStdin(in[0]) {
+		t.Errorf("expected stdin, got %v (%v)", in, err)
+	}
+	if _, err := inputFiles([]string{"-", "-"}, ""); err == nil {
+		t.Errorf("expected error for stdin given twice")
+	}
+}
+
+func TestParseOptions_InputFormat(t *testing.T) {
+	opts, err := parseOptions([]string{"--input-format=yaml", "--base-dir", "conf", "-"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if opts.inputFormat != internal.YAML || opts.baseDir != "conf" || !reflect.DeepEqual(opts.files, []string{"-"}) {
+		t.Errorf("unexpected options: %+v", opts)
+	}
+	if _, err := parseOptions([]string{"--input-format", "xml"}); err == nil {
+		t.Errorf("expected error for unknown input format")
+	}
+}
+
+func TestParseOptions_Cache(t *testing.T) {
+	opts, err := parseOptions([]string{"--cache-dir", "cache", "--no-cache", "a.json"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if opts.cacheDir != "cache" || !opts.noCache {
+		t.Errorf("unexpected options: %+v", opts)
+	}
+}
+
+func TestParseOptions_KeyOrder(t *testing.T) {
+	opts, err := parseOptions([]string{"--key-order", "child-first", "a.json"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if opts.keyOrderPolicy != internal.KeyOrderChildFirst {
+		t.Errorf("unexpected options: %+v", opts)
+	}
+	opts, err = parseOptions([]string{"--sort-keys", "a.json"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if opts.keyOrderPolicy != internal.KeyOrderSorted {
+		t.Errorf("unexpected options: %+v", opts)
+	}
+	if _, err := parseOptions([]string{"--key-order=random"}); err == nil {
+		t.Errorf("expected error for unknown key order")
+	}
+}
+
+func TestProcessNodeEntryKey_RawUnset(t *testing.T) {
+	dir := t.TempDir()
+	_ = testutil.WriteTempJSON(t, dir, "parent.json", `{"a": 1, "b": 2}`)
+	child := testutil.WriteTempJSON(t, dir, "child.json", `{"$extends": ["parent.json"], "a": "$unset", "b": "raw:$unset"}`)
+	result, err := processNodeEntryKey(internal.NewNodeEntryKey(filepath.Dir(child), filepath.Base(child)), &options{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected, _ := json.MarshalIndent(map[string]any{"b": "$unset"}, "", "  ")
+	if result != string(expected) {
+		t.Errorf("expected %v, got %v", string(expected), result)
+	}
+}
+
+func TestParseOptions_NestedTemplatingLevels(t *testing.T) {
+	opts, err := parseOptions([]string{"a.json"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if opts.nestedTemplatingLevels != internal.DefaultNestedTemplatingLevels {
+		t.Errorf("expected %d levels by default, got %d", internal.DefaultNestedTemplatingLevels, opts.nestedTemplatingLevels)
+	}
+	if opts, err = parseOptions([]string{"--nested-templating-levels", "2", "a.json"}); err != nil || opts.nestedTemplatingLevels != 2 {
+		t.Errorf("unexpected result: %+v, %v", opts, err)
+	}
+	if _, err := parseOptions([]string{"--nested-templating-levels=0"}); err == nil {
+		t.Errorf("expected error for zero levels")
+	}
+}
+
+func TestProcessNodeEntryKey_NestedTemplatingLevels(t *testing.T) {
+	dir := t.TempDir()
+	child := testutil.WriteTempJSON(t, dir, "child.json", `{"a": "eval:string:\"eval:string:\\\"x\\\"\""}`)
+	key := internal.NewNodeEntryKey(filepath.Dir(child), filepath.Base(child))
+	result, err := processNodeEntryKey(key, &options{nestedTemplatingLevels: 2})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected, _ := json.MarshalIndent(map[string]any{"a": "x"}, "", "  ")
+	if result != string(expected) {
+		t.Errorf("expected %v, got %v", string(expected), result)
+	}
+	if _, err := processNodeEntryKey(key, &options{nestedTemplatingLevels: 1}); err == nil || !strings.Contains(err.Error(), "within 1 levels") {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestProcessNodeEntryKey_NonObjectDocument(t *testing.T) {
+	dir := t.TempDir()
+	_ = testutil.WriteTempJSON(t, dir, "hosts.json", `["a", "b"]`)
+	child := testutil.WriteTempJSON(t, dir, "all.yaml", "$extends: [hosts.json]\n$merge: {.: append}\n$value: [c]\n")
+	key := internal.NewNodeEntryKey(filepath.Dir(child), filepath.Base(child))
+	for _, each := range []struct {
+		opts     *options
+		expected string
+	}{
+		{&options{compactOutput: true}, `["a","b","c"]`},
+		{&options{outputFormat: internal.OutputYAML}, "- a\n- b\n- c"},
+		{&options{query: ".[-1]", rawOutput: true}, "c"},
+		// Each element of an appended array tells the file it comes from.
+		{&options{explain: ".[0]"}, ".[0] = \"a\"\n  defined at " + filepath.Join(dir, "hosts.json") + ":1"},
+		{&options{explain: ".[2]"}, ".[2] = \"c\"\n  defined at " + child + ":3"},
+	} {
+		result, err := processNodeEntryKey(key, each.opts)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if result != each.expected {
+			t.Errorf("%+v: expected %q, got %q", each.opts, each.expected, result)
+		}
+	}
+	if _, err := processNodeEntryKey(key, &options{outputFormat: internal.OutputTOML}); err == nil || !strings.Contains(err.Error(), "not an object") {
+		t.Errorf("expected an error for TOML, got %v", err)
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/dakusui/jqplusplus/internal"
+)
+
+// options holds the parsed command line of jq++.
+type options struct {
+	help           bool
+	validationMode internal.ValidationMode
+	// outputFormat is the format in which rendered objects are printed. If empty, JSON is used.
+	outputFormat internal.OutputFormat
+	// query is a jq program applied to the rendered object, if not empty. Its results are printed instead of the object.
+	query string
+	// rawOutput prints string results without quotes, as `jq -r` does.
+	rawOutput bool
+	// compactOutput prints JSON on a single line, as `jq -c` does.
+	compactOutput bool
+	// args are the variables given by --arg, --argjson, and --slurpfile, keyed by their names without `$`.
+	// They are available to templates as well as to query.
+	args map[string]any
+	// allowedEnv are the names (or globs) of environment variables visible to expressions through `$ENV` and `env`.
+	allowedEnv []string
+	// watch keeps rendering files whenever files they depend on change.
+	watch bool
+	// outDir is the directory to which rendered files are written, mirroring the targets. If empty, stdout is used.
+	outDir string
+	// outExt is the extension, without a dot, of the files written to outDir. If empty, the output format's is used.
+	outExt string
+	// jobs is the number of targets rendered in parallel.
+	jobs int
+	// keepGoing renders the remaining targets after a failure.
+	keepGoing bool
+	// manifest is the file to which a manifest of rendered files is written, if not empty.
+	manifest string
+	// explain is a path expression whose origins are printed instead of the rendered object, if not empty.
+	explain string
+	// inputFormat is the format of stdin. If empty, it is told from the content.
+	inputFormat internal.FileType
+	// baseDir is the directory against which files stdin inherits from are resolved. If empty, the working directory
+	// is used.
+	baseDir string
+	// cacheDir is the directory in which resolved nodes are stored across runs. If empty, JF_CACHE_DIR is used.
+	cacheDir string
+	// noCache disables storing resolved nodes across runs, even if cacheDir or JF_CACHE_DIR is given.
+	noCache bool
+	// keyOrderPolicy decides the order of keys in rendered objects.
+	keyOrderPolicy internal.KeyOrderPolicy
+	// nestedTemplatingLevels is the number of times templating is applied to a value. If 0,
+	// internal.DefaultNestedTemplatingLevels is used.
+	nestedTemplatingLevels int
+	// files are the targets to be rendered, where "-" is stdin. If empty, stdin is read.
+	files []string
+	// stdin is the content of stdin, read beforehand if it is one of the targets.
+	stdin []byte
+}
+
+// parseOptions parses command line arguments (excluding the program name).
+// Options may be given either as `--name=value` or `--name value`. Everything after `--` is treated as a file.
+func parseOptions(args []string) (*options, error) {
+	ret := &options{validationMode: internal.ValidationNo, outputFormat: internal.OutputJSON, jobs: 1, nestedTemplatingLevels: internal.DefaultNestedTemplatingLevels}
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			ret.files = append(ret.files, args[i+1:]...)
+			break
+		}
+		if !strings.HasPrefix(arg, "-") || arg == "-" {
+			ret.files = append(ret.files, arg)
+			continue
+		}
+		name, value, hasValue := strings.Cut(arg, "=")
+		// nextValue returns the value of the current option, consuming the next argument if it was not given inline.
+		nextValue := func() (string, error) {
+			if hasValue {
+				return value, nil
+			}
+			if i+1 >= len(args) {
+				return "", fmt.Errorf("option %s requires a value", name)
+			}
+			i++
+			return args[i], nil
+		}
+		switch name {
+		case "-h", "--help":
+			ret.help = true
+		case "--validation":
+			v, err := nextValue()
+			if err != nil {
+				return nil, err
+			}
+			mode, err := internal.ParseValidationMode(v)
+			if err != nil {
+				return nil, err
+			}
+			ret.validationMode = mode
+		case "-o", "--output":
+			v, err := nextValue()
+			if err != nil {
+				return nil, err
+			}
+			format, err := internal.ParseOutputFormat(v)
+			if err != nil {
+				return nil, err
+			}
+			ret.outputFormat = format
+		case "-q", "--query":
+			v, err := nextValue()
+			if err != nil {
+				return nil, err
+			}
+			ret.query = v
+		case "-r", "--raw-output":
+			ret.rawOutput = true
+		case "-c", "--compact-output":
+			ret.compactOutput = true
+		case "--arg", "--argjson", "--slurpfile":
+			// As jq does, these options take two arguments, a name and a value.
+			if hasValue || i+2 >= len(args) {
+				return nil, fmt.Errorf("option %s requires a name and a value", name)
+			}
+			varName, arg := args[i+1], args[i+2]
+			i += 2
+			var v any = arg
+			switch name {
+			case "--argjson":
+				if err := internal.UnmarshalJSON([]byte(arg), &v); err != nil {
+					return nil, fmt.Errorf("invalid JSON for --argjson %s: %w", varName, err)
+				}
+			case "--slurpfile":
+				values, err := internal.ReadSlurpFile(arg)
+				if err != nil {
+					return nil, fmt.Errorf("invalid file for --slurpfile %s: %w", varName, err)
+				}
+				v = values
+			}
+			if ret.args == nil {
+				ret.args = map[string]any{}
+			}
+			ret.args[varName] = v
+		case "--allow-env":
+			v, err := nextValue()
+			if err != nil {
+				return nil, err
+			}
+			patterns := strings.Split(v, ",")
+			if _, err := internal.AllowedEnviron(nil, patterns); err != nil {
+				return nil, err
+			}
+			ret.allowedEnv = append(ret.allowedEnv, patterns...)
+		case "--watch":
+			ret.watch = true
+		case "--out", "--out-dir":
+			v, err := nextValue()
+			if err != nil {
+				return nil, err
+			}
+			ret.outDir = v
+		case "--out-ext":
+			v, err := nextValue()
+			if err != nil {
+				return nil, err
+			}
+			ret.outExt = strings.TrimPrefix(v, ".")
+		case "-j", "--jobs":
+			v, err := nextValue()
+			if err != nil {
+				return nil, err
+			}
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("invalid number of jobs: %q", v)
+			}
+			ret.jobs = n
+		case "--keep-going":
+			ret.keepGoing = true
+		case "--manifest":
+			v, err := nextValue()
+			if err != nil {
+				return nil, err
+			}
+			ret.manifest = v
+		case "--input-format":
+			v, err := nextValue()
+			if err != nil {
+				return nil, err
+			}
+			ft, err := internal.ParseInputFormat(v)
+			if err != nil {
+				return nil, err
+			}
+			ret.inputFormat = ft
+		case "--base-dir":
+			v, err := nextValue()
+			if err != nil {
+				return nil, err
+			}
+			ret.baseDir = v
+		case "--cache-dir":
+			v, err := nextValue()
+			if err != nil {
+				return nil, err
+			}
+			ret.cacheDir = v
+		case "--no-cache":
+			ret.noCache = true
+		case "--key-order":
+			v, err := nextValue()
+			if err != nil {
+				return nil, err
+			}
+			policy, err := internal.ParseKeyOrderPolicy(v)
+			if err != nil {
+				return nil, err
+			}
+			ret.keyOrderPolicy = policy
+		case "--sort-keys":
+			ret.keyOrderPolicy = internal.KeyOrderSorted
+		case "--nested-templating-levels":
+			v, err := nextValue()
+			if err != nil {
+				return nil, err
+			}
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("invalid number of nested templating levels: %q", v)
+			}
+			ret.nestedTemplatingLevels = n
+		case "--explain":
+			v, err := nextValue()
+			if err != nil {
+				return nil, err
+			}
+			if _, err := internal.PathExpressionToPathArray(v); err != nil {
+				return nil, fmt.Errorf("invalid path for --explain: %q: %w", v, err)
+			}
+			ret.explain = v
+		default:
+			return nil, fmt.Errorf("unknown option: %s", arg)
+		}
+	}
+	if ret.manifest != "" && ret.outDir == "" {
+		return nil, fmt.Errorf("option --manifest requires --out-dir")
+	}
+	if ret.watch && ret.explain != "" {
+		return nil, fmt.Errorf("option --explain cannot be used with --watch")
+	}
+	if ret.watch && ret.manifest != "" {
+		return nil, fmt.Errorf("option --manifest cannot be used with --watch")
+	}
+	if ret.watch && ret.jobs > 1 {
+		return nil, fmt.Errorf("option --jobs cannot be used with --watch")
+	}
+	return ret, nil
+}
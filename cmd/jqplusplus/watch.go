@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/dakusui/jqplusplus/internal"
+	"github.com/fsnotify/fsnotify"
+)
+
+// watchDebounce is how long watch waits for more changes after one, so that a burst of writes (e.g. an editor saving
+// a file through a temporary file) results in a single render.
+const watchDebounce = 100 * time.Millisecond
+
+// watch renders targets, and then renders each of them again whenever a file it depends on changes, until stop is
+// closed.
+// Rendered objects are written under opts.outDir as processNodeEntryKeys does if given, otherwise to stdout.
+// Render errors are written to stderr and do not stop watching.
+//
+// Directories containing the dependencies are watched rather than the files themselves, so that files replaced by
+// renaming, as many editors do, are still followed. Dependencies that are directories, i.e., the ones listed for
+// patterns in "$extends" or "$includes", are watched themselves as well, so that files added to them are noticed.
+func watch(in []internal.NodeEntryKey, opts *options, stdout, stderr io.Writer, stop <-chan struct{}) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = watcher.Close() }()
+
+	var outputs []string
+	if opts.outDir != "" {
+		if outputs, err = outputPaths(in, opts); err != nil {
+			return err
+		}
+	}
+	// dependencies holds the files each target depends on, in the same order as in.
+	dependencies := make([][]string, len(in))
+	watchedDirs := map[string]bool{}
+	render := func(session *internal.Session, i int) {
+		output, deps, err := renderNodeEntryKey(session, in[i], opts)
+		if target, absErr := filepath.Abs(in[i].String()); absErr == nil && !slices.Contains(deps, target) {
+			// The target is watched even if it could not be loaded, so that fixing it triggers a render.
+			deps = append(deps, target)
+		}
+		dependencies[i] = deps
+		for _, each := range deps {
+			dirs := []string{filepath.Dir(each)}
+			if info, err := os.Stat(each); err == nil && info.IsDir() {
+				dirs = append(dirs, each)
+			}
+			for _, dir := range dirs {
+				if watchedDirs[dir] {
+					continue
+				}
+				if err := watcher.Add(dir); err != nil {
+					_, _ = fmt.Fprintf(stderr, "Warning: failed to watch %s: %v\n", dir, err)
+					continue
+				}
+				watchedDirs[dir] = true
+			}
+		}
+		if err != nil {
+			_, _ = fmt.Fprintln(stderr, formatError(in[i], err))
+			return
+		}
+		if outputs == nil {
+			_, err = io.WriteString(stdout, output+"\n")
+		} else {
+			err = writeOutput(outputs[i], output)
+		}
+		if err != nil {
+			_, _ = fmt.Fprintf(stderr, "Error writing output for %s: %v\n", in[i], err)
+		}
+	}
+	// renderAll renders the targets selected by pred in a new session, since files cached in a previous one may have
+	// changed.
+	renderAll := func(pred func(i int) bool) {
+		session := newSession(opts)
+		for i := range in {
+			if pred(i) {
+				render(session, i)
+			}
+		}
+	}
+	renderAll(func(int) bool { return true })
+
+	changed := map[string]bool{}
+	var timer <-chan time.Time
+	for {
+		select {
+		case <-stop:
+			return nil
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			if event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Remove|fsnotify.Rename) == 0 {
+				continue
+			}
+			changed[filepath.Clean(event.Name)] = true
+			// A change of a file is a change of the directory it is in, if the directory is a dependency.
+			changed[filepath.Dir(filepath.Clean(event.Name))] = true
+			timer = time.After(watchDebounce)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			_, _ = fmt.Fprintf(stderr, "Warning: %v\n", err)
+		case <-timer:
+			timer = nil
+			renderAll(func(i int) bool {
+				return slices.ContainsFunc(dependencies[i], func(f string) bool { return changed[f] })
+			})
+			changed = map[string]bool{}
+		}
+	}
+}
@@ -0,0 +1,270 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// builtinDefinitions are jq-front built-in functions that are defined in jq itself.
+// `error` is defined here rather than through gojq.WithFunction because gojq's own `error` takes precedence over custom
+// functions.
+const builtinDefinitions = `def error(msg): msg | tostring | "ERROR: " + . | error;`
+
+// templatingSession holds the state shared by all the nodes evaluated in one templating stage, so that the built-in
+// functions can reach the whole document and evaluate referenced nodes on demand.
+type templatingSession struct {
+	// self is the document given to the templating stage, i.e., the content before any templating happens.
+	self map[string]any
+	// snapshot is the document against which expressions are evaluated.
+	// Results of evaluated nodes are written back to it, so that subsequent expressions see them.
+	snapshot map[string]any
+	// ttl limits how many times a node is re-evaluated when its result is another "eval:" string, i.e., the levels of
+	// nested templating.
+	ttl            int
+	invocationSpec InvocationSpec
+	// resolved holds results of nodes evaluated so far, keyed by pathKey.
+	resolved map[string]any
+	// evaluating is the stack of nodes being evaluated, used for detecting circular references.
+	evaluating [][]any
+}
+
+func newTemplatingSession(self map[string]any, snapshot map[string]any, ttl int, invocationSpec InvocationSpec) *templatingSession {
+	return &templatingSession{
+		self:           self,
+		snapshot:       snapshot,
+		ttl:            ttl,
+		invocationSpec: invocationSpec,
+		resolved:       map[string]any{},
+	}
+}
+
+// invocationSpecFor returns an InvocationSpec for evaluating an expression found at curn, with the built-in functions
+// registered.
+// cur is bound to the `$cur` variable.
+func (s *templatingSession) invocationSpecFor(curn []any, cur []any) *InvocationSpec {
+	return FromSpec(&s.invocationSpec).
+		AddVariable("$cur", cur).
+		AddDefinitions(builtinDefinitions).
+		AddFunctions(s.builtinFunctions(curn)...).
+		Build()
+}
+
+// builtinFunctions returns jq-front built-in functions for an expression found at curn.
+//
+//   - ref(path): the value of the node at path, evaluating "eval:" and "raw:" strings in it on demand.
+//   - self: the document before any templating happens.
+//   - curn: the path to the node that makes the call.
+//   - cur: the path to the container of the node that makes the call.
+//   - parent, parent(path): the path to the parent of the input or given path.
+//
+// Paths can be given either as path arrays (e.g. ["a","b",0]) or path expressions (e.g. ".a.b[0]").
+// curn and cur return path arrays, and parent returns a path in the same form as it is given.
+// As in jq-front, the root is the empty path expression "", e.g., parent(".a") returns "".
+func (s *templatingSession) builtinFunctions(curn []any) []*JqFunction {
+	return []*JqFunction{
+		{Name: "ref", MinArity: 1, MaxArity: 1, Callback: func(_ any, args []any) any {
+			p, err := toPathArray(args[0])
+			if err != nil {
+				return fmt.Errorf("ref: %w", err)
+			}
+			v, err := s.resolve(p)
+			if err != nil {
+				return fmt.Errorf("ref: %w", err)
+			}
+			return v
+		}},
+		{Name: "self", MinArity: 0, MaxArity: 0, Callback: func(_ any, _ []any) any {
+			return DeepCopy(s.self)
+		}},
+		{Name: "curn", MinArity: 0, MaxArity: 0, Callback: func(_ any, _ []any) any {
+			return ToAnySlice(curn)
+		}},
+		{Name: "cur", MinArity: 0, MaxArity: 0, Callback: func(_ any, _ []any) any {
+			return DropLast(curn)
+		}},
+		{Name: "parent", MinArity: 0, MaxArity: 1, Callback: func(input any, args []any) any {
+			if len(args) > 0 {
+				input = args[0]
+			}
+			ret, err := parentPath(input)
+			if err != nil {
+				return fmt.Errorf("parent: %w", err)
+			}
+			return ret
+		}},
+	}
+}
+
+// resolve returns the value at path p, with every "eval:" and "raw:" string in it evaluated.
+func (s *templatingSession) resolve(p []any) (any, error) {
+	v, ok := GetAtPath(s.snapshot, p)
+	if !ok {
+		pe, _ := PathArrayToPathExpression(p)
+		return nil, fmt.Errorf("path not found: %s", pe)
+	}
+	switch x := v.(type) {
+	case string:
+		if !isTemplatingString(x) {
+			return x, nil
+		}
+		return s.evaluateNode(p)
+	case map[string]any, []any:
+		if err := s.evaluateNodesUnder(p, x); err != nil {
+			return nil, err
+		}
+		ret, _ := GetAtPath(s.snapshot, p)
+		return DeepCopy(ret), nil
+	default:
+		return x, nil
+	}
+}
+
+// evaluateNodesUnder evaluates every "eval:" and "raw:" string in v, which is the container at path p.
+func (s *templatingSession) evaluateNodesUnder(p []any, v any) error {
+	for _, e := range StringEntries(map[string]any{"": v}, isTemplatingString) {
+		if _, err := s.evaluateNode(append(DeepCopyAs(p), e.Path[1:]...)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// evaluateNode evaluates the "eval:" or "raw:" string at path p and stores the result in the snapshot at p.
+// If the result is another "eval:" string, it is evaluated again at the same path, up to ttl times.
+// If the result is a container that has "eval:" or "raw:" strings in it, they are evaluated, too.
+func (s *templatingSession) evaluateNode(p []any) (any, error) {
+	key := pathKey(p)
+	if v, ok := s.resolved[key]; ok {
+		return v, nil
+	}
+	for _, each := range s.evaluating {
+		if pathKey(each) == key {
+			str, _ := GetAtPath(s.snapshot, p)
+			return nil, &EvalError{
+				Path:       p,
+				Expression: fmt.Sprint(str),
+				Err:        fmt.Errorf("circular reference detected: %s", formatPathChain(append(s.evaluating, p))),
+			}
+		}
+	}
+	s.evaluating = append(s.evaluating, p)
+	defer func() { s.evaluating = s.evaluating[:len(s.evaluating)-1] }()
+
+	v, _ := GetAtPath(s.snapshot, p)
+	for i := 0; ; i++ {
+		str, ok := v.(string)
+		if !ok || !isTemplatingString(str) {
+			break
+		}
+		if i >= s.ttl {
+			return nil, &EvalError{Path: p, Expression: str, Err: fmt.Errorf("templating did not finish within %d levels", s.ttl)}
+		}
+		w, err := s.evaluateString(p, str)
+		if err != nil {
+			return nil, err
+		}
+		v = w
+		if strings.HasPrefix(str, prefixRaw) {
+			// The result of "raw:" is never evaluated again.
+			break
+		}
+	}
+	if !PutAtPath(s.snapshot, p, v) {
+		return nil, &EvalError{Path: p, Err: fmt.Errorf("failed to put value")}
+	}
+	switch v.(type) {
+	case map[string]any, []any:
+		if err := s.evaluateNodesUnder(p, v); err != nil {
+			return nil, err
+		}
+		v, _ = GetAtPath(s.snapshot, p)
+	}
+	s.resolved[key] = v
+	return v, nil
+}
+
+// evaluateString evaluates a single "eval:" or "raw:" string found at path p.
+// An error is returned as *EvalError, unless it already tells where it occurred, e.g., in a node referenced through
+// `ref`.
+func (s *templatingSession) evaluateString(p []any, str string) (any, error) {
+	if strings.HasPrefix(str, prefixRaw) {
+		return str[len(prefixRaw):], nil
+	}
+	expr, expectedType := extractExpressionAndExpectedType(str[len(prefixEval):])
+	ret, err := ApplyJQExpression(s.snapshot, expr, []JSONType{expectedType}, *s.invocationSpecFor(p, p))
+	if err != nil {
+		if located, ok := asLocatedError(err); ok {
+			return nil, located
+		}
+		return nil, &EvalError{Path: p, Expression: str, Err: err}
+	}
+	return ret, nil
+}
+
+func isTemplatingString(v string) bool {
+	return strings.HasPrefix(v, prefixEval) || strings.HasPrefix(v, prefixRaw)
+}
+
+// toPathArray converts a path given to a built-in function into a path array.
+func toPathArray(v any) ([]any, error) {
+	switch x := v.(type) {
+	case string:
+		if x == "" {
+			// The root, which parent gives for a top-level path.
+			return []any{}, nil
+		}
+		return PathExpressionToPathArray(x)
+	case []any:
+		ret := make([]any, len(x))
+		for i, each := range x {
+			switch y := each.(type) {
+			case string:
+				ret[i] = y
+			case int:
+				ret[i] = y
+			case float64:
+				if y != float64(int(y)) {
+					return nil, fmt.Errorf("invalid path element: %v", y)
+				}
+				ret[i] = int(y)
+			case json.Number:
+				n, err := y.Int64()
+				if err != nil {
+					return nil, fmt.Errorf("invalid path element: %v", y)
+				}
+				ret[i] = int(n)
+			default:
+				return nil, fmt.Errorf("invalid path element: %v (%T)", y, y)
+			}
+		}
+		return ret, nil
+	default:
+		return nil, fmt.Errorf("path must be a string or an array: %v (%T)", v, v)
+	}
+}
+
+// parentPath returns the parent of a path, in the same form (path expression or path array) as it is given.
+func parentPath(v any) (any, error) {
+	p, err := toPathArray(v)
+	if err != nil {
+		return nil, err
+	}
+	if len(p) == 0 {
+		return nil, fmt.Errorf("root node has no parent")
+	}
+	if _, ok := v.(string); ok {
+		return PathArrayToPathExpression(DropLast(p))
+	}
+	return DropLast(p), nil
+}
+
+func formatPathChain(paths [][]any) string {
+	return strings.Join(Map(paths, func(p []any) string {
+		ret, err := PathArrayToPathExpression(p)
+		if err != nil || ret == "" {
+			return "."
+		}
+		return ret
+	}), " -> ")
+}
@@ -0,0 +1,159 @@
+package internal
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestProcessValueSide_Ref(t *testing.T) {
+	input := map[string]any{
+		"a": map[string]any{"b": map[string]any{"c": "hello"}},
+		"r": `eval:string:ref(".a.b.c") + ", world"`,
+		"o": `eval:object:ref(["a", "b"])`,
+	}
+	result, err := ProcessValueSide(input, 7, EmptyInvocationSpec())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := map[string]any{
+		"a": map[string]any{"b": map[string]any{"c": "hello"}},
+		"r": "hello, world",
+		"o": map[string]any{"c": "hello"},
+	}
+	if !reflect.DeepEqual(expected, result) {
+		t.Errorf("expected %v, got %v", expected, result)
+	}
+}
+
+func TestProcessValueSide_RefEvaluatesOnDemand(t *testing.T) {
+	input := map[string]any{
+		"releaseVersion":  "eval:string:\"2.12.\" + (1 + 1 | tostring)",
+		"snapshotVersion": `eval:string:ref(".releaseVersion") + "-SNAPSHOT"`,
+		"nested":          `eval:object:ref(".o")`,
+		"o":               map[string]any{"x": `eval:string:ref(".snapshotVersion")`},
+	}
+	result, err := ProcessValueSide(input, 7, EmptyInvocationSpec())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := map[string]any{
+		"releaseVersion":  "2.12.2",
+		"snapshotVersion": "2.12.2-SNAPSHOT",
+		"nested":          map[string]any{"x": "2.12.2-SNAPSHOT"},
+		"o":               map[string]any{"x": "2.12.2-SNAPSHOT"},
+	}
+	if !reflect.DeepEqual(expected, result) {
+		t.Errorf("expected %v, got %v", expected, result)
+	}
+}
+
+func TestProcessValueSide_RefCircular_ThenFail(t *testing.T) {
+	input := map[string]any{"a": `eval:ref(".b")`, "b": `eval:ref(".a")`}
+	_, err := ProcessValueSide(input, 7, EmptyInvocationSpec())
+	if err == nil || !strings.Contains(err.Error(), "circular reference detected") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestProcessValueSide_RefMissing_ThenFail(t *testing.T) {
+	input := map[string]any{"a": `eval:ref(".missing")`}
+	_, err := ProcessValueSide(input, 7, EmptyInvocationSpec())
+	if err == nil || !strings.Contains(err.Error(), "path not found: .missing") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestProcessValueSide_Self(t *testing.T) {
+	input := map[string]any{"a": "raw:hello", "b": `eval:string:self.a | ascii_upcase`}
+	result, err := ProcessValueSide(input, 7, EmptyInvocationSpec())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := map[string]any{"a": "hello", "b": "RAW:HELLO"}
+	if !reflect.DeepEqual(expected, result) {
+		t.Errorf("expected %v, got %v", expected, result)
+	}
+}
+
+func TestProcessValueSide_CurnCurAndParent(t *testing.T) {
+	input := map[string]any{
+		"a": map[string]any{
+			"b": []any{"eval:array:curn", "eval:array:cur"},
+			"c": `eval:string:parent(".hello.world")`,
+			"d": "eval:array:curn | parent",
+			"e": `eval:string:ref(cur + ["c"])`,
+		},
+	}
+	result, err := ProcessValueSide(input, 7, EmptyInvocationSpec())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := map[string]any{
+		"a": map[string]any{
+			"b": []any{[]any{"a", "b", json.Number("0")}, []any{"a", "b"}},
+			"c": ".hello",
+			"d": []any{"a"},
+			"e": ".hello",
+		},
+	}
+	if !reflect.DeepEqual(expected, result) {
+		t.Errorf("expected %v, got %v", expected, result)
+	}
+}
+
+func TestProcessValueSide_ParentOfTopLevelPath(t *testing.T) {
+	input := map[string]any{
+		"a": `eval:string:parent(".a")`,
+		"b": `eval:array:parent(["b"])`,
+	}
+	result, err := ProcessValueSide(input, 7, EmptyInvocationSpec())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := map[string]any{
+		"a": "",
+		"b": []any{},
+	}
+	if !reflect.DeepEqual(expected, result) {
+		t.Errorf("expected %v, got %v", expected, result)
+	}
+	// The root given back to parent has none.
+	if _, err := ProcessValueSide(map[string]any{"a": `eval:string:parent(".a") | parent`}, 7, EmptyInvocationSpec()); err == nil || !strings.Contains(err.Error(), "root node has no parent") {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestProcessValueSide_Error_ThenFail(t *testing.T) {
+	input := map[string]any{"a": `eval:error("something went wrong")`}
+	_, err := ProcessValueSide(input, 7, EmptyInvocationSpec())
+	if err == nil || !strings.Contains(err.Error(), "ERROR: something went wrong") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestProcessKeySide_Cur(t *testing.T) {
+	input := map[string]any{"x": map[string]any{"eval:cur | join(\"-\")": "X", "name": "y"}, "eval:ref(\".x.name\")": "Y"}
+	result, err := ProcessKeySide(input, 7, EmptyInvocationSpec())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := map[string]any{"x": map[string]any{"x": "X", "name": "y"}, "y": "Y"}
+	if !reflect.DeepEqual(expected, result) {
+		t.Errorf("expected %v, got %v", expected, result)
+	}
+}
+
+func TestPathExpressionToPathArray(t *testing.T) {
+	p, err := PathExpressionToPathArray(`.a["b.c"][0]`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(p, []any{"a", "b.c", 0}) {
+		t.Errorf("unexpected path: %v", p)
+	}
+	if _, err := PathExpressionToPathArray(`1`); err == nil {
+		t.Errorf("expected error for non-path expression")
+	}
+}
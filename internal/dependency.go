@@ -0,0 +1,342 @@
+package internal
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/itchyny/gojq"
+)
+
+// EvaluationOrder returns the paths of "eval:" and "raw:" string nodes in obj, ordered so that each node comes after
+// the nodes whose values it reads.
+//
+// The paths read by an expression are found by analyzing it statically: index chains applied to the input document
+// (e.g. `.a.b[0]`) and calls of `ref` or `getpath` with constant arguments are taken into account.
+// A node that reads one of its own ancestors (e.g. the container it belongs to) does not depend on other nodes through
+// the read, since such a read concerns the structure around the node rather than values of its siblings.
+// A node whose expression reads the document in a way that cannot be told statically (e.g. `. as $d | $d.a`) comes
+// after all the other nodes, except for the ones that read it.
+//
+// If the nodes reference each other circularly, including a node reading itself, an *EvalError listing the paths in
+// the cycle is returned.
+func EvaluationOrder(obj map[string]any) ([][]any, error) {
+	entries := Sort(StringEntries(obj, isTemplatingString), func(a, b Entry) bool {
+		return lessPathArrays(a.Path, b.Path)
+	})
+	reads := Map(entries, func(e Entry) [][]any {
+		s := e.Value.(string)
+		if !strings.HasPrefix(s, prefixEval) {
+			return nil
+		}
+		expr, _ := extractExpressionAndExpectedType(s[len(prefixEval):])
+		// Unparsable expressions are reported when they are evaluated.
+		ret, _ := ExpressionReadPaths(expr)
+		return ret
+	})
+	dependencies := make([][]int, len(entries))
+	opaque := make([]bool, len(entries))
+	for i, e := range entries {
+		for _, r := range reads[i] {
+			if len(r) == 0 {
+				opaque[i] = true
+			}
+			if isPathPrefix(r, e.Path) && len(r) < len(e.Path) {
+				continue
+			}
+			// A read of the node itself, or of anything in its result, makes the node depend on itself.
+			for j, f := range entries {
+				if isPathPrefix(r, f.Path) || isPathPrefix(f.Path, r) {
+					dependencies[i] = append(dependencies[i], j)
+				}
+			}
+		}
+	}
+	for i := range entries {
+		if !opaque[i] {
+			continue
+		}
+		readers := dependentsOf(i, dependencies)
+		for j := range entries {
+			if !opaque[j] && !readers[j] {
+				dependencies[i] = append(dependencies[i], j)
+			}
+		}
+	}
+
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	states := make([]int, len(entries))
+	var stack []int
+	var ret [][]any
+	var visit func(i int) error
+	visit = func(i int) error {
+		switch states[i] {
+		case visited:
+			return nil
+		case visiting:
+			var cycle [][]any
+			for k := len(stack) - 1; k >= 0; k-- {
+				cycle = Insert(cycle, 0, entries[stack[k]].Path)
+				if stack[k] == i {
+					break
+				}
+			}
+			return &EvalError{
+				Path:       entries[i].Path,
+				Expression: entries[i].Value.(string),
+				Err:        fmt.Errorf("circular reference detected: %s", formatPathChain(append(cycle, entries[i].Path))),
+			}
+		}
+		states[i] = visiting
+		stack = append(stack, i)
+		for _, j := range dependencies[i] {
+			if err := visit(j); err != nil {
+				return err
+			}
+		}
+		stack = stack[:len(stack)-1]
+		states[i] = visited
+		ret = append(ret, entries[i].Path)
+		return nil
+	}
+	for i := range entries {
+		if err := visit(i); err != nil {
+			return nil, err
+		}
+	}
+	return ret, nil
+}
+
+// dependentsOf returns the nodes that depend on node i, directly or indirectly, including i itself.
+func dependentsOf(i int, dependencies [][]int) []bool {
+	ret := make([]bool, len(dependencies))
+	ret[i] = true
+	for changed := true; changed; {
+		changed = false
+		for j, each := range dependencies {
+			if !ret[j] && slices.ContainsFunc(each, func(k int) bool { return ret[k] }) {
+				ret[j] = true
+				changed = true
+			}
+		}
+	}
+	return ret
+}
+
+// ExpressionReadPaths returns the paths in the input document that a jq expression reads, as far as they can be
+// determined statically.
+// An empty path is returned if the expression may read anything in the document, e.g., through the document bound to a
+// variable, an iteration, or a function applied to it.
+func ExpressionReadPaths(expression string) ([][]any, error) {
+	query, err := gojq.Parse(expression)
+	if err != nil {
+		return nil, err
+	}
+	var ret [][]any
+	collectReadPathsFromQuery(query, true, &ret)
+	return DistinctBy(ret, pathKey), nil
+}
+
+// collectReadPathsFromQuery walks a query. onInput tells if the query is applied to the input document itself.
+func collectReadPathsFromQuery(q *gojq.Query, onInput bool, out *[][]any) {
+	if q == nil {
+		return
+	}
+	if q.Term != nil {
+		collectReadPathsFromTerm(q.Term, onInput, out)
+	}
+	collectReadPathsFromQuery(q.Left, onInput, out)
+	// The right-hand side of a pipe is applied to the output of the left-hand side, except for a binding
+	// (`E as $x | body`), whose body is applied to the same input as E.
+	collectReadPathsFromQuery(q.Right, onInput && (q.Op != gojq.OpPipe || q.Patterns != nil), out)
+}
+
+func collectReadPathsFromTerm(t *gojq.Term, onInput bool, out *[][]any) {
+	switch t.Type {
+	case gojq.TermTypeIdentity, gojq.TermTypeIndex:
+		if onInput {
+			var p []any
+			if t.Type == gojq.TermTypeIndex {
+				p = appendConstantIndex(p, t.Index)
+			}
+			if p != nil || t.Type == gojq.TermTypeIdentity {
+				for _, s := range t.SuffixList {
+					if s.Index == nil {
+						break
+					}
+					q := appendConstantIndex(p, s.Index)
+					if q == nil {
+						break
+					}
+					p = q
+				}
+				if len(p) > 0 {
+					*out = append(*out, p)
+				}
+			}
+			if len(p) == 0 {
+				// The document itself, or an index that is not constant, e.g., `.[$k]`.
+				*out = append(*out, []any{})
+			}
+		}
+		if t.Index != nil {
+			collectReadPathsFromIndex(t.Index, onInput, out)
+		}
+	case gojq.TermTypeRecurse:
+		if onInput {
+			*out = append(*out, []any{})
+		}
+	case gojq.TermTypeFunc:
+		switch {
+		case !onInput || strings.HasPrefix(t.Func.Name, "$"):
+			// Arguments of functions may be applied to anything (e.g. elements in `map(f)`), thus not tracked.
+		case (t.Func.Name == "ref" || t.Func.Name == "getpath") && len(t.Func.Args) == 1:
+			if p, ok := constantPath(t.Func.Args[0]); ok && len(p) > 0 {
+				*out = append(*out, p)
+			} else {
+				*out = append(*out, []any{})
+			}
+		case (t.Func.Name == "parent" || t.Func.Name == "error") && len(t.Func.Args) == 1:
+			collectReadPathsFromQuery(t.Func.Args[0], onInput, out)
+		case !documentFreeFunctions[t.Func.Name] || len(t.Func.Args) > 0:
+			*out = append(*out, []any{})
+		}
+	case gojq.TermTypeObject:
+		for _, kv := range t.Object.KeyVals {
+			collectReadPathsFromString(kv.KeyString, onInput, out)
+			collectReadPathsFromQuery(kv.KeyQuery, onInput, out)
+			collectReadPathsFromQuery(kv.Val, onInput, out)
+		}
+	case gojq.TermTypeArray:
+		collectReadPathsFromQuery(t.Array.Query, onInput, out)
+	case gojq.TermTypeUnary:
+		collectReadPathsFromTerm(t.Unary.Term, onInput, out)
+	case gojq.TermTypeFormat, gojq.TermTypeString:
+		if t.Type == gojq.TermTypeFormat && t.Str == nil && onInput {
+			// A format such as `@base64` applied to the document.
+			*out = append(*out, []any{})
+		}
+		collectReadPathsFromString(t.Str, onInput, out)
+	case gojq.TermTypeIf:
+		collectReadPathsFromQuery(t.If.Cond, onInput, out)
+		collectReadPathsFromQuery(t.If.Then, onInput, out)
+		for _, e := range t.If.Elif {
+			collectReadPathsFromQuery(e.Cond, onInput, out)
+			collectReadPathsFromQuery(e.Then, onInput, out)
+		}
+		collectReadPathsFromQuery(t.If.Else, onInput, out)
+	case gojq.TermTypeTry:
+		collectReadPathsFromQuery(t.Try.Body, onInput, out)
+		collectReadPathsFromQuery(t.Try.Catch, false, out)
+	case gojq.TermTypeReduce:
+		collectReadPathsFromQuery(t.Reduce.Query, onInput, out)
+		collectReadPathsFromQuery(t.Reduce.Start, onInput, out)
+	case gojq.TermTypeForeach:
+		collectReadPathsFromQuery(t.Foreach.Query, onInput, out)
+		collectReadPathsFromQuery(t.Foreach.Start, onInput, out)
+	case gojq.TermTypeLabel:
+		collectReadPathsFromQuery(t.Label.Body, onInput, out)
+	case gojq.TermTypeQuery:
+		collectReadPathsFromQuery(t.Query, onInput, out)
+	}
+	for _, s := range t.SuffixList {
+		if s.Index != nil {
+			collectReadPathsFromIndex(s.Index, onInput, out)
+		}
+	}
+}
+
+// documentFreeFunctions are the functions that do not read their input when called without arguments.
+var documentFreeFunctions = map[string]bool{
+	"self": true, "curn": true, "cur": true, "env": true, "now": true, "empty": true, "input_filename": true,
+	"builtins": true, "halt": true,
+}
+
+// collectReadPathsFromIndex walks queries computing an index (e.g. `.a[.i]`), which are applied to the same input as
+// the indexed term.
+func collectReadPathsFromIndex(i *gojq.Index, onInput bool, out *[][]any) {
+	collectReadPathsFromString(i.Str, onInput, out)
+	collectReadPathsFromQuery(i.Start, onInput, out)
+	collectReadPathsFromQuery(i.End, onInput, out)
+}
+
+func collectReadPathsFromString(s *gojq.String, onInput bool, out *[][]any) {
+	if s == nil {
+		return
+	}
+	for _, q := range s.Queries {
+		collectReadPathsFromQuery(q, onInput, out)
+	}
+}
+
+// appendConstantIndex appends an index to p if it is a constant key or array index. Otherwise, it returns nil.
+func appendConstantIndex(p []any, i *gojq.Index) []any {
+	if i.IsSlice {
+		return nil
+	}
+	if i.Name != "" {
+		return append(append([]any{}, p...), i.Name)
+	}
+	if i.Str != nil {
+		if len(i.Str.Queries) > 0 {
+			return nil
+		}
+		return append(append([]any{}, p...), i.Str.Str)
+	}
+	if i.Start != nil && i.Start.Term != nil && i.Start.Left == nil {
+		switch i.Start.Term.Type {
+		case gojq.TermTypeString:
+			if len(i.Start.Term.Str.Queries) == 0 && len(i.Start.Term.SuffixList) == 0 {
+				return append(append([]any{}, p...), i.Start.Term.Str.Str)
+			}
+		case gojq.TermTypeNumber:
+			if n, err := strconv.Atoi(i.Start.Term.Number); err == nil {
+				return append(append([]any{}, p...), n)
+			}
+		}
+	}
+	return nil
+}
+
+// constantPath returns the path given as a constant argument, either a path expression string or a path array.
+func constantPath(q *gojq.Query) ([]any, bool) {
+	if q.Term == nil || q.Left != nil || len(q.Term.SuffixList) > 0 {
+		return nil, false
+	}
+	switch q.Term.Type {
+	case gojq.TermTypeString:
+		if len(q.Term.Str.Queries) > 0 {
+			return nil, false
+		}
+		p, err := PathExpressionToPathArray(q.Term.Str.Str)
+		return p, err == nil
+	case gojq.TermTypeArray:
+		// A literal array such as ["a", "b", 0] evaluates to itself regardless of the input.
+		v, ok := q.Run(nil).Next()
+		if !ok {
+			return nil, false
+		}
+		p, err := toPathArray(v)
+		return p, err == nil
+	default:
+		return nil, false
+	}
+}
+
+// isPathPrefix tells if prefix is a prefix of (or equal to) p.
+func isPathPrefix(prefix []any, p []any) bool {
+	if len(prefix) > len(p) {
+		return false
+	}
+	for i := range prefix {
+		if prefix[i] != p[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,166 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestExpressionReadPaths(t *testing.T) {
+	for _, c := range []struct {
+		expression string
+		expected   [][]any
+	}{
+		{`.a.b[0]`, [][]any{{"a", "b", 0}}},
+		{`.a | .b`, [][]any{{"a"}}},
+		{`.a as $x | .b`, [][]any{{"a"}, {"b"}}},
+		{`ref(".x.y") + ref(["z", 1])`, [][]any{{"x", "y"}, {"z", 1}}},
+		{`"\(.a)-\(.["b.c"])"`, [][]any{{"a"}, {"b.c"}}},
+		{`{k: .k} | map(.v)`, [][]any{{"k"}}},
+		{`if .c then .t else .e end`, [][]any{{"c"}, {"t"}, {"e"}}},
+		{`.a[.i]`, [][]any{{"a"}, {"i"}}},
+		{`$cur | tostring`, [][]any{}},
+		{`curn | parent`, [][]any{}},
+		{`. as $d | $d.y`, [][]any{{}}},
+		{`getpath($cur)`, [][]any{{}}},
+		{`[paths]`, [][]any{{}}},
+		{`.[] | .a`, [][]any{{}}},
+	} {
+		actual, err := ExpressionReadPaths(c.expression)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", c.expression, err)
+			continue
+		}
+		if !reflect.DeepEqual(actual, c.expected) {
+			t.Errorf("%s: expected %v, got %v", c.expression, c.expected, actual)
+		}
+	}
+}
+
+func TestEvaluationOrder(t *testing.T) {
+	obj := map[string]any{
+		"a": "eval:.b + .c",
+		"b": "eval:.c",
+		"c": "raw:hello",
+		"d": map[string]any{"x": "eval:.d.y", "y": "eval:.a"},
+	}
+	order, err := EvaluationOrder(obj)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := [][]any{{"c"}, {"b"}, {"a"}, {"d", "y"}, {"d", "x"}}
+	if !reflect.DeepEqual(order, expected) {
+		t.Errorf("expected %v, got %v", expected, order)
+	}
+}
+
+func TestEvaluationOrder_Cycle_ThenFail(t *testing.T) {
+	obj := map[string]any{"a": "eval:.b", "b": map[string]any{"c": "eval:.d"}, "d": "eval:.a"}
+	_, err := EvaluationOrder(obj)
+	if err == nil || !strings.Contains(err.Error(), "circular reference detected: .a -> .b.c -> .d -> .a") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestEvaluationOrder_SelfRead_ThenFail(t *testing.T) {
+	for _, each := range []string{"eval:.a", "eval:.a.b"} {
+		_, err := EvaluationOrder(map[string]any{"a": each})
+		if err == nil || !strings.Contains(err.Error(), "circular reference detected: .a -> .a") {
+			t.Errorf("%s: unexpected error: %v", each, err)
+		}
+	}
+}
+
+func TestEvaluationOrder_UnresolvableReads(t *testing.T) {
+	obj := map[string]any{
+		"a": "eval:. as $d | $d.z",
+		"b": "eval:.a",
+		"y": "eval:.z",
+		"z": "raw:!",
+	}
+	order, err := EvaluationOrder(obj)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := [][]any{{"z"}, {"y"}, {"a"}, {"b"}}
+	if !reflect.DeepEqual(order, expected) {
+		t.Errorf("expected %v, got %v", expected, order)
+	}
+}
+
+func TestProcessValueSide_DependencyOrder(t *testing.T) {
+	input := map[string]any{
+		"a": "eval:.b + \"!\"",
+		"b": "eval:.c.x",
+		"c": "eval:object:{x: \"hello\"}",
+		"l": "eval:number:.a | length",
+	}
+	result, err := ProcessValueSide(input, 7, EmptyInvocationSpec())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := map[string]any{"a": "hello!", "b": "hello", "c": map[string]any{"x": "hello"}, "l": json.Number("6")}
+	if !reflect.DeepEqual(expected, result) {
+		t.Errorf("expected %v, got %v", expected, result)
+	}
+}
+
+func TestProcessValueSide_NestedTemplatingInResult(t *testing.T) {
+	input := map[string]any{
+		"a": `eval:object:{x: "eval:string:ref(\".b\")", y: "raw:eval:"}`,
+		"b": "eval:\"eval:\\\"hi\\\"\"",
+	}
+	result, err := ProcessValueSide(input, 7, EmptyInvocationSpec())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := map[string]any{"a": map[string]any{"x": "hi", "y": "eval:"}, "b": "hi"}
+	if !reflect.DeepEqual(expected, result) {
+		t.Errorf("expected %v, got %v", expected, result)
+	}
+}
+
+func TestProcessValueSide_ReadThroughVariable(t *testing.T) {
+	input := map[string]any{
+		"x": "eval:. as $d | $d.y",
+		"y": "eval:string:\"hi\" + .z",
+		"z": "eval:\"!\"",
+	}
+	result, err := ProcessValueSide(input, 5, EmptyInvocationSpec())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := map[string]any{"x": "hi!", "y": "hi!", "z": "!"}
+	if !reflect.DeepEqual(expected, result) {
+		t.Errorf("expected %v, got %v", expected, result)
+	}
+}
+
+func TestProcessValueSide_SelfRead_ThenFail(t *testing.T) {
+	_, err := ProcessValueSide(map[string]any{"a": "eval:.a"}, 5, EmptyInvocationSpec())
+	if err == nil || !strings.Contains(err.Error(), "circular reference detected: .a -> .a") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestProcessValueSide_Cycle_ThenFail(t *testing.T) {
+	input := map[string]any{"a": "eval:.b", "b": "eval:.a"}
+	_, err := ProcessValueSide(input, 7, EmptyInvocationSpec())
+	if err == nil || !strings.Contains(err.Error(), "circular reference detected: .a -> .b -> .a") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestProcessValueSide_TemplatingLevelsExceeded_ThenFail(t *testing.T) {
+	input := map[string]any{"a": "eval:\"eval:\\\"hi\\\"\""}
+	_, err := ProcessValueSide(input, 1, EmptyInvocationSpec())
+	var evalError *EvalError
+	if !errors.As(err, &evalError) || !strings.Contains(err.Error(), "templating did not finish within 1 levels") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if evalError.Location() != ".a" {
+		t.Errorf("unexpected location: %q", evalError.Location())
+	}
+}
@@ -0,0 +1,142 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// LocatedError is an error that knows where in the input it occurred.
+// Location and Detail are meant to be printed in a compiler-like format, i.e., "<location>: error: <detail>".
+type LocatedError interface {
+	error
+	// Location returns the place where the error occurred, such as "file.json:3" or "file.json: .a.b".
+	Location() string
+	// Detail returns the description of the error without its location.
+	Detail() string
+}
+
+// LoadError is an error that occurred while reading or parsing a file.
+type LoadError struct {
+	File string
+	// Line is the 1-based line number at which the error occurred, or 0 if unknown.
+	Line int
+	Err  error
+}
+
+func (e *LoadError) Location() string {
+	if e.Line > 0 {
+		return e.File + ":" + strconv.Itoa(e.Line)
+	}
+	return e.File
+}
+
+func (e *LoadError) Detail() string {
+	return e.Err.Error()
+}
+
+func (e *LoadError) Error() string {
+	return e.Location() + ": " + e.Detail()
+}
+
+func (e *LoadError) Unwrap() error {
+	return e.Err
+}
+
+// InheritanceError is an error that occurred while resolving "$extends" or "$includes".
+type InheritanceError struct {
+	// File is the file in which the directive was found.
+	File string
+	// Path is the path array to the node that has the directive.
+	Path []any
+	// Directive is either "$extends" or "$includes".
+	Directive string
+	// Parent is the entry in the directive that failed, if any.
+	Parent string
+	Err    error
+}
+
+func (e *InheritanceError) Location() string {
+	return formatLocation(e.File, e.Path)
+}
+
+func (e *InheritanceError) Detail() string {
+	if e.Parent != "" {
+		return fmt.Sprintf("%s: %q: %s", e.Directive, e.Parent, e.Err)
+	}
+	if e.Directive != "" {
+		return e.Directive + ": " + e.Err.Error()
+	}
+	return e.Err.Error()
+}
+
+func (e *InheritanceError) Error() string {
+	return e.Location() + ": " + e.Detail()
+}
+
+func (e *InheritanceError) Unwrap() error {
+	return e.Err
+}
+
+// EvalError is an error that occurred while evaluating a jq expression in a key or a value.
+type EvalError struct {
+	// File is the file being rendered. It may be empty when the error is raised, and filled later by WithSourceFile.
+	File string
+	// Path is the path array to the node whose key or value was being evaluated.
+	Path []any
+	// Expression is the text of the key or the value being evaluated.
+	Expression string
+	Err        error
+}
+
+func (e *EvalError) Location() string {
+	return formatLocation(e.File, e.Path)
+}
+
+func (e *EvalError) Detail() string {
+	if e.Expression != "" {
+		return fmt.Sprintf("%q: %s", e.Expression, e.Err)
+	}
+	return e.Err.Error()
+}
+
+func (e *EvalError) Error() string {
+	return e.Location() + ": " + e.Detail()
+}
+
+func (e *EvalError) Unwrap() error {
+	return e.Err
+}
+
+// WithSourceFile fills the file of an EvalError in err's chain, if it is not known yet, and returns err.
+func WithSourceFile(err error, file string) error {
+	var evalError *EvalError
+	if errors.As(err, &evalError) && evalError.File == "" {
+		evalError.File = file
+	}
+	return err
+}
+
+// asLocatedError returns the innermost-reported LocatedError in err's chain, if any.
+// It is used to avoid wrapping an error that already tells where it occurred.
+func asLocatedError(err error) (LocatedError, bool) {
+	var located LocatedError
+	if errors.As(err, &located) {
+		return located, true
+	}
+	return nil, false
+}
+
+func formatLocation(file string, path []any) string {
+	p, err := PathArrayToPathExpression(path)
+	if err != nil {
+		p = fmt.Sprint(path)
+	}
+	if p == "" {
+		p = "."
+	}
+	if file == "" {
+		return p
+	}
+	return file + ": " + p
+}
@@ -0,0 +1,111 @@
+package internal
+
+import (
+	"errors"
+	"github.com/dakusui/jqplusplus/internal/testutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestProcessValueSide_BrokenExpression_ThenEvalError(t *testing.T) {
+	input := map[string]any{"a": map[string]any{"b": "eval:.x | foo"}}
+	_, err := ProcessValueSide(input, 7, EmptyInvocationSpec())
+	var evalError *EvalError
+	if !errors.As(err, &evalError) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(evalError.Path, []any{"a", "b"}) || evalError.Expression != "eval:.x | foo" {
+		t.Errorf("unexpected error: %#v", evalError)
+	}
+	if !strings.Contains(evalError.Detail(), "function not defined: foo/0") {
+		t.Errorf("unexpected detail: %s", evalError.Detail())
+	}
+}
+
+func TestProcessValueSide_BrokenReferencedNode_ThenEvalErrorAtReferencedNode(t *testing.T) {
+	input := map[string]any{"a": "eval:ref(\".b\")", "b": "eval:error(\"boom\")"}
+	_, err := ProcessValueSide(input, 7, EmptyInvocationSpec())
+	var evalError *EvalError
+	if !errors.As(err, &evalError) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if evalError.Location() != ".b" || !strings.Contains(evalError.Detail(), "ERROR: boom") {
+		t.Errorf("unexpected error: %v", evalError)
+	}
+}
+
+func TestProcessKeySide_NonStringKey_ThenEvalError(t *testing.T) {
+	input := map[string]any{"a": map[string]any{"eval:1": "x"}}
+	_, err := ProcessKeySide(input, 7, EmptyInvocationSpec())
+	var evalError *EvalError
+	if !errors.As(err, &evalError) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if evalError.Location() != ".a" || evalError.Expression != "eval:1" {
+		t.Errorf("unexpected error: %v", evalError)
+	}
+}
+
+func TestProcessKeySide_ArrayOfKeys(t *testing.T) {
+	input := map[string]any{"eval:array:[\"x\",\"y\"]": 1}
+	result, err := ProcessKeySide(input, 7, EmptyInvocationSpec())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := map[string]any{"x": 1, "y": 1}
+	if !reflect.DeepEqual(expected, result) {
+		t.Errorf("expected %v, got %v", expected, result)
+	}
+}
+
+func TestProcessKeySide_NestedKeys(t *testing.T) {
+	input := map[string]any{"eval:\"a\"": map[string]any{"eval:$cur | join(\"-\")": 1}}
+	result, err := ProcessKeySide(input, 7, EmptyInvocationSpec())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := map[string]any{"a": map[string]any{"a": 1}}
+	if !reflect.DeepEqual(expected, result) {
+		t.Errorf("expected %v, got %v", expected, result)
+	}
+}
+
+func TestLoadAndResolveInheritances_SyntaxError_ThenLoadErrorWithLine(t *testing.T) {
+	dir := t.TempDir()
+	file := testutil.WriteTempJSON(t, dir, "broken.json", "{\n  \"a\": 1,\n  x\n}")
+	_, err := LoadAndResolveInheritances(filepath.Dir(file), filepath.Base(file), []string{})
+	var loadError *LoadError
+	if !errors.As(err, &loadError) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if loadError.Line != 3 || !strings.HasSuffix(loadError.Location(), "broken.json:3") {
+		t.Errorf("unexpected error: %v", loadError)
+	}
+}
+
+func TestLoadAndResolveInheritances_MissingParentInNestedNode_ThenInheritanceError(t *testing.T) {
+	dir := t.TempDir()
+	child := testutil.WriteTempJSON(t, dir, "child.json", `{"a": {"b": {"$extends": ["missing.json"]}}}`)
+	_, err := LoadAndResolveInheritances(filepath.Dir(child), filepath.Base(child), []string{})
+	var inheritanceError *InheritanceError
+	if !errors.As(err, &inheritanceError) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.HasSuffix(inheritanceError.File, "child.json") ||
+		!reflect.DeepEqual(inheritanceError.Path, []any{"a", "b"}) ||
+		inheritanceError.Directive != "$extends" ||
+		inheritanceError.Parent != "missing.json" ||
+		!errors.Is(err, ErrFileNotFound) {
+		t.Errorf("unexpected error: %#v", inheritanceError)
+	}
+}
+
+func TestWithSourceFile(t *testing.T) {
+	err := WithSourceFile(&EvalError{Path: []any{"a", 0}, Expression: "eval:x", Err: errors.New("boom")}, "f.json")
+	expected := `f.json: .a[0]: "eval:x": boom`
+	if err.Error() != expected {
+		t.Errorf("expected %q, got %q", expected, err.Error())
+	}
+}
@@ -1,13 +1,20 @@
 package internal
 
 import (
+	"encoding/json"
 	"fmt"
+	"math/big"
 	"reflect"
 	"strings"
 
 	"github.com/itchyny/gojq"
 )
 
+const (
+	prefixRaw  = "raw:"
+	prefixEval = "eval:"
+)
+
 type JSONType int
 
 const (
@@ -51,17 +58,9 @@ func ApplyJQExpression(
 	expectedTypes []JSONType,
 	invocationSpec InvocationSpec,
 ) (any, error) {
-	// Parse the jq expression
-	expressionWithImportStatements := composeExpressionString(expression, invocationSpec.ModuleNames())
-	query, err := gojq.Parse(expressionWithImportStatements)
-	if err != nil {
-		return nil, fmt.Errorf("failed to parse jq expression: '%v' <%w>", expressionWithImportStatements, err)
-	}
-
-	// Compile the jq query (this is where custom functions/modules are wired in)
-	code, err := gojq.Compile(query, append(invocationSpec.CompilerOptions(), gojq.WithVariables(invocationSpec.VariableNames()))...)
+	code, err := compileJQExpression(expression, invocationSpec)
 	if err != nil {
-		return nil, fmt.Errorf("failed to compile jq expression: %w", err)
+		return nil, err
 	}
 
 	// Run the compiled jq code
@@ -79,20 +78,62 @@ func ApplyJQExpression(
 		return nil, fmt.Errorf("error while executing jq expression: %w", err)
 	}
 
+	result = NormalizeNumbers(result)
 	// Validate and return the result based on the expected type
 	expected := isExpected(result, expectedTypes...)
 	if !expected {
-		return nil, fmt.Errorf("result type mismatch: expected one of %s but got %T", expectedTypes, result)
+		return nil, fmt.Errorf("result type mismatch: expected one of %s but got %s", expectedTypes, jsonTypeName(result))
 	}
 	return result, nil
 }
 
-func composeExpressionString(expression string, moduleNames []string) string {
-	joinedModuleNames := Map(moduleNames, func(each string) string {
-		return fmt.Sprintf(`import "%s" as %s`, each, each)
+// ApplyJQFilter applies a jq expression to the provided input like jq does, and returns all the results it produces,
+// in order.
+// Unlike ApplyJQExpression, the results are not checked against any type.
+func ApplyJQFilter(input any, expression string, invocationSpec InvocationSpec) ([]any, error) {
+	code, err := compileJQExpression(expression, invocationSpec)
+	if err != nil {
+		return nil, err
+	}
+	ret := []any{}
+	iter := code.Run(input, invocationSpec.VariableValues()...)
+	for {
+		result, ok := iter.Next()
+		if !ok {
+			break
+		}
+		if err, isErr := result.(error); isErr {
+			return nil, fmt.Errorf("error while executing jq expression: %w", err)
+		}
+		ret = append(ret, NormalizeNumbers(result))
+	}
+	return ret, nil
+}
+
+// compileJQExpression parses a jq expression and compiles it with the modules, functions, definitions, and variables
+// in invocationSpec.
+func compileJQExpression(expression string, invocationSpec InvocationSpec) (*gojq.Code, error) {
+	// Parse the jq expression
+	expressionWithImportStatements := composeExpressionString(expression, invocationSpec.ModuleNames(), invocationSpec.Definitions())
+	query, err := gojq.Parse(expressionWithImportStatements)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse jq expression: '%v' <%w>", expressionWithImportStatements, err)
+	}
+
+	// Compile the jq query (this is where custom functions/modules are wired in)
+	code, err := gojq.Compile(query, append(invocationSpec.CompilerOptions(), gojq.WithVariables(invocationSpec.VariableNames()))...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compile jq expression: %w", err)
+	}
+	return code, nil
+}
+
+func composeExpressionString(expression string, moduleNames []string, definitions []string) string {
+	importStatements := Map(moduleNames, func(each string) string {
+		return fmt.Sprintf(`import "%s" as %s;`, each, each)
 	})
-	expressionString := strings.Join(append(joinedModuleNames, expression), "; ")
-	return expressionString
+	// Function definitions must follow import statements, and both must precede the expression.
+	return strings.Join(append(append(importStatements, definitions...), expression), " ")
 }
 
 func isExpected(v any, expectedTypes ...JSONType) bool {
@@ -103,6 +144,9 @@ func isExpected(v any, expectedTypes ...JSONType) bool {
 				return true
 			}
 		case Array:
+			if v == nil {
+				continue
+			}
 			k := reflect.TypeOf(v).Kind()
 			if k == reflect.Slice || k == reflect.Array {
 				return true
@@ -119,6 +163,10 @@ func isExpected(v any, expectedTypes ...JSONType) bool {
 				return true
 			case int64:
 				return true
+			case json.Number:
+				return true
+			case *big.Int:
+				return true
 			default:
 				continue
 			}
@@ -137,28 +185,60 @@ func isExpected(v any, expectedTypes ...JSONType) bool {
 	return false
 }
 
-func toStringArray(v any) []string {
+func toStringArray(v any) ([]string, error) {
 	switch x := v.(type) {
 	case string:
-		return []string{v.(string)}
+		return []string{x}, nil
 	case []string:
-		return v.([]string)
+		return x, nil
+	case []any:
+		ret := make([]string, len(x))
+		for i, each := range x {
+			s, ok := each.(string)
+			if !ok {
+				return nil, fmt.Errorf("array must contain only strings: %v", v)
+			}
+			ret[i] = s
+		}
+		return ret, nil
 	default:
-		panic(fmt.Sprintf("Unexpected type: %v (%v)", x, v))
+		return nil, fmt.Errorf("unexpected type: %v (%T)", v, v)
 	}
 }
 
+// DefaultNestedTemplatingLevels is the default of the ttl given to ProcessKeySide and ProcessValueSide, i.e., the
+// number of times templating is applied to a value.
+const DefaultNestedTemplatingLevels = 5
+
+// ProcessKeySide resolves keys that begin with "eval:" or "raw:".
+// An "eval:" key is evaluated as a jq expression that yields a string or an array of strings, and the entry is copied
+// under each of the resulting keys.
+// The jq-front built-in functions are available in the expressions, where `self` refers to obj.
+//
+// A key nested in another "eval:" or "raw:" key is resolved in the pass after the outer one, so that it sees the
+// resolved key of its container.
+// Errors are returned as *EvalError, which tells the path and the text of the offending key.
 func ProcessKeySide(obj map[string]any, ttl int, invocationSpec InvocationSpec) (map[string]any, error) {
+	ret, _, err := processKeySide(obj, obj, nil, ttl, invocationSpec)
+	return ret, err
+}
+
+// ProcessKeySideWithKeyOrder works like ProcessKeySide, and additionally returns the key order of the result made from
+// keyOrder, the one of obj, where the keys an entry is copied under take the place of the key it was under.
+func ProcessKeySideWithKeyOrder(obj map[string]any, keyOrder *KeyOrder, ttl int, invocationSpec InvocationSpec) (map[string]any, *KeyOrder, error) {
+	return processKeySide(obj, obj, keyOrder, ttl, invocationSpec)
+}
+
+func processKeySide(self map[string]any, obj map[string]any, keyOrder *KeyOrder, ttl int, invocationSpec InvocationSpec) (map[string]any, *KeyOrder, error) {
 	keyHavingPrefixForProcessing := func(path []any) bool {
-		last := path[len(path)-1]
-		switch last.(type) {
-		case string:
-			break
-		default:
-			return false
+		for i, each := range path {
+			key, ok := each.(string)
+			if ok && isTemplatingString(key) {
+				// Only the outermost key in a path is processed in a pass.
+				return i == len(path)-1
+			}
 		}
-		key := last.(string)
-		return strings.HasPrefix(key, "eval:") || strings.HasPrefix(key, "raw:")
+		return false
 	}
 	type keyChange struct {
 		// The last element must be a string
@@ -167,61 +247,66 @@ func ProcessKeySide(obj map[string]any, ttl int, invocationSpec InvocationSpec)
 		After []string
 	}
 	// Process keys
-	pathsToBeProcessed := Paths(obj, keyHavingPrefixForProcessing)
+	pathsToBeProcessed := Sort(Paths(obj, keyHavingPrefixForProcessing), lessPathArrays)
 	if len(pathsToBeProcessed) == 0 {
-		return obj, nil
+		return obj, keyOrder, nil
 	}
 	if ttl <= 0 {
-		panic(fmt.Sprintf("ttl is 0, %v entries left.(%v)", len(pathsToBeProcessed), pathsToBeProcessed))
+		p := pathsToBeProcessed[0]
+		return nil, nil, &EvalError{
+			Path:       DropLast(p),
+			Expression: p[len(p)-1].(string),
+			Err:        fmt.Errorf("templating of keys did not finish within given levels; %d keys left", len(pathsToBeProcessed)),
+		}
 	}
-	keyChanges := Map(pathsToBeProcessed, func(p []any) keyChange {
-		str := p[len(p)-1]
-		if strings.HasPrefix(str.(string), "raw:") {
-			return keyChange{
-				Before: p,
-				After:  []string{str.(string)[len("raw:"):]},
-			}
-		} else if strings.HasPrefix(str.(string), "eval:") {
-			expr, t := extractExpressionAndExpectedType(str.(string)[len("eval:"):])
-			if t != String && t != Array {
-				panic(fmt.Sprintf("Last element of path must be a string or an array: %v", p))
-			}
-			spec := FromSpec(&invocationSpec).
-				AddVariable("$cur", p[0:len(p)-1]).
-				Build()
-			v, err := ApplyJQExpression(obj, expr, []JSONType{String, Array}, *spec)
-			if err != nil {
-				panic(fmt.Sprintf("Failed to evaluate jq expression: %v", err))
-			}
-			w := toStringArray(v)
-			ret := keyChange{
+	// Values referenced from keys are evaluated on a copy, since the value side is processed later on its own.
+	session := newTemplatingSession(self, DeepCopyAs(obj), ttl, invocationSpec)
+	keyChanges := make([]keyChange, 0, len(pathsToBeProcessed))
+	for _, p := range pathsToBeProcessed {
+		str := p[len(p)-1].(string)
+		if strings.HasPrefix(str, prefixRaw) {
+			keyChanges = append(keyChanges, keyChange{
 				Before: p,
-				After:  w,
+				After:  []string{str[len(prefixRaw):]},
+			})
+			continue
+		}
+		expr, t := extractExpressionAndExpectedType(str[len(prefixEval):])
+		if t != String && t != Array {
+			return nil, nil, &EvalError{Path: DropLast(p), Expression: str, Err: fmt.Errorf("key must be evaluated as a string or an array, but %s is specified", t)}
+		}
+		spec := session.invocationSpecFor(p, p[0:len(p)-1])
+		v, err := ApplyJQExpression(obj, expr, []JSONType{String, Array}, *spec)
+		if err != nil {
+			if located, ok := asLocatedError(err); ok {
+				return nil, nil, located
 			}
-			return ret
+			return nil, nil, &EvalError{Path: DropLast(p), Expression: str, Err: err}
 		}
-		panic(fmt.Sprintf("Last element of path must start with eval: or raw: %v", p))
-	})
+		w, err := toStringArray(v)
+		if err != nil {
+			return nil, nil, &EvalError{Path: DropLast(p), Expression: str, Err: err}
+		}
+		keyChanges = append(keyChanges, keyChange{
+			Before: p,
+			After:  w,
+		})
+	}
 	ret := DeepCopyAs(obj)
 	for _, c := range keyChanges {
-		var v any
-		v, ok := GetAtPath(ret, c.Before)
-		if !ok {
-			panic(fmt.Sprintf("failed to find key: %v", c.Before))
-		}
-		if !RemovePath(ret, c.Before) {
-			panic(fmt.Sprintf("Missing path: %v", c.Before))
-		}
+		v, _ := GetAtPath(ret, c.Before)
+		RemovePath(ret, c.Before)
 		for _, l := range c.After {
 			p := DeepCopyAs(c.Before)
 			p[len(p)-1] = l
 			PutAtPath(ret, p, DeepCopyAs(v))
 		}
+		keyOrder = keyOrder.renameKey(c.Before, c.After)
 	}
-	return ProcessKeySide(ret, ttl-1, invocationSpec)
+	return processKeySide(self, ret, keyOrder, ttl-1, invocationSpec)
 }
 
-// ProcessValueSide recursively processes and resolves special string values within a JSON-like object.
+// ProcessValueSide processes and resolves special string values within a JSON-like object.
 //
 // It looks for string values in the input object that begin with special prefixes:
 //   - "eval:" indicates that the value should be interpreted as a jq expression and evaluated in the context of the object.
@@ -231,71 +316,37 @@ func ProcessKeySide(obj map[string]any, ttl int, invocationSpec InvocationSpec)
 //   - "raw:..." → just strips the prefix and uses the remaining string.
 //   - "eval:..." → evaluates the jq expression and replaces the value with the result.
 //
-// This function is recursive and will perform these replacements for all matching entries, repeatedly decreasing `ttl` (time-to-live)
-// to prevent infinite recursion (useful if some expressions resolve into further "eval:" entries).
+// The jq-front built-in functions (ref, self, curn, cur, parent, and error) are available in the expressions.
+// `ref` evaluates the referenced node on demand, and `self` returns Obj as it was given to this function.
+//
+// Each entry is evaluated exactly once, in the order given by EvaluationOrder, i.e., after the entries whose values
+// its expression reads.
+// Results are written back immediately, so that subsequent expressions see evaluated values.
 //
 // Arguments:
 //
 //	Obj: A map[string]any representing a JSON object which may contain strings with "eval:" or "raw:" prefixes.
-//	ttl: A recursion depth limit to avoid infinite loops (panics if reaches zero with unresolved entries).
+//	ttl: The levels of nested templating, i.e., how many times an entry is re-evaluated when its result is
+//	     another "eval:" string.
 //
 // Returns:
 //
 //	A new object map[string]any with all special entries resolved.
-//	An error if any "eval:" expression fails to evaluate.
-//
-// Panics if ttl reaches zero and some entries remain unresolved.
+//	An error if any "eval:" expression fails to evaluate, entries reference each other circularly, or templating
+//	does not finish within ttl levels.
 func ProcessValueSide(obj map[string]any, ttl int, invocationSpec InvocationSpec) (map[string]any, error) {
-	const prefixRaw = "raw:"
-	const prefixEval = "eval:"
-	entries := StringEntries(obj, func(v string) bool {
-		if strings.HasPrefix(v, prefixEval) {
-			return true
-		}
-		if strings.HasPrefix(v, prefixRaw) {
-			return true
-		}
-		return false
-	})
-	if len(entries) == 0 {
-		return obj, nil
-	}
-	if ttl <= 0 {
-		panic(fmt.Sprintf("ttl is 0, %v entries left.(%v)", len(entries), entries))
-	}
-	newObj := DeepCopyAs(obj)
-	var newEntries []Entry
-	for _, e := range entries {
-		v := e.Value.(string)
-		var n Entry
-		if strings.HasPrefix(v, prefixRaw) {
-			n = Entry{e.Path, v[len(prefixRaw):]}
-		} else if strings.HasPrefix(v, prefixEval) {
-			var expectedType JSONType
-			w := v[len(prefixEval):]
-			w, expectedType = extractExpressionAndExpectedType(w)
-			spec := FromSpec(&invocationSpec).
-				AddVariable("$cur", e.Path).
-				Build()
-			x, err := ApplyJQExpression(newObj, w, []JSONType{expectedType}, *spec)
-			if err != nil {
-				return nil, err
-			}
-			n = Entry{e.Path, x}
-		} else {
-			panic(fmt.Sprintf("Fishy value was found: %v (in %v)", v, e))
-		}
-		newEntries = append(newEntries, n)
+	ret := DeepCopyAs(obj)
+	order, err := EvaluationOrder(ret)
+	if err != nil {
+		return nil, err
 	}
-	for _, e := range newEntries {
-		p := e.Path
-		v := e.Value
-
-		if !PutAtPath(newObj, p, v) {
-			panic(fmt.Sprintf("failed to put value at path %v", p))
+	session := newTemplatingSession(obj, ret, ttl, invocationSpec)
+	for _, p := range order {
+		if _, err := session.evaluateNode(p); err != nil {
+			return nil, err
 		}
 	}
-	return ProcessValueSide(newObj, ttl-1, invocationSpec)
+	return ret, nil
 }
 
 func extractExpressionAndExpectedType(expr string) (string, JSONType) {
@@ -1,6 +1,7 @@
 package internal
 
 import (
+	"encoding/json"
 	"reflect"
 	"testing"
 )
@@ -21,37 +22,37 @@ func TestEval_a(t *testing.T) {
 func TestEval_c(t *testing.T) {
 	input := map[string]any{"a": "Hello", "b": "X", "c": 1.0, "d": 234, "e": 12345678901234567}
 	expression := `.c`
-	expected := 1.0
+	expected := json.Number("1")
 	v, err := ApplyJQExpression(input, expression, []JSONType{Number}, EmptyInvocationSpec())
 	if err != nil {
 		t.Errorf("Failed to apply '%s' to '%s': %s", input, expression, err)
 	}
 	if v != expected {
-		t.Errorf("Expected '%f' but got '%s'", expected, v)
+		t.Errorf("Expected '%s' but got '%s'", expected, v)
 	}
 }
 func TestEval_d(t *testing.T) {
 	input := map[string]any{"a": "Hello", "b": "X", "c": 1.0, "d": 234, "e": 12345678901234567}
 	expression := `.d`
-	expected := 234
+	expected := json.Number("234")
 	v, err := ApplyJQExpression(input, expression, []JSONType{Number}, EmptyInvocationSpec())
 	if err != nil {
 		t.Errorf("Failed to apply '%s' to '%s': %s", input, expression, err)
 	}
 	if v != expected {
-		t.Errorf("Expected '%d' but got '%s'", expected, v)
+		t.Errorf("Expected '%s' but got '%s'", expected, v)
 	}
 }
 func TestEval_e(t *testing.T) {
 	input := map[string]any{"a": "Hello", "b": "X", "c": 1.0, "d": 234, "e": 12345678901234567}
 	expression := `.e`
-	expected := 12345678901234567
+	expected := json.Number("12345678901234567")
 	v, err := ApplyJQExpression(input, expression, []JSONType{Number}, EmptyInvocationSpec())
 	if err != nil {
 		t.Errorf("Failed to apply '%s' to '%s': %s", input, expression, err)
 	}
 	if v != expected {
-		t.Errorf("Expected '%d' but got '%s'", expected, v)
+		t.Errorf("Expected '%s' but got '%s'", expected, v)
 	}
 }
 
@@ -114,3 +115,45 @@ func TestProcessKeySide_2(t *testing.T) {
 		t.Errorf("Expected '%s', but got '%s'", expected, result)
 	}
 }
+
+func TestApplyJQFilter(t *testing.T) {
+	spec := NewInvocationSpecBuilder().AddVariable("$n", float64(10)).Build()
+	result, err := ApplyJQFilter(map[string]any{"a": []any{float64(1), float64(2)}}, ".a[] + $n", *spec)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(result, []any{json.Number("11"), json.Number("12")}) {
+		t.Errorf("unexpected result: %v", result)
+	}
+}
+
+func TestApplyJQFilter_NoResult(t *testing.T) {
+	result, err := ApplyJQFilter(map[string]any{}, "empty", *NewInvocationSpecBuilder().Build())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(result) != 0 {
+		t.Errorf("unexpected result: %v", result)
+	}
+}
+
+func TestApplyJQExpression_TypeMismatch_ThenJSONTypeNames(t *testing.T) {
+	for _, each := range []struct {
+		expression string
+		expected   string
+	}{
+		{"1", "result type mismatch: expected one of [string] but got number"},
+		{"true", "result type mismatch: expected one of [string] but got boolean"},
+		{"null", "result type mismatch: expected one of [string] but got null"},
+		{"[1]", "result type mismatch: expected one of [string] but got array"},
+		{"{}", "result type mismatch: expected one of [string] but got object"},
+	} {
+		_, err := ApplyJQExpression(map[string]any{}, each.expression, []JSONType{String}, EmptyInvocationSpec())
+		if err == nil || err.Error() != each.expected {
+			t.Errorf("%s: expected %q, got %v", each.expression, each.expected, err)
+		}
+	}
+	if _, err := ApplyJQExpression(map[string]any{}, "null", []JSONType{Array}, EmptyInvocationSpec()); err == nil || err.Error() != "result type mismatch: expected one of [array] but got null" {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
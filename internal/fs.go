@@ -0,0 +1,224 @@
+package internal
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FileSystem is where nodes are loaded from.
+// Names are in the form of the OS's paths, either absolute or relative to the working directory, so that a
+// FileSystem can be used in place of the functions in the os package.
+type FileSystem interface {
+	Stat(name string) (fs.FileInfo, error)
+	ReadFile(name string) ([]byte, error)
+	// ReadDir returns the entries of a directory sorted by their names.
+	ReadDir(name string) ([]fs.DirEntry, error)
+	// Abs returns an absolute representation of name.
+	Abs(name string) (string, error)
+}
+
+// OSFileSystem returns the FileSystem of the OS.
+func OSFileSystem() FileSystem {
+	return osFileSystem{}
+}
+
+type osFileSystem struct{}
+
+func (osFileSystem) Stat(name string) (fs.FileInfo, error) { return os.Stat(name) }
+
+func (osFileSystem) ReadFile(name string) ([]byte, error) { return os.ReadFile(name) }
+
+func (osFileSystem) ReadDir(name string) ([]fs.DirEntry, error) { return os.ReadDir(name) }
+
+func (osFileSystem) Abs(name string) (string, error) { return filepath.Abs(name) }
+
+// NewFileSystem makes a FileSystem of fsys, such as an embed.FS or a fstest.MapFS.
+// The root of fsys is the root directory ("/") of the FileSystem, which is also its working directory, i.e., both
+// "/a/b.json" and "a/b.json" refer to "a/b.json" in fsys.
+func NewFileSystem(fsys fs.FS) FileSystem {
+	return ioFileSystem{fsys: fsys}
+}
+
+type ioFileSystem struct {
+	fsys fs.FS
+}
+
+func (f ioFileSystem) Stat(name string) (fs.FileInfo, error) { return fs.Stat(f.fsys, f.fsName(name)) }
+
+func (f ioFileSystem) ReadFile(name string) ([]byte, error) {
+	return fs.ReadFile(f.fsys, f.fsName(name))
+}
+
+func (f ioFileSystem) ReadDir(name string) ([]fs.DirEntry, error) {
+	return fs.ReadDir(f.fsys, f.fsName(name))
+}
+
+func (f ioFileSystem) Abs(name string) (string, error) {
+	return filepath.Join(string(filepath.Separator), name), nil
+}
+
+// fsName converts a name into the form io/fs requires, i.e., an unrooted, slash-separated path.
+func (f ioFileSystem) fsName(name string) string {
+	ret := strings.TrimPrefix(filepath.ToSlash(filepath.Join(string(filepath.Separator), name)), "/")
+	if ret == "" {
+		return "."
+	}
+	return ret
+}
+
+// localNodeRoot is the directory under which overlays place $local nodes.
+var localNodeRoot = filepath.Join(string(filepath.Separator), "$local")
+
+// overlayFileSystem serves files held in memory, falling back to base for the others.
+// It is safe for concurrent use.
+type overlayFileSystem struct {
+	base  FileSystem
+	mu    sync.RWMutex
+	files map[string][]byte
+	dirs  map[string]bool
+	// seq numbers the directories made by newLocalNodeDirectory.
+	seq int
+}
+
+func newOverlayFileSystem(base FileSystem) *overlayFileSystem {
+	return &overlayFileSystem{base: base, files: map[string][]byte{}, dirs: map[string]bool{}}
+}
+
+// newLocalNodeDirectory returns a new directory for $local nodes, which no other call returns.
+func (o *overlayFileSystem) newLocalNodeDirectory() string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.seq++
+	return filepath.Join(localNodeRoot, strconv.Itoa(o.seq))
+}
+
+// writeFile places a file, and its parent directories, in memory. name must be absolute.
+func (o *overlayFileSystem) writeFile(name string, data []byte) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	name = filepath.Clean(name)
+	o.files[name] = data
+	for dir := filepath.Dir(name); !o.dirs[dir]; dir = filepath.Dir(dir) {
+		o.dirs[dir] = true
+	}
+}
+
+func (o *overlayFileSystem) Stat(name string) (fs.FileInfo, error) {
+	abs, err := o.Abs(name)
+	if err != nil {
+		return nil, err
+	}
+	o.mu.RLock()
+	data, isFile := o.files[abs]
+	isDir := o.dirs[abs]
+	o.mu.RUnlock()
+	if isFile || isDir {
+		return memoryFileInfo{name: filepath.Base(abs), size: int64(len(data)), dir: isDir}, nil
+	}
+	return o.base.Stat(name)
+}
+
+func (o *overlayFileSystem) ReadFile(name string) ([]byte, error) {
+	abs, err := o.Abs(name)
+	if err != nil {
+		return nil, err
+	}
+	o.mu.RLock()
+	data, ok := o.files[abs]
+	o.mu.RUnlock()
+	if ok {
+		return append([]byte{}, data...), nil
+	}
+	return o.base.ReadFile(name)
+}
+
+// ReadDir returns the entries held in memory along with the ones of base. An entry in memory hides the one of base with
+// the same name.
+func (o *overlayFileSystem) ReadDir(name string) ([]fs.DirEntry, error) {
+	abs, err := o.Abs(name)
+	if err != nil {
+		return nil, err
+	}
+	o.mu.RLock()
+	isDir := o.dirs[abs]
+	entries := map[string]fs.DirEntry{}
+	for file, data := range o.files {
+		if filepath.Dir(file) == abs {
+			entries[filepath.Base(file)] = fs.FileInfoToDirEntry(memoryFileInfo{name: filepath.Base(file), size: int64(len(data))})
+		}
+	}
+	for dir := range o.dirs {
+		if dir != abs && filepath.Dir(dir) == abs {
+			entries[filepath.Base(dir)] = fs.FileInfoToDirEntry(memoryFileInfo{name: filepath.Base(dir), dir: true})
+		}
+	}
+	o.mu.RUnlock()
+	ret, err := o.base.ReadDir(name)
+	if err != nil && !isDir {
+		return nil, err
+	}
+	ret = slices.DeleteFunc(ret, func(e fs.DirEntry) bool { return entries[e.Name()] != nil })
+	for _, each := range entries {
+		ret = append(ret, each)
+	}
+	slices.SortFunc(ret, func(a, b fs.DirEntry) int { return strings.Compare(a.Name(), b.Name()) })
+	return ret, nil
+}
+
+func (o *overlayFileSystem) Abs(name string) (string, error) {
+	return o.base.Abs(name)
+}
+
+type memoryFileInfo struct {
+	name string
+	size int64
+	dir  bool
+}
+
+func (i memoryFileInfo) Name() string { return i.name }
+
+func (i memoryFileInfo) Size() int64 { return i.size }
+
+func (i memoryFileInfo) Mode() fs.FileMode {
+	if i.dir {
+		return fs.ModeDir | 0o555
+	}
+	return 0o444
+}
+
+func (i memoryFileInfo) ModTime() time.Time { return time.Time{} }
+
+func (i memoryFileInfo) IsDir() bool { return i.dir }
+
+func (i memoryFileInfo) Sys() any { return nil }
+
+// isOSFile tells if name in fsys is a file of the OS, i.e., fsys is the OS's FileSystem, or overlays it without
+// holding name in memory.
+func isOSFile(fsys FileSystem, name string) bool {
+	for {
+		switch f := fsys.(type) {
+		case osFileSystem:
+			return true
+		case *overlayFileSystem:
+			abs, err := f.Abs(name)
+			if err != nil {
+				return false
+			}
+			f.mu.RLock()
+			_, isFile := f.files[abs]
+			f.mu.RUnlock()
+			if isFile {
+				return false
+			}
+			fsys = f.base
+		default:
+			return false
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package internal
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"testing/fstest"
+)
+
+func TestSession_FileSystem(t *testing.T) {
+	fsys := fstest.MapFS{
+		"a/child.json":  {Data: []byte(`{"$extends": ["parent.json"], "$local": {"l.json": {"c": 3}}, "x": {"$extends": ["l.json"]}}`)},
+		"a/parent.json": {Data: []byte(`{"p": 1}`)},
+	}
+	session := NewSession([]string{}, SessionOptions{FileSystem: NewFileSystem(fsys)})
+
+	result, dependencies, err := session.LoadAndResolveInheritances("a", "child.json")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := map[string]any{"p": json.Number("1"), "x": map[string]any{"c": json.Number("3")}}
+	if !reflect.DeepEqual(result.Obj, expected) {
+		t.Errorf("expected %v, got %v", expected, result.Obj)
+	}
+	// $local nodes live in memory, and are not dependencies.
+	if expected := []string{"/a/child.json", "/a/parent.json"}; !reflect.DeepEqual(dependencies, expected) {
+		t.Errorf("expected %v, got %v", expected, dependencies)
+	}
+}
+
+func TestSession_FileSystem_MissingFile_ThenError(t *testing.T) {
+	fsys := fstest.MapFS{
+		"child.json": {Data: []byte(`{"$extends": ["missing.json"]}`)},
+	}
+	session := NewSession([]string{}, SessionOptions{FileSystem: NewFileSystem(fsys)})
+
+	_, _, err := session.LoadAndResolveInheritances("/", "child.json")
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+func TestSession_FileSystem_Patterns(t *testing.T) {
+	fsys := fstest.MapFS{
+		"a/child.json":       {Data: []byte(`{"$extends": ["conf.d"], "$local": {"l1": {"l": 1}, "l2": {"l": 2, "m": 2}}, "x": {"$extends": ["l*"]}}`)},
+		"a/conf.d/p.json":    {Data: []byte(`{"p": 1}`)},
+		"a/conf.d/q.yaml":    {Data: []byte("q: 2\n")},
+		"a/conf.d/README.md": {Data: []byte("# Not a node")},
+	}
+	session := NewSession([]string{}, SessionOptions{FileSystem: NewFileSystem(fsys)})
+
+	result, dependencies, err := session.LoadAndResolveInheritances("a", "child.json")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := map[string]any{"p": json.Number("1"), "q": json.Number("2"), "x": map[string]any{"l": json.Number("1"), "m": json.Number("2")}}
+	if !reflect.DeepEqual(result.Obj, expected) {
+		t.Errorf("expected %v, got %v", expected, result.Obj)
+	}
+	// Directories listed for patterns are dependencies, while the ones of $local nodes live in memory. "/a" is listed
+	// for "l*" before the $local nodes.
+	if expected := []string{"/a", "/a/child.json", "/a/conf.d", "/a/conf.d/p.json", "/a/conf.d/q.yaml"}; !reflect.DeepEqual(dependencies, expected) {
+		t.Errorf("expected %v, got %v", expected, dependencies)
+	}
+}
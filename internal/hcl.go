@@ -0,0 +1,232 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+	"slices"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclparse"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	"github.com/zclconf/go-cty/cty"
+)
+
+// readHCL reads an HCL file (e.g. a Terraform variable file) and returns it as a JSON-compatible map.
+//
+// Attributes become keys of the object they belong to.
+// A block becomes an object nested under its type and then its labels, e.g., `variable "region" { default = "x" }`
+// becomes {"variable": {"region": {"default": "x"}}}.
+// If two or more blocks end up at the same place, they are gathered into an array.
+//
+// Expressions are evaluated without variables or functions.
+// An expression that cannot be evaluated that way is represented as a string in the way HCL's JSON syntax does, e.g.,
+// `var.region` becomes "${var.region}" and `"hello ${var.name}"` becomes "hello ${var.name}".
+func readHCL(path string) (map[string]any, *JqModule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	return parseHCL(data, path)
+}
+
+// parseHCL parses HCL text in the way readHCL does. filename is used in error messages.
+func parseHCL(data []byte, filename string) (map[string]any, *JqModule, error) {
+	parser := hclparse.NewParser()
+	file, diags := parser.ParseHCL(data, filename)
+	if diags.HasErrors() {
+		return nil, nil, diags
+	}
+	body, ok := file.Body.(*hclsyntax.Body)
+	if !ok {
+		return nil, nil, fmt.Errorf("unsupported HCL body: %T", file.Body)
+	}
+	ret, err := hclBodyToMap(body, file.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	return ret, nil, nil
+}
+
+func hclBodyToMap(body *hclsyntax.Body, src []byte) (map[string]any, error) {
+	ret := map[string]any{}
+	for name, attr := range body.Attributes {
+		ret[name] = hclExpressionToAny(attr.Expr, src)
+	}
+	for _, block := range body.Blocks {
+		v, err := hclBodyToMap(block.Body, src)
+		if err != nil {
+			return nil, err
+		}
+		container := ret
+		keys := append([]string{block.Type}, block.Labels...)
+		for _, k := range keys[:len(keys)-1] {
+			next, ok := container[k].(map[string]any)
+			if !ok {
+				if _, exists := container[k]; exists {
+					return nil, fmt.Errorf("%s: block %q conflicts with another definition", block.DefRange(), k)
+				}
+				next = map[string]any{}
+				container[k] = next
+			}
+			container = next
+		}
+		last := keys[len(keys)-1]
+		switch existing := container[last].(type) {
+		case nil:
+			container[last] = v
+		case []any:
+			container[last] = append(existing, v)
+		case map[string]any:
+			container[last] = []any{existing, v}
+		default:
+			return nil, fmt.Errorf("%s: block %q conflicts with another definition", block.DefRange(), last)
+		}
+	}
+	return ret, nil
+}
+
+// hclExpressionToAny evaluates an expression that consists of literals, falling back to a string made by
+// hclExpressionToString.
+// Tuples and objects are converted element by element, so that only the elements that cannot be evaluated become
+// strings.
+func hclExpressionToAny(expr hclsyntax.Expression, src []byte) any {
+	switch x := expr.(type) {
+	case *hclsyntax.TupleConsExpr:
+		ret := make([]any, 0, len(x.Exprs))
+		for _, each := range x.Exprs {
+			ret = append(ret, hclExpressionToAny(each, src))
+		}
+		return ret
+	case *hclsyntax.ObjectConsExpr:
+		ret := make(map[string]any, len(x.Items))
+		for _, item := range x.Items {
+			ret[hclObjectKey(item, src)] = hclExpressionToAny(item.ValueExpr, src)
+		}
+		return ret
+	}
+	v, diags := expr.Value(nil)
+	if diags.HasErrors() || !v.IsWhollyKnown() {
+		return hclExpressionToString(expr, src)
+	}
+	return ctyValueToAny(v)
+}
+
+// hclObjectKey returns the key of an item of an object constructor, i.e., a keyword or a string as it is, and any
+// other expression as hclExpressionToString makes it.
+func hclObjectKey(item hclsyntax.ObjectConsItem, src []byte) string {
+	if key := hcl.ExprAsKeyword(item.KeyExpr); key != "" {
+		return key
+	}
+	k, diags := item.KeyExpr.Value(nil)
+	if diags.HasErrors() || k.IsNull() || !k.Type().Equals(cty.String) {
+		return hclExpressionToString(item.KeyExpr, src)
+	}
+	return k.AsString()
+}
+
+// hclKeyOrder returns the keys of the objects made by parseHCL in the order they are written, keyed by pathKey.
+func hclKeyOrder(data []byte, filename string) map[string][]string {
+	file, diags := hclsyntax.ParseConfig(data, filename, hcl.InitialPos)
+	if diags.HasErrors() {
+		return nil
+	}
+	body, ok := file.Body.(*hclsyntax.Body)
+	if !ok {
+		return nil
+	}
+	ret := map[string][]string{}
+	hclBodyKeyOrder(body, []any{}, file.Bytes, ret)
+	return ret
+}
+
+func hclBodyKeyOrder(body *hclsyntax.Body, p []any, src []byte, ret map[string][]string) {
+	type item struct {
+		offset int
+		record func()
+	}
+	var items []item
+	// occurrences holds the number of blocks recorded at each place, keyed by pathKey.
+	occurrences := map[string]int{}
+	for name, attr := range body.Attributes {
+		items = append(items, item{attr.SrcRange.Start.Byte, func() {
+			ret[pathKey(p)] = appendKeys(ret[pathKey(p)], name)
+			hclExpressionKeyOrder(attr.Expr, append(slices.Clone(p), name), src, ret)
+		}})
+	}
+	for _, block := range body.Blocks {
+		items = append(items, item{block.TypeRange.Start.Byte, func() {
+			q := slices.Clone(p)
+			for _, k := range append([]string{block.Type}, block.Labels...) {
+				ret[pathKey(q)] = appendKeys(ret[pathKey(q)], k)
+				q = append(q, k)
+			}
+			// Whether the block is gathered into an array is not known until all the blocks are seen.
+			n := occurrences[pathKey(q)]
+			occurrences[pathKey(q)]++
+			if n == 0 {
+				hclBodyKeyOrder(block.Body, q, src, ret)
+			}
+			hclBodyKeyOrder(block.Body, append(slices.Clone(q), n), src, ret)
+		}})
+	}
+	slices.SortFunc(items, func(a, b item) int { return a.offset - b.offset })
+	for _, each := range items {
+		each.record()
+	}
+}
+
+func hclExpressionKeyOrder(expr hclsyntax.Expression, p []any, src []byte, ret map[string][]string) {
+	switch x := expr.(type) {
+	case *hclsyntax.TupleConsExpr:
+		for i, each := range x.Exprs {
+			hclExpressionKeyOrder(each, append(slices.Clone(p), i), src, ret)
+		}
+	case *hclsyntax.ObjectConsExpr:
+		for _, item := range x.Items {
+			key := hclObjectKey(item, src)
+			ret[pathKey(p)] = appendKeys(ret[pathKey(p)], key)
+			hclExpressionKeyOrder(item.ValueExpr, append(slices.Clone(p), key), src, ret)
+		}
+	}
+}
+
+// hclExpressionToString represents an expression as a string in the way HCL's JSON syntax does, i.e., a template by
+// its content and any other expression by an interpolation sequence wrapping it.
+func hclExpressionToString(expr hclsyntax.Expression, src []byte) string {
+	text := string(expr.Range().SliceBytes(src))
+	if _, ok := expr.(*hclsyntax.TemplateExpr); ok && len(text) >= 2 && text[0] == '"' && text[len(text)-1] == '"' {
+		return text[1 : len(text)-1]
+	}
+	return "${" + text + "}"
+}
+
+func ctyValueToAny(v cty.Value) any {
+	if v.IsNull() {
+		return nil
+	}
+	t := v.Type()
+	switch {
+	case t == cty.String:
+		return v.AsString()
+	case t == cty.Bool:
+		return v.True()
+	case t == cty.Number:
+		return bigFloatNumber(v.AsBigFloat())
+	case t.IsListType() || t.IsSetType() || t.IsTupleType():
+		ret := make([]any, 0, v.LengthInt())
+		for it := v.ElementIterator(); it.Next(); {
+			_, each := it.Element()
+			ret = append(ret, ctyValueToAny(each))
+		}
+		return ret
+	case t.IsMapType() || t.IsObjectType():
+		ret := make(map[string]any, v.LengthInt())
+		for it := v.ElementIterator(); it.Next(); {
+			k, each := it.Element()
+			ret[k.AsString()] = ctyValueToAny(each)
+		}
+		return ret
+	default:
+		return v.GoString()
+	}
+}
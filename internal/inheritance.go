@@ -1,39 +1,63 @@
 package internal
 
 import (
+	"errors"
 	"fmt"
-	"os"
+	"maps"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
 )
 
 // LoadAndResolveInheritances loads a JSON file, resolves filelevel, and returns the merged result as a map.
 func LoadAndResolveInheritances(baseDir string, filename string, searchPaths []string) (*NodeEntryValue, error) {
-	sessionDirectory := CreateSessionDirectory()
-	defer func() {
-		err := os.RemoveAll(CreateSessionDirectory())
-		if err != nil {
-			_, _ = fmt.Fprintln(os.Stderr, fmt.Errorf("failed to remove directory: %s", err))
-		}
-	}()
+	ret, _, err := loadAndResolveInheritances(baseDir, filename, searchPaths, false)
+	return ret, err
+}
+
+// LoadAndResolveInheritancesWithProvenance works like LoadAndResolveInheritances, and additionally records in the
+// returned value which file (and line, for JSON and YAML) every leaf comes from.
+func LoadAndResolveInheritancesWithProvenance(baseDir string, filename string, searchPaths []string) (*NodeEntryValue, error) {
+	ret, _, err := loadAndResolveInheritances(baseDir, filename, searchPaths, true)
+	return ret, err
+}
+
+// LoadAndResolveInheritancesWithDependencies works like LoadAndResolveInheritances, and additionally returns the
+// absolute paths of the files the result depends on, i.e., the target, its parents, and their modules and scripts.
+// The files visited before a failure are returned even when an error is returned, so that a caller can tell which
+// files to fix.
+func LoadAndResolveInheritancesWithDependencies(baseDir string, filename string, searchPaths []string) (*NodeEntryValue, []string, error) {
+	return loadAndResolveInheritances(baseDir, filename, searchPaths, false)
+}
 
-	return NewNodePoolWithBaseSearchPaths(baseDir, sessionDirectory, searchPaths).ReadNodeEntryValue(baseDir, filename, []*JqModule{})
+func loadAndResolveInheritances(baseDir string, filename string, searchPaths []string, tracksProvenance bool) (*NodeEntryValue, []string, error) {
+	session := NewSession(searchPaths, SessionOptions{TracksProvenance: tracksProvenance})
+	return session.LoadAndResolveInheritances(baseDir, filename)
 }
 
 // LoadAndResolveInheritancesRecursively loads a JSON file, resolves $extends or $includes recursively, and merges parents.
 func LoadAndResolveInheritancesRecursively(baseDir string, targetFile string, nodepool NodePool) (*NodeEntryValue, error) {
-	absPath, bDir, err := ResolveFilePath(targetFile, baseDir, nodepool.SearchPaths())
+	absPath, bDir, load, err := resolveNode(targetFile, baseDir, nodepool)
 	if err != nil {
 		return nil, err
 	}
+	return loadAndResolveNode(absPath, bDir, load, nodepool)
+}
+
+// loadAndResolveNode loads a node with load and resolves its inheritances against bDir.
+// absPath identifies the node and tells where its values come from.
+func loadAndResolveNode(absPath string, bDir string, load func() (map[string]any, *JqModule, error), nodepool NodePool) (*NodeEntryValue, error) {
 	if nodepool.IsVisited(absPath) {
 		return nil, fmt.Errorf("circular filelevel inheritance detected: %s", absPath)
 	}
 	nodepool.MarkVisited(absPath)
 
-	obj, compilerOption, err := LoadFileAsRawJSON(absPath)
+	obj, compilerOption, err := load()
 	if err != nil {
+		if _, ok := asLocatedError(err); !ok {
+			return nil, &LoadError{File: absPath, Err: err}
+		}
 		return nil, err
 	}
 
@@ -41,18 +65,36 @@ func LoadAndResolveInheritancesRecursively(baseDir string, targetFile string, no
 	if compilerOption != nil {
 		compilerOptions = append(compilerOptions, compilerOption)
 	}
-	nodeEntryValue, err := resolveBothInheritances(bDir, obj, compilerOptions, nodepool)
+	var provenance *Provenance
+	if nodepool.TracksProvenance() {
+		provenance = newProvenance(obj, absPath, loadLeafLines(nodepool.FileSystem(), absPath))
+	}
+	var keyOrder *KeyOrder
+	if nodepool.KeyOrderPolicy() != KeyOrderSorted {
+		keyOrder = newKeyOrder(obj, loadKeyOrder(nodepool.FileSystem(), absPath))
+	}
+	nodeEntryValue, err := resolveBothInheritances(bDir, &NodeEntryValue{Obj: obj, CompilerOptions: compilerOptions, Provenance: provenance, KeyOrder: keyOrder}, nodepool)
 	if err != nil {
-		return nil, err
+		return nil, locateInheritanceError(err, absPath, []any{})
 	}
 	obj = nodeEntryValue.Obj
 	compilerOptions = nodeEntryValue.CompilerOptions
+	provenance = nodeEntryValue.Provenance
+	keyOrder = nodeEntryValue.KeyOrder
 
-	p, err := MaterializeLocalNodes(obj, nodepool.SessionDirectory())
+	localNodeDirectory, err := nodepool.MaterializeLocalNodes(obj, keyOrder)
+	if err != nil {
+		return nil, &LoadError{File: absPath, Err: fmt.Errorf("failed to materialize $local: %w", err)}
+	}
 	delete(obj, "$local")
+	provenance = provenance.restrictTo(obj)
 
-	nodepool.Enter(p)
-	for _, p := range DistinctBy(Map(Sort(Paths(obj, lastElementIsOneOf("$extends", "$includes")), lessPathArrays), DropLast[any]), pathKey) {
+	nodepool.Enter(localNodeDirectory)
+	for _, p := range DistinctBy(Map(Sort(Paths(obj, lastElementIsOneOf("$extends", "$includes", MergeDirective, DeleteDirective, ValueDirective)), lessPathArrays), DropLast[any]), pathKey) {
+		if len(p) == 0 {
+			// The node itself, which holds a document other than an object.
+			continue
+		}
 		internal, ok := GetAtPath(obj, ToAnySlice(p))
 		if !ok {
 			continue
@@ -61,65 +103,508 @@ func LoadAndResolveInheritancesRecursively(baseDir string, targetFile string, no
 		if !ok {
 			continue
 		}
-		nodeEntryValue, err := resolveBothInheritances(bDir, internalObj, compilerOptions, nodepool)
+		nodeEntryValue, err := resolveBothInheritances(bDir, &NodeEntryValue{Obj: internalObj, CompilerOptions: compilerOptions, Provenance: provenance.Subtree(ToAnySlice(p)), KeyOrder: keyOrder.Subtree(ToAnySlice(p))}, nodepool)
 		if err != nil {
-			return nil, err
+			nodepool.Leave(localNodeDirectory)
+			return nil, locateInheritanceError(err, absPath, ToAnySlice(p))
+		}
+		if err := checkValueDirective(nodeEntryValue.Obj); err != nil {
+			nodepool.Leave(localNodeDirectory)
+			return nil, locateInheritanceError(err, absPath, ToAnySlice(p))
+		}
+		internal, root := any(nodeEntryValue.Obj), []any{}
+		if v, ok := nodeEntryValue.Obj[ValueDirective]; ok {
+			// An internal node holding a document other than an object is replaced with the document.
+			internal, root = v, []any{ValueDirective}
 		}
-		internalObj = nodeEntryValue.Obj
 		compilerOptions = nodeEntryValue.CompilerOptions
-		PutAtPath(obj, ToAnySlice(p), internalObj)
+		provenance = provenance.graft(ToAnySlice(p), nodeEntryValue.Provenance.Subtree(root))
+		keyOrder = keyOrder.graft(ToAnySlice(p), nodeEntryValue.KeyOrder.Subtree(root))
+		PutAtPath(obj, ToAnySlice(p), internal)
+	}
+	nodepool.Leave(localNodeDirectory)
+	// Markers are kept until here, so that they take effect in the inheritances of internal nodes, too.
+	if stripped, found := withoutMergeMarkers(obj); found {
+		obj = stripped.(map[string]any)
+	}
+	if err := checkValueDirective(obj); err != nil {
+		return nil, locateInheritanceError(err, absPath, []any{})
+	}
+	provenance = provenance.restrictTo(obj)
+	return &NodeEntryValue{Obj: obj, CompilerOptions: compilerOptions, Provenance: provenance, KeyOrder: keyOrder}, nil
+}
+
+// wrapDocument returns the object a document is loaded as, i.e., the document itself if it is an object, or an object
+// holding it at ValueDirective otherwise. A null document is loaded as nil, i.e., an empty object.
+func wrapDocument(v any) map[string]any {
+	switch x := v.(type) {
+	case nil:
+		return nil
+	case map[string]any:
+		return x
+	default:
+		return map[string]any{ValueDirective: x}
+	}
+}
+
+// UnwrapDocument returns the document obj stands for, i.e., the value at ValueDirective if it is the only key of obj,
+// or obj itself otherwise, along with the path at which obj holds it.
+func UnwrapDocument(obj map[string]any) (any, []any) {
+	if v, ok := obj[ValueDirective]; ok && len(obj) == 1 {
+		return v, []any{ValueDirective}
+	}
+	return obj, []any{}
+}
+
+// documentRoot returns the path at which the object a document is loaded as holds it. See wrapDocument.
+func documentRoot(isObject bool) []any {
+	if isObject {
+		return []any{}
+	}
+	return []any{ValueDirective}
+}
+
+// checkValueDirective checks that a node having ValueDirective has no other keys, which happens when an object and a
+// value other than an object are merged, e.g., when an object extends an array.
+// Merge markers, which are removed from the result, are not counted.
+func checkValueDirective(obj map[string]any) error {
+	if _, ok := obj[ValueDirective]; !ok {
+		return nil
+	}
+	others := Filter(slices.Sorted(maps.Keys(obj)), func(k string) bool {
+		return k != ValueDirective && k != ReplaceDirective && obj[k] != UnsetMarker
+	})
+	if len(others) == 0 {
+		return nil
+	}
+	return &InheritanceError{Directive: ValueDirective, Err: fmt.Errorf("cannot be merged with other keys, i.e., an object and a value other than an object cannot be merged: %s", strings.Join(others, ", "))}
+}
+
+// locateInheritanceError fills the file and the path of an InheritanceError raised by resolveBothInheritances, which
+// does not know where the node it is given comes from.
+func locateInheritanceError(err error, file string, path []any) error {
+	var inheritanceError *InheritanceError
+	if errors.As(err, &inheritanceError) && inheritanceError.File == "" {
+		inheritanceError.File = file
+		inheritanceError.Path = path
+	}
+	return err
+}
+
+// resolveNode resolves a string found in "$extends" or "$includes" (or a target file) into a key that identifies it,
+// a directory against which its own inheritances are resolved, and a function that loads its content.
+func resolveNode(targetFile string, baseDir string, nodepool NodePool) (string, string, func() (map[string]any, *JqModule, error), error) {
+	searchPaths := nodepool.SearchPaths()
+	if IsScriptDirective(targetFile) {
+		d, err := ParseScriptDirective(targetFile)
+		if err != nil {
+			return "", "", nil, err
+		}
+		key, programDir, err := d.ResolvedKey(baseDir, searchPaths)
+		if err != nil {
+			return "", "", nil, err
+		}
+		return key, programDir, func() (map[string]any, *JqModule, error) {
+			// An invalid JF_SCRIPT_TIMEOUT is reported by the command line tool, before rendering.
+			timeout, _ := ScriptTimeout()
+			obj, err := d.Run(baseDir, searchPaths, timeout)
+			return obj, nil, err
+		}, nil
 	}
-	nodepool.Leave(p)
-	return &NodeEntryValue{obj, compilerOptions}, nil
+	path, _, err := resolveFilePath(nodepool.FileSystem(), targetFile, baseDir, searchPaths, func(path string) {
+		if abs, err := nodepool.FileSystem().Abs(path); err == nil {
+			nodepool.MarkAbsent(abs)
+		}
+	})
+	if err != nil {
+		return "", "", nil, err
+	}
+	// Search paths may be relative, while a file must be identified by a single path.
+	absPath, err := nodepool.FileSystem().Abs(path)
+	if err != nil {
+		return "", "", nil, err
+	}
+	bDir := filepath.Dir(absPath)
+	return absPath, bDir, func() (map[string]any, *JqModule, error) {
+		return nodepool.LoadFile(absPath)
+	}, nil
 }
 
-func resolveBothInheritances(baseDir string, obj map[string]any, compilerOptions []*JqModule, nodepool NodePool) (*NodeEntryValue, error) {
-	ret := &NodeEntryValue{Obj: obj, CompilerOptions: compilerOptions}
-	ret, err := resolveInheritances(ret.Obj, ret.CompilerOptions, baseDir, Extends, nodepool)
+// resolveBothInheritances resolves "$extends" and then "$includes" of a node, merging parents under the rules given
+// by its "$merge" directive, if any.
+func resolveBothInheritances(baseDir string, nodeEntryValue *NodeEntryValue, nodepool NodePool) (*NodeEntryValue, error) {
+	var rules MergeRules
+	if v, ok := nodeEntryValue.Obj[MergeDirective]; ok {
+		var err error
+		if rules, err = ParseMergeDirective(v); err != nil {
+			return nil, &InheritanceError{Directive: MergeDirective, Err: err}
+		}
+		delete(nodeEntryValue.Obj, MergeDirective)
+		nodeEntryValue.Provenance = nodeEntryValue.Provenance.restrictTo(nodeEntryValue.Obj)
+	}
+	if nested := nestedMergeRules(nodeEntryValue.Obj); len(nested) > 0 {
+		// The node's own rules take precedence over the ones of its descendants.
+		maps.Copy(nested, rules)
+		rules = nested
+	}
+	if _, ok := rules[pathKey([]any{})]; !ok && nodepool.DefaultMergeRule() != (MergeRule{}) {
+		rules = maps.Clone(rules)
+		if rules == nil {
+			rules = MergeRules{}
+		}
+		rules[pathKey([]any{})] = nodepool.DefaultMergeRule()
+	}
+	ret, err := resolveInheritances(nodeEntryValue, baseDir, Extends, rules, nodepool)
 	if err != nil {
 		return nil, err
 	}
-	ret, err = resolveInheritances(ret.Obj, ret.CompilerOptions, baseDir, Includes, nodepool)
+	ret, err = resolveInheritances(ret, baseDir, Includes, rules, nodepool)
 	if err != nil {
 		return nil, err
 	}
+	if v, ok := ret.Obj[DeleteDirective]; ok {
+		paths, err := ParseDeleteDirective(v)
+		if err != nil {
+			return nil, &InheritanceError{Directive: DeleteDirective, Err: err}
+		}
+		// Nodes that come from parents are shared with the NodePool cache, thus must not be modified in place.
+		ret.Obj = DeepCopyAs(ret.Obj)
+		delete(ret.Obj, DeleteDirective)
+		for _, p := range paths {
+			RemovePath(ret.Obj, p)
+		}
+		ret.Provenance = ret.Provenance.restrictTo(ret.Obj)
+	}
 	return ret, nil
 }
 
-func resolveInheritances(obj map[string]any, compilerOptions []*JqModule, baseDir string, mergeType InheritType, nodepool NodePool) (*NodeEntryValue, error) {
-	tmpCompilerOptions := compilerOptions
+// ParseDeleteDirective parses the value of a "$delete" directive, an array of paths relative to the node having the
+// directive.
+// Each path is a path expression, whose leading dot may be omitted, e.g., "a" or "b.c".
+func ParseDeleteDirective(v any) ([][]any, error) {
+	entries, ok := v.([]any)
+	if !ok {
+		return nil, fmt.Errorf("%s must be an array of strings: %v", DeleteDirective, v)
+	}
+	var ret [][]any
+	for _, each := range entries {
+		s, ok := each.(string)
+		if !ok {
+			return nil, fmt.Errorf("%s array must contain only strings: %v", DeleteDirective, v)
+		}
+		if !strings.HasPrefix(s, ".") {
+			s = "." + s
+		}
+		p, err := PathExpressionToPathArray(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid path in %s: %q: %w", DeleteDirective, each, err)
+		}
+		if len(p) == 0 {
+			return nil, fmt.Errorf("%s cannot remove the node itself: %q", DeleteDirective, each)
+		}
+		ret = append(ret, p)
+	}
+	return ret, nil
+}
+
+// withoutMergeMarkers returns v without UnsetMarker values, along with their keys, and ReplaceDirective keys in its
+// objects, and whether they are found.
+// v is left untouched, since its objects and arrays may be shared with the nodes it is merged from, e.g., in the cache.
+// Only the objects and arrays having markers, and their ancestors, are copied.
+func withoutMergeMarkers(v any) (any, bool) {
+	switch x := v.(type) {
+	case map[string]any:
+		var ret map[string]any
+		for k, each := range x {
+			stripped, found := withoutMergeMarkers(each)
+			removed := k == ReplaceDirective || each == UnsetMarker
+			if !found && !removed {
+				continue
+			}
+			if ret == nil {
+				ret = maps.Clone(x)
+			}
+			if removed {
+				delete(ret, k)
+			} else {
+				ret[k] = stripped
+			}
+		}
+		if ret == nil {
+			return x, false
+		}
+		return ret, true
+	case []any:
+		var ret []any
+		for i, each := range x {
+			stripped, found := withoutMergeMarkers(each)
+			if !found {
+				continue
+			}
+			if ret == nil {
+				ret = slices.Clone(x)
+			}
+			ret[i] = stripped
+		}
+		if ret == nil {
+			return x, false
+		}
+		return ret, true
+	default:
+		return v, false
+	}
+}
+
+func resolveInheritances(nodeEntryValue *NodeEntryValue, baseDir string, mergeType InheritType, rules MergeRules, nodepool NodePool) (*NodeEntryValue, error) {
+	obj := nodeEntryValue.Obj
+	provenance := nodeEntryValue.Provenance
+	keyOrder := nodeEntryValue.KeyOrder
+	tmpCompilerOptions := nodeEntryValue.CompilerOptions
 	// Check for $extends or $includes
 	inherits, ok := obj[mergeType.String()]
 	if ok {
 		parentFiles, err := parseInheritsField(inherits, mergeType)
 		if err != nil {
-			return nil, err
+			return nil, &InheritanceError{Directive: mergeType.String(), Err: err}
+		}
+		var parents []parentReference
+		for _, each := range parentFiles {
+			expanded, err := expandParentReference(each, baseDir, nodepool)
+			if err != nil {
+				return nil, &InheritanceError{Directive: mergeType.String(), Parent: each, Err: err}
+			}
+			parents = append(parents, expanded...)
 		}
 		if mergeType.IsOrderReversed() {
-			Reverse(parentFiles)
+			Reverse(parents)
 		}
 		var mergedParents map[string]any
-		for i, parent := range parentFiles {
-			nodeEntryValue, err := nodepool.ReadNodeEntryValue(baseDir, parent, tmpCompilerOptions)
+		var mergedParentsProvenance *Provenance
+		var mergedParentsKeyOrder *KeyOrder
+		for i, parent := range parents {
+			nodeEntryValue, err := readParentNodeEntryValue(baseDir, parent, tmpCompilerOptions, nodepool)
 			if err != nil {
-				return nil, err
+				// An error located in the parent (or further ancestors) tells more than where the parent is referenced.
+				if _, ok := asLocatedError(err); ok {
+					return nil, err
+				}
+				return nil, &InheritanceError{Directive: mergeType.String(), Parent: parent.entry, Err: err}
 			}
 			if i == 0 {
 				mergedParents = nodeEntryValue.Obj
+				mergedParentsProvenance = nodeEntryValue.Provenance
+				mergedParentsKeyOrder = nodeEntryValue.KeyOrder
 			} else {
-				mergedParents = mergeObjects(mergedParents, nodeEntryValue.Obj)
+				previous := mergedParents
+				mergedParents, err = MergeObjectsWithRules(previous, nodeEntryValue.Obj, rules)
+				if err != nil {
+					return nil, &InheritanceError{Directive: mergeType.String(), Parent: parent.entry, Err: err}
+				}
+				mergedParentsProvenance = mergeProvenance(mergedParents, nodeEntryValue.Obj, nodeEntryValue.Provenance, previous, mergedParentsProvenance, rules)
+				mergedParentsKeyOrder = mergeKeyOrders(mergedParents, previous, mergedParentsKeyOrder, nodeEntryValue.Obj, nodeEntryValue.KeyOrder, rules, true)
 			}
 			tmpCompilerOptions = append(tmpCompilerOptions, nodeEntryValue.CompilerOptions...)
 		}
-		if !mergeType.IsOrderReversed() {
-			obj = mergeObjects(mergedParents, obj)
-		} else {
-			obj = mergeObjects(obj, mergedParents)
-		}
 		delete(obj, mergeType.String())
+		winner, loser := obj, mergedParents
+		winnerProvenance, loserProvenance := provenance, mergedParentsProvenance
+		winnerKeyOrder, loserKeyOrder := keyOrder, mergedParentsKeyOrder
+		if mergeType.IsOrderReversed() {
+			winner, loser = loser, winner
+			winnerProvenance, loserProvenance = loserProvenance, winnerProvenance
+			winnerKeyOrder, loserKeyOrder = loserKeyOrder, winnerKeyOrder
+		}
+		obj, err = MergeObjectsWithRules(loser, winner, rules)
+		if err != nil {
+			return nil, &InheritanceError{Directive: mergeType.String(), Err: err}
+		}
+		provenance = mergeProvenance(obj, winner, winnerProvenance, loser, loserProvenance, rules)
+		// The order depends on which side is the child, i.e., the node having the directive, rather than on which wins.
+		loserFirst := (nodepool.KeyOrderPolicy() != KeyOrderChildFirst) == !mergeType.IsOrderReversed()
+		keyOrder = mergeKeyOrders(obj, loser, loserKeyOrder, winner, winnerKeyOrder, rules, loserFirst)
+	}
+
+	return &NodeEntryValue{Obj: obj, CompilerOptions: tmpCompilerOptions, Provenance: provenance, KeyOrder: keyOrder}, nil
+}
+
+// nestedMergeRules returns the rules given by "$merge" directives of the descendants of obj that do not inherit by
+// themselves, keyed by paths relative to obj, so that they take effect when obj is merged with its parents.
+// The directive of a descendant having "$extends" or "$includes" is left to the inheritance of the descendant.
+// The directives are left in place, to be removed along with the nodes having them, where invalid ones are reported.
+func nestedMergeRules(obj map[string]any) MergeRules {
+	paths := Filter(Paths(obj, lastElementIsOneOf(MergeDirective)), func(p []any) bool {
+		if len(p) < 2 {
+			return false
+		}
+		node, _ := GetAtPath(obj, p[:len(p)-1])
+		m, _ := node.(map[string]any)
+		_, extends := m[Extends.String()]
+		_, includes := m[Includes.String()]
+		return !extends && !includes
+	})
+	// A rule of a deeper node takes precedence over the ones of its ancestors.
+	slices.SortStableFunc(paths, func(a, b []any) int { return len(a) - len(b) })
+	ret := MergeRules{}
+	for _, p := range paths {
+		v, _ := GetAtPath(obj, p)
+		rules, err := ParseMergeDirective(v)
+		if err != nil {
+			continue
+		}
+		prefix := pathKey(p[:len(p)-1])
+		for k, rule := range rules {
+			ret[prefix+k] = rule
+		}
 	}
+	return ret
+}
 
-	return &NodeEntryValue{Obj: obj, CompilerOptions: tmpCompilerOptions}, nil
+// parentReference is a parent referenced by an entry in "$extends" or "$includes".
+type parentReference struct {
+	// entry is the entry, or for a file a pattern or a directory is expanded into, the file relative to where it is
+	// found, followed by the fragment, if any. It is used in error messages.
+	entry string
+	// name is the name of the node, without the fragment. See parseParentReference and splitFragment.
+	name     string
+	fragment string
+	optional bool
+}
+
+// expandParentReference parses an entry in "$extends" or "$includes".
+// If the name of the entry is a pattern or a directory (see resolveFilePaths), the entry is expanded into a reference
+// for each file it refers to, as if the files were listed in its place in sorted order. The references are returned in
+// the order parseInheritsField returns entries, i.e., from the least prioritized one.
+// If the entry is optional and a pattern matches no file, nothing is returned.
+func expandParentReference(entry string, baseDir string, nodepool NodePool) ([]parentReference, error) {
+	name, optional := parseParentReference(entry)
+	name, fragment := splitFragment(name)
+	ref := parentReference{entry: entry, name: name, fragment: fragment, optional: optional}
+	if IsScriptDirective(name) {
+		return []parentReference{ref}, nil
+	}
+	fsys := nodepool.FileSystem()
+	dir, files, ok, err := resolveFilePaths(fsys, name, baseDir, nodepool.SearchPaths(), func(dir string) {
+		if abs, err := fsys.Abs(dir); err == nil {
+			nodepool.MarkListed(abs)
+		}
+	})
+	if !ok {
+		return []parentReference{ref}, nil
+	}
+	if err != nil {
+		if optional && errors.Is(err, ErrFileNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	ret := make([]parentReference, 0, len(files))
+	for i := len(files) - 1; i >= 0; i-- {
+		abs, err := fsys.Abs(filepath.Join(dir, files[i]))
+		if err != nil {
+			return nil, err
+		}
+		each := parentReference{entry: files[i], name: abs, fragment: fragment}
+		if fragment != "" {
+			each.entry += "#" + fragment
+		}
+		ret = append(ret, each)
+	}
+	return ret, nil
+}
+
+// readParentNodeEntryValue reads a parent referenced by an entry in "$extends" or "$includes".
+// If the entry is optional (see parseParentReference) and the parent cannot be found, an empty object is returned.
+// If the entry has a fragment (see splitFragment), the sub-node it selects is returned instead of the whole parent,
+// after the parent's own inheritances are resolved.
+func readParentNodeEntryValue(baseDir string, parent parentReference, compilerOptions []*JqModule, nodepool NodePool) (*NodeEntryValue, error) {
+	if parent.optional {
+		if _, _, _, err := resolveNode(parent.name, baseDir, nodepool); errors.Is(err, ErrFileNotFound) {
+			return &NodeEntryValue{Obj: map[string]any{}}, nil
+		}
+	}
+	ret, err := nodepool.ReadNodeEntryValue(baseDir, parent.name, compilerOptions)
+	if err != nil {
+		return nil, err
+	}
+	return selectFragment(ret, parent.fragment)
+}
+
+// splitFragment splits a name in "$extends" or "$includes" into the name of a node and a fragment that selects a
+// sub-node of it, i.e., the part after the first "#" followed by "/", ".", or nothing.
+// A fragment is either a JSON Pointer (RFC 6901), e.g. "base.json#/services/web", or a path expression, e.g.
+// "base.json#.services.web". An empty fragment selects the node itself.
+// A "#" that would start a fragment can be escaped with a backslash, e.g., `file\#.json` (written as "file\\#.json" in
+// JSON).
+func splitFragment(name string) (string, string) {
+	var b strings.Builder
+	for i := 0; i < len(name); i++ {
+		switch {
+		case strings.HasPrefix(name[i:], `\#`):
+			b.WriteByte('#')
+			i++
+		case name[i] == '#' && (i+1 == len(name) || name[i+1] == '/' || name[i+1] == '.'):
+			return b.String(), name[i+1:]
+		default:
+			b.WriteByte(name[i])
+		}
+	}
+	return b.String(), ""
+}
+
+// selectFragment returns the sub-node of a node selected by a fragment, relative to the document the node stands for.
+// See splitFragment.
+func selectFragment(nodeEntryValue *NodeEntryValue, fragment string) (*NodeEntryValue, error) {
+	if fragment == "" {
+		return nodeEntryValue, nil
+	}
+	document, root := UnwrapDocument(nodeEntryValue.Obj)
+	var p []any
+	var err error
+	if strings.HasPrefix(fragment, "/") {
+		p, err = jsonPointerToPathArray(document, fragment)
+	} else {
+		p, err = PathExpressionToPathArray(fragment)
+	}
+	if err != nil {
+		return nil, err
+	}
+	p = append(slices.Clone(root), p...)
+	v, ok := GetAtPath(nodeEntryValue.Obj, p)
+	if !ok {
+		return nil, fmt.Errorf("fragment %q does not refer to a node", fragment)
+	}
+	ret := &NodeEntryValue{CompilerOptions: nodeEntryValue.CompilerOptions, Provenance: nodeEntryValue.Provenance.Subtree(p), KeyOrder: nodeEntryValue.KeyOrder.Subtree(p)}
+	if obj, ok := v.(map[string]any); ok {
+		ret.Obj = obj
+		return ret, nil
+	}
+	// A sub-node that is not an object is held at ValueDirective, as a document that is not an object is.
+	ret.Obj = map[string]any{ValueDirective: v}
+	if ret.Provenance != nil {
+		ret.Provenance = (&Provenance{entries: map[string]ProvenanceEntry{}}).graft([]any{ValueDirective}, ret.Provenance)
+	}
+	if ret.KeyOrder != nil {
+		ret.KeyOrder = (&KeyOrder{keys: map[string][]string{}}).graft([]any{ValueDirective}, ret.KeyOrder)
+	}
+	return ret, nil
+}
+
+// parseParentReference splits an entry in "$extends" or "$includes" into a name and a flag telling if it is optional.
+//
+// A trailing "?" makes the entry optional, i.e., it is considered an empty object if it is not found on the search paths.
+// A file whose name really ends with "?" can be referenced by escaping the question mark with a backslash, i.e., `file\?`
+// (written as "file\\?" in JSON).
+// Both can be combined: `file\??` is an optional reference to "file?".
+func parseParentReference(entry string) (string, bool) {
+	optional := false
+	if strings.HasSuffix(entry, "?") && !strings.HasSuffix(entry, `\?`) {
+		optional = true
+		entry = entry[:len(entry)-1]
+	}
+	if strings.HasSuffix(entry, `\?`) {
+		entry = entry[:len(entry)-2] + "?"
+	}
+	return entry, optional
 }
 
 // parseInheritsField parses the $extends field, which can be a string or array of strings.
@@ -140,6 +625,24 @@ func parseInheritsField(val any, inherits InheritType) ([]string, error) {
 	}
 }
 
+const (
+	// MergeDirective is the key through which a node gives merge policies to its descendants. See ParseMergeDirective.
+	MergeDirective = "$merge"
+	// DeleteDirective is the key through which a node lists paths to be removed after its parents are merged into it.
+	// See ParseDeleteDirective.
+	DeleteDirective = "$delete"
+	// ReplaceDirective is the key that makes an object replace the one it overrides, instead of being merged with it,
+	// when its value is true.
+	ReplaceDirective = "$replace"
+	// UnsetMarker is the value that removes the key it is given to, along with the value it overrides.
+	// It is reserved, i.e., the string cannot be a value of a node as it is, but can be made by "raw:$unset".
+	UnsetMarker = "$unset"
+	// ValueDirective is the key at which a node holds a value other than an object, e.g., an array, which the node
+	// stands for. A document that is not an object is loaded as an object holding it at this key, so that it is merged
+	// with the values of the other nodes at the same key.
+	ValueDirective = "$value"
+)
+
 type InheritType int
 
 const (
@@ -169,7 +672,32 @@ func (m InheritType) IsOrderReversed() bool {
 	}
 }
 
+// ParseRawJSON parses the content of a file of the given type, like LoadFileAsRawJSON does for a file.
+// name is the path of the file the content is supposed to come from, which is used for error messages and the names of
+// jq modules.
+func ParseRawJSON(data []byte, name string, ft FileType) (map[string]any, *JqModule, error) {
+	switch ft {
+	case JSON:
+		return withNormalizedNumbers(parseJSON(data, name))
+	case JQ:
+		return parseJQ(data, name)
+	case YAML:
+		return withNormalizedNumbers(parseYAML(data))
+	case TOML:
+		return withNormalizedNumbers(parseTOML(data))
+	case JSON5:
+		return withNormalizedNumbers(parseJSON5(data))
+	case HCL:
+		return withNormalizedNumbers(parseHCL(data, name))
+	case HOCON:
+		return withNormalizedNumbers(parseHOCON(data))
+	default:
+		return nil, nil, fmt.Errorf("unsupported file type: %q (%s)", ft, name)
+	}
+}
+
 // LoadFileAsRawJSON loads and parses a file (JSON, YAML, etc.) into a gojq-compatible object.
+// A document that is not an object, e.g. an array, is held at ValueDirective.
 func LoadFileAsRawJSON(path string) (map[string]any, *JqModule, error) {
 	ft, ok := detectFileType(path)
 	if !ok {
@@ -178,24 +706,49 @@ func LoadFileAsRawJSON(path string) (map[string]any, *JqModule, error) {
 
 	switch ft {
 	case JSON:
-		return readJSON(path)
+		return withNormalizedNumbers(readJSON(path))
 	case JQ:
 		return readJQ(path)
 	case YAML:
-		return readYAML(path)
+		return withNormalizedNumbers(readYAML(path))
 	case TOML:
-		return readTOML(path)
+		return withNormalizedNumbers(readTOML(path))
 	case JSON5:
-		return readJSON5(path)
+		return withNormalizedNumbers(readJSON5(path))
 	case HCL:
-		return nil, nil, fmt.Errorf("unsupported file type: %q (%s)", ft, path)
+		return withNormalizedNumbers(readHCL(path))
 	case HOCON:
-		return readHOCON(path)
+		return withNormalizedNumbers(readHOCON(path))
 	default:
 		return nil, nil, fmt.Errorf("unsupported file type: %q (%s)", ft, path)
 	}
 }
 
+// LoadFileAsRawJSONIn works like LoadFileAsRawJSON for a file in fsys.
+func LoadFileAsRawJSONIn(fsys FileSystem, path string) (map[string]any, *JqModule, error) {
+	if isOSFile(fsys, path) {
+		// Some formats read other files relative to the file, e.g. HOCON's includes, which only work on the OS.
+		return LoadFileAsRawJSON(path)
+	}
+	ft, ok := detectFileType(path)
+	if !ok {
+		return nil, nil, fmt.Errorf("unsupported file type: %q (%s)", filepath.Ext(path), path)
+	}
+	data, err := fsys.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	return ParseRawJSON(data, path, ft)
+}
+
+// withNormalizedNumbers normalizes the numbers in an object returned by a loader. See NormalizeNumbers.
+func withNormalizedNumbers(obj map[string]any, module *JqModule, err error) (map[string]any, *JqModule, error) {
+	if obj != nil {
+		NormalizeNumbers(obj)
+	}
+	return obj, module, err
+}
+
 func lastElementIsOneOf(v ...string) func(p []any) bool {
 	return func(p []any) bool {
 		if len(p) == 0 {
@@ -214,16 +767,18 @@ func lastElementIsOneOf(v ...string) func(p []any) bool {
 	}
 }
 
+// lessPathArrays orders path arrays by their path expressions.
+// A path that cannot be rendered as a path expression is compared by its fmt representation instead.
 func lessPathArrays(a []any, b []any) bool {
-	pea, e := PathArrayToPathExpression(a)
-	if e != nil {
-		panic(e)
-	}
-	peb, e := PathArrayToPathExpression(b)
-	if e != nil {
-		panic(e)
+	return pathArrayOrderingKey(a) < pathArrayOrderingKey(b)
+}
+
+func pathArrayOrderingKey(p []any) string {
+	ret, err := PathArrayToPathExpression(p)
+	if err != nil {
+		return fmt.Sprint(p)
 	}
-	return pea < peb
+	return ret
 }
 
 func pathKey(p []any) string {
@@ -237,7 +792,7 @@ func pathKey(p []any) string {
 			b.WriteString("i:")
 			b.WriteString(strconv.Itoa(x))
 		default:
-			panic("unsupported type in path")
+			b.WriteString(fmt.Sprintf("%T:%v", x, x))
 		}
 		b.WriteByte('|')
 	}
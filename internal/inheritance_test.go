@@ -1,7 +1,10 @@
 package internal
 
 import (
+	"encoding/json"
+	"errors"
 	"github.com/dakusui/jqplusplus/internal/testutil"
+	"os"
 	"path/filepath"
 	"reflect"
 	"strings"
@@ -15,7 +18,7 @@ func TestLoadAndResolveInheritances_NoExtends(t *testing.T) {
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
-	expected := map[string]interface{}{"a": float64(1), "b": float64(2)}
+	expected := map[string]interface{}{"a": json.Number("1"), "b": json.Number("2")}
 	if !reflect.DeepEqual(result.Obj, expected) {
 		t.Errorf("expected %v, got %v", expected, result)
 	}
@@ -29,7 +32,7 @@ func TestLoadAndResolveInheritances_SingleExtends(t *testing.T) {
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
-	expected := map[string]interface{}{"a": float64(1), "b": float64(3), "c": float64(4)}
+	expected := map[string]interface{}{"a": json.Number("1"), "b": json.Number("3"), "c": json.Number("4")}
 	if !reflect.DeepEqual(result.Obj, expected) {
 		t.Errorf("expected %v, got %v", expected, result)
 	}
@@ -45,7 +48,7 @@ func TestLoadAndResolveInheritances_MultipleExtends(t *testing.T) {
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
-	expected := map[string]interface{}{"a": float64(1), "b": float64(2), "c": float64(300), "d": float64(400)}
+	expected := map[string]interface{}{"a": json.Number("1"), "b": json.Number("2"), "c": json.Number("300"), "d": json.Number("400")}
 	if !reflect.DeepEqual(result.Obj, expected) {
 		t.Errorf("expected %v, got %v", expected, result)
 	}
@@ -59,7 +62,7 @@ func TestLoadAndResolveInheritances_SingleInternalExtends(t *testing.T) {
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
-	expected := map[string]any{"x": map[string]any{"a": float64(1), "b": float64(3), "c": float64(4)}}
+	expected := map[string]any{"x": map[string]any{"a": json.Number("1"), "b": json.Number("3"), "c": json.Number("4")}}
 	if !reflect.DeepEqual(result.Obj, expected) {
 		t.Errorf("expected %v, got %v", expected, result)
 	}
@@ -72,7 +75,7 @@ func TestLoadAndResolveInheritances_SingleLocalExtends(t *testing.T) {
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
-	expected := map[string]any{"x": map[string]any{"a": float64(1), "b": float64(3), "c": float64(4)}}
+	expected := map[string]any{"x": map[string]any{"a": json.Number("1"), "b": json.Number("3"), "c": json.Number("4")}}
 	if !reflect.DeepEqual(result.Obj, expected) {
 		t.Errorf("expected %v, got %v", expected, result)
 	}
@@ -136,7 +139,7 @@ func TestLoadAndResolveInheritances_NestedExtends(t *testing.T) {
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
-	expected := map[string]interface{}{"a": float64(1), "b": float64(2), "c": float64(3)}
+	expected := map[string]interface{}{"a": json.Number("1"), "b": json.Number("2"), "c": json.Number("3")}
 	if !reflect.DeepEqual(result.Obj, expected) {
 		t.Errorf("expected %v, got %v", expected, result)
 	}
@@ -160,7 +163,7 @@ func TestLoadAndResolveInheritances_SingleIncludes(t *testing.T) {
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
-	expected := map[string]interface{}{"a": float64(1), "b": float64(2), "c": float64(4)}
+	expected := map[string]interface{}{"a": json.Number("1"), "b": json.Number("2"), "c": json.Number("4")}
 	if !reflect.DeepEqual(result.Obj, expected) {
 		t.Errorf("expected %v, got %v", expected, result)
 	}
@@ -175,7 +178,7 @@ func TestLoadAndResolveInheritances_MultipleIncludes(t *testing.T) {
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
-	expected := map[string]interface{}{"a": float64(1), "b": float64(21), "c": float64(30), "d": float64(400)}
+	expected := map[string]interface{}{"a": json.Number("1"), "b": json.Number("21"), "c": json.Number("30"), "d": json.Number("400")}
 	if !reflect.DeepEqual(result.Obj, expected) {
 		t.Errorf("expected %v, got %v", expected, result)
 	}
@@ -190,7 +193,7 @@ func TestLoadAndResolveInheritances_BothExtendsAndIncludes(t *testing.T) {
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
-	expected := map[string]interface{}{"a": float64(1), "b": float64(20), "c": float64(30), "d": float64(400)}
+	expected := map[string]interface{}{"a": json.Number("1"), "b": json.Number("20"), "c": json.Number("30"), "d": json.Number("400")}
 	if !reflect.DeepEqual(result.Obj, expected) {
 		t.Errorf("expected %v, got %v", expected, result)
 	}
@@ -204,7 +207,7 @@ func TestLoadAndResolveInheritances_BothExtendsAndIncludesTheSame(t *testing.T)
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
-	expected := map[string]interface{}{"a": float64(1), "b": float64(2), "c": float64(300), "d": float64(400)}
+	expected := map[string]interface{}{"a": json.Number("1"), "b": json.Number("2"), "c": json.Number("300"), "d": json.Number("400")}
 	if !reflect.DeepEqual(result.Obj, expected) {
 		t.Errorf("expected %v, got %v", expected, result)
 	}
@@ -220,8 +223,571 @@ func TestLoadAndResolveInheritances_BothExtendsAndIncludesOneLevelNested(t *test
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
-	expected := map[string]interface{}{"a": float64(1), "b": float64(20), "c": float64(30), "d": float64(400)}
+	expected := map[string]interface{}{"a": json.Number("1"), "b": json.Number("20"), "c": json.Number("30"), "d": json.Number("400")}
 	if !reflect.DeepEqual(result.Obj, expected) {
 		t.Errorf("expected %v, got %v", expected, result)
 	}
 }
+
+func TestLoadAndResolveInheritances_OptionalExtendsMissing(t *testing.T) {
+	dir := t.TempDir()
+	child := testutil.WriteTempJSON(t, dir, "child.json", `{"key": {"$extends": ["missingFile.json?"]}, "$extends": ["missingFile.json?"]}`)
+	result, err := LoadAndResolveInheritances(filepath.Dir(child), filepath.Base(child), []string{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := map[string]any{"key": map[string]any{}}
+	if !reflect.DeepEqual(result.Obj, expected) {
+		t.Errorf("expected %v, got %v", expected, result.Obj)
+	}
+}
+
+func TestLoadAndResolveInheritances_OptionalIncludesExisting(t *testing.T) {
+	dir := t.TempDir()
+	_ = testutil.WriteTempJSON(t, dir, "parent.json", `{"a": 1, "b": 2}`)
+	child := testutil.WriteTempJSON(t, dir, "child.json", `{"$includes": ["parent.json?"], "b": 3}`)
+	result, err := LoadAndResolveInheritances(filepath.Dir(child), filepath.Base(child), []string{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := map[string]any{"a": json.Number("1"), "b": json.Number("2")}
+	if !reflect.DeepEqual(result.Obj, expected) {
+		t.Errorf("expected %v, got %v", expected, result.Obj)
+	}
+}
+
+func TestLoadAndResolveInheritances_OptionalExtendsWithBrokenGrandparent_ThenFail(t *testing.T) {
+	dir := t.TempDir()
+	_ = testutil.WriteTempJSON(t, dir, "parent.json", `{"$extends": ["missingGrandparent.json"]}`)
+	child := testutil.WriteTempJSON(t, dir, "child.json", `{"$extends": ["parent.json?"]}`)
+	_, err := LoadAndResolveInheritances(filepath.Dir(child), filepath.Base(child), []string{})
+	if err == nil || !strings.Contains(err.Error(), "missingGrandparent.json") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestLoadAndResolveInheritances_FileNameEndingWithQuestionMark(t *testing.T) {
+	dir := t.TempDir()
+	_ = testutil.WriteTempJSON(t, dir, "what?", `{"a": 1}`)
+	child := testutil.WriteTempJSON(t, dir, "child.json", `{"x": {"$extends": ["what\\?"]}, "y": {"$extends": ["what\\??"]}, "z": {"$extends": ["missing\\??"]}}`)
+	result, err := LoadAndResolveInheritances(filepath.Dir(child), filepath.Base(child), []string{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := map[string]any{"x": map[string]any{"a": json.Number("1")}, "y": map[string]any{"a": json.Number("1")}, "z": map[string]any{}}
+	if !reflect.DeepEqual(result.Obj, expected) {
+		t.Errorf("expected %v, got %v", expected, result.Obj)
+	}
+}
+
+func TestParseParentReference(t *testing.T) {
+	for _, c := range []struct {
+		entry    string
+		name     string
+		optional bool
+	}{
+		{"a.json", "a.json", false},
+		{"a.json?", "a.json", true},
+		{`a\?`, "a?", false},
+		{`a\??`, "a?", true},
+	} {
+		name, optional := parseParentReference(c.entry)
+		if name != c.name || optional != c.optional {
+			t.Errorf("%q: expected (%q, %v), got (%q, %v)", c.entry, c.name, c.optional, name, optional)
+		}
+	}
+}
+
+func TestSplitFragment(t *testing.T) {
+	for _, c := range []struct {
+		entry    string
+		name     string
+		fragment string
+	}{
+		{"a.json", "a.json", ""},
+		{"a.json#/b/c", "a.json", "/b/c"},
+		{"a.json#.b.c", "a.json", ".b.c"},
+		{"a.json#", "a.json", ""},
+		{"a#b.json", "a#b.json", ""},
+		{`a\#.json#/b`, "a#.json", "/b"},
+	} {
+		name, fragment := splitFragment(c.entry)
+		if name != c.name || fragment != c.fragment {
+			t.Errorf("%q: expected (%q, %q), got (%q, %q)", c.entry, c.name, c.fragment, name, fragment)
+		}
+	}
+}
+
+func TestLoadAndResolveInheritances_Fragments(t *testing.T) {
+	dir := t.TempDir()
+	_ = testutil.WriteTempJSON(t, dir, "grandparent.json", `{"services": {"web": {"port": 80}}}`)
+	_ = testutil.WriteTempJSON(t, dir, "base.json", `{
+  "$extends": ["grandparent.json"],
+  "services": {"web": {"image": "nginx"}, "db": {"image": "postgres"}},
+  "a/b": {"~c": {"hosts": ["x", "y"]}}
+}`)
+	for _, c := range []struct {
+		name     string
+		entry    string
+		expected map[string]any
+	}{
+		{"JSONPointer", "base.json#/services/web", map[string]any{"port": json.Number("80"), "image": "nginx", "name": "app"}},
+		{"PathExpression", "base.json#.services.db", map[string]any{"image": "postgres", "name": "app"}},
+		{"Escapes", "base.json#/a~1b/~0c", map[string]any{"hosts": []any{"x", "y"}, "name": "app"}},
+		{"Optional", "base.json#/services/web?", map[string]any{"port": json.Number("80"), "image": "nginx", "name": "app"}},
+		{"WholeNode", "base.json#", map[string]any{
+			"services": map[string]any{"web": map[string]any{"port": json.Number("80"), "image": "nginx"}, "db": map[string]any{"image": "postgres"}},
+			"a/b":      map[string]any{"~c": map[string]any{"hosts": []any{"x", "y"}}},
+			"name":     "app",
+		}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			child := testutil.WriteTempJSON(t, dir, "child.json", `{"$extends": ["`+c.entry+`"], "name": "app"}`)
+			result, err := LoadAndResolveInheritances(filepath.Dir(child), filepath.Base(child), []string{})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(result.Obj, c.expected) {
+				t.Errorf("expected %v, got %v", c.expected, result.Obj)
+			}
+		})
+	}
+}
+
+func TestLoadAndResolveInheritances_FragmentsOfNonObjects(t *testing.T) {
+	dir := t.TempDir()
+	_ = testutil.WriteTempJSON(t, dir, "hosts.json", `[{"name": "a", "tags": ["x"]}, {"name": "b"}]`)
+	_ = testutil.WriteTempJSON(t, dir, "base.json", `{"hosts": ["a", "b"]}`)
+	child := testutil.WriteTempJSON(t, dir, "child.json", `{
+  "$local": {"l": {"server": {"port": 8080}}},
+  "first": {"$extends": ["hosts.json#/0"], "port": 80},
+  "tags": {"$extends": ["hosts.json#.[0].tags"]},
+  "hosts": {"$extends": ["base.json#/hosts"]},
+  "server": {"$extends": ["l#/server"]}
+}`)
+	session := NewSession([]string{}, SessionOptions{TracksProvenance: true})
+	result, _, err := session.LoadAndResolveInheritances(filepath.Dir(child), filepath.Base(child))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := map[string]any{
+		"first":  map[string]any{"name": "a", "tags": []any{"x"}, "port": json.Number("80")},
+		"tags":   []any{"x"},
+		"hosts":  []any{"a", "b"},
+		"server": map[string]any{"port": json.Number("8080")},
+	}
+	if !reflect.DeepEqual(result.Obj, expected) {
+		t.Errorf("expected %v, got %v", expected, result.Obj)
+	}
+	if origins, ok := result.Provenance.Lookup([]any{"hosts"}); !ok || filepath.Base(origins[len(origins)-1].File) != "base.json" {
+		t.Errorf("unexpected origins: %v", origins)
+	}
+}
+
+func TestLoadAndResolveInheritances_FragmentNotFound_ThenFail(t *testing.T) {
+	dir := t.TempDir()
+	_ = testutil.WriteTempJSON(t, dir, "base.json", `{"services": {"web": {"port": 80}}, "list": [1]}`)
+	for _, each := range []string{"base.json#/services/db", "base.json#/list/1", "base.json#/list/01", "base.json#.services.web.port.x"} {
+		child := testutil.WriteTempJSON(t, dir, "child.json", `{"$extends": ["`+each+`"]}`)
+		_, err := LoadAndResolveInheritances(filepath.Dir(child), filepath.Base(child), []string{})
+		if err == nil || !strings.Contains(err.Error(), "does not refer to a node") {
+			t.Errorf("%s: expected an error, got %v", each, err)
+		}
+	}
+}
+
+func TestLoadAndResolveInheritances_Patterns(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "conf.d", "sub"), 0o755); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	_ = testutil.WriteTempJSON(t, dir, "conf.d/10-b.json", `{"b": 1, "v": "b"}`)
+	_ = testutil.WriteTempJSON(t, dir, "conf.d/00-a.yaml", "a: 1\nv: a\n")
+	_ = testutil.WriteTempJSON(t, dir, "conf.d/20-c.json", `{"c": {"d": 1}, "v": "c"}`)
+	_ = testutil.WriteTempJSON(t, dir, "conf.d/README", "not a node")
+	_ = testutil.WriteTempJSON(t, dir, "conf.d/notes.txt", "not a node")
+	_ = testutil.WriteTempJSON(t, dir, "conf.d/sub/x.json", `{"x": 1}`)
+	all := func(v string) map[string]any {
+		return map[string]any{"a": json.Number("1"), "b": json.Number("1"), "c": map[string]any{"d": json.Number("1")}, "v": v}
+	}
+	for _, c := range []struct {
+		name     string
+		child    string
+		expected map[string]any
+	}{
+		// Files are inherited as if they were listed in sorted order, i.e., an earlier one wins in "$extends".
+		{"Extends", `{"$extends": ["conf.d/*.json"]}`, map[string]any{"b": json.Number("1"), "c": map[string]any{"d": json.Number("1")}, "v": "b"}},
+		{"Includes", `{"$includes": ["conf.d/*.json"]}`, map[string]any{"b": json.Number("1"), "c": map[string]any{"d": json.Number("1")}, "v": "c"}},
+		{"Directory", `{"$extends": ["conf.d"]}`, all("a")},
+		{"DirectoryIncluded", `{"$includes": ["conf.d"]}`, all("c")},
+		{"AmongOthers", `{"$extends": ["conf.d/1*", "conf.d/2*"]}`, map[string]any{"b": json.Number("1"), "c": map[string]any{"d": json.Number("1")}, "v": "b"}},
+		{"Directories", `{"$extends": ["conf.*/s?b/*"]}`, map[string]any{"x": json.Number("1")}},
+		{"Fragments", `{"n": {"$extends": ["conf.d/*.json#/v"]}}`, map[string]any{"n": "b"}},
+		{"OptionalNoMatch", `{"$extends": ["conf.d/*.toml?"], "z": 1}`, map[string]any{"z": json.Number("1")}},
+		{"NodeLevel", `{"n": {"$extends": ["conf.d/0*"]}}`, map[string]any{"n": map[string]any{"a": json.Number("1"), "v": "a"}}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			child := testutil.WriteTempJSON(t, dir, "child.json", c.child)
+			result, err := LoadAndResolveInheritances(filepath.Dir(child), filepath.Base(child), []string{})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(result.Obj, c.expected) {
+				t.Errorf("expected %v, got %v", c.expected, result.Obj)
+			}
+		})
+	}
+}
+
+func TestLoadAndResolveInheritances_Patterns_FirstSearchPath(t *testing.T) {
+	dir := t.TempDir()
+	lib1 := t.TempDir()
+	lib2 := t.TempDir()
+	for _, each := range []string{filepath.Join(lib1, "conf.d"), filepath.Join(lib2, "conf.d"), filepath.Join(lib2, "other")} {
+		if err := os.MkdirAll(each, 0o755); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	_ = testutil.WriteTempJSON(t, lib1, "conf.d/b.json", `{"b": 1}`)
+	_ = testutil.WriteTempJSON(t, lib2, "conf.d/a.json", `{"a": 2}`)
+	_ = testutil.WriteTempJSON(t, lib2, "conf.d/b.json", `{"b": 2}`)
+	_ = testutil.WriteTempJSON(t, lib2, "other/c.json", `{"c": 2}`)
+	child := testutil.WriteTempJSON(t, dir, "child.json", `{"$extends": ["conf.d/*.json", "other"]}`)
+	result, err := LoadAndResolveInheritances(filepath.Dir(child), filepath.Base(child), []string{lib1, lib2})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if expected := map[string]any{"b": json.Number("1"), "c": json.Number("2")}; !reflect.DeepEqual(result.Obj, expected) {
+		t.Errorf("expected %v, got %v", expected, result.Obj)
+	}
+}
+
+func TestLoadAndResolveInheritances_BracketedFileName(t *testing.T) {
+	dir := t.TempDir()
+	_ = testutil.WriteTempJSON(t, dir, "a[1].json", `{"a": 1}`)
+	_ = testutil.WriteTempJSON(t, dir, "b[1.json", `{"b": 1}`)
+	_ = testutil.WriteTempJSON(t, dir, "c1.json", `{"c": 1}`)
+	child := testutil.WriteTempJSON(t, dir, "child.json", `{"$extends": ["a[1].json", "b[1.json", "c[1].json"]}`)
+	result, err := LoadAndResolveInheritances(filepath.Dir(child), filepath.Base(child), []string{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if expected := map[string]any{"a": json.Number("1"), "b": json.Number("1"), "c": json.Number("1")}; !reflect.DeepEqual(result.Obj, expected) {
+		t.Errorf("expected %v, got %v", expected, result.Obj)
+	}
+}
+
+func TestLoadAndResolveInheritances_PatternNoMatch_ThenFail(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "conf.d"), 0o755); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	_ = testutil.WriteTempJSON(t, dir, "conf.d/a.txt", "not a node")
+	child := testutil.WriteTempJSON(t, dir, "child.json", `{"$extends": ["conf.d/*"]}`)
+	_, err := LoadAndResolveInheritances(filepath.Dir(child), filepath.Base(child), []string{})
+	if !errors.Is(err, ErrFileNotFound) || !strings.Contains(err.Error(), "conf.d/*") {
+		t.Errorf("expected an error for a pattern matching nothing, got %v", err)
+	}
+}
+
+func TestLoadAndResolveInheritances_PatternMatchError_ThenFail(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "conf.d"), 0o755); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	_ = testutil.WriteTempJSON(t, dir, "conf.d/a.json", `{"a": 1}`)
+	_ = testutil.WriteTempJSON(t, dir, "conf.d/b.json", `{"b": `)
+	child := testutil.WriteTempJSON(t, dir, "child.json", `{"$extends": ["conf.d/*.json#/x"]}`)
+	_, err := LoadAndResolveInheritances(filepath.Dir(child), filepath.Base(child), []string{})
+	if err == nil || !strings.Contains(err.Error(), "b.json") {
+		t.Errorf("expected an error for b.json, got %v", err)
+	}
+	_ = testutil.WriteTempJSON(t, dir, "conf.d/b.json", `{"b": 1}`)
+	_, err = LoadAndResolveInheritances(filepath.Dir(child), filepath.Base(child), []string{})
+	if err == nil || !strings.Contains(err.Error(), filepath.Join("conf.d", "b.json")+"#/x") {
+		t.Errorf("expected an error for the fragment of b.json, got %v", err)
+	}
+}
+
+func TestLoadAndResolveInheritances_MergeDirective(t *testing.T) {
+	dir := t.TempDir()
+	_ = testutil.WriteTempJSON(t, dir, "parent.json", `{"tags": ["a", "b"], "n": {"list": [1]}}`)
+	_ = testutil.WriteTempJSON(t, dir, "included.json", `{"list": [3]}`)
+	child := testutil.WriteTempJSON(t, dir, "child.json", `{
+  "$extends": ["parent.json"],
+  "$merge": {"tags": "union"},
+  "tags": ["b", "c"],
+  "n": {"$includes": ["included.json"], "$merge": {".list": "append"}, "list": [2]}
+}`)
+	result, err := LoadAndResolveInheritances(filepath.Dir(child), filepath.Base(child), []string{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := map[string]any{"tags": []any{"a", "b", "c"}, "n": map[string]any{"list": []any{json.Number("2"), json.Number("3")}}}
+	if !reflect.DeepEqual(result.Obj, expected) {
+		t.Errorf("expected %v, got %v", expected, result.Obj)
+	}
+}
+
+func TestLoadAndResolveInheritances_NestedMergeDirective(t *testing.T) {
+	dir := t.TempDir()
+	_ = testutil.WriteTempJSON(t, dir, "parent.json", `{"s": {"xs": [1], "t": {"ys": [1]}, "zs": [1]}}`)
+	child := testutil.WriteTempJSON(t, dir, "child.json", `{
+  "$extends": ["parent.json"],
+  "$merge": {".s.zs": "append"},
+  "s": {"$merge": {"xs": "append", ".zs": "prepend"}, "xs": [2], "t": {"$merge": {".": "union"}, "ys": [2, 1]}, "zs": [2]}
+}`)
+	result, err := LoadAndResolveInheritances(filepath.Dir(child), filepath.Base(child), []string{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := map[string]any{"s": map[string]any{
+		"xs": []any{json.Number("1"), json.Number("2")},
+		"t":  map[string]any{"ys": []any{json.Number("1"), json.Number("2")}},
+		"zs": []any{json.Number("1"), json.Number("2")},
+	}}
+	if !reflect.DeepEqual(result.Obj, expected) {
+		t.Errorf("expected %v, got %v", expected, result.Obj)
+	}
+}
+
+func TestLoadAndResolveInheritances_MergeDirectiveErrorOnConflict_ThenFail(t *testing.T) {
+	dir := t.TempDir()
+	_ = testutil.WriteTempJSON(t, dir, "parent.json", `{"a": {"b": 1}}`)
+	child := testutil.WriteTempJSON(t, dir, "child.json", `{"$extends": ["parent.json"], "$merge": {".": "errorOnConflict"}, "a": {"b": 2}}`)
+	_, err := LoadAndResolveInheritances(filepath.Dir(child), filepath.Base(child), []string{})
+	if err == nil || !strings.Contains(err.Error(), "conflicting values at .a.b") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestLoadAndResolveInheritances_MergeDirectiveComparesNumbersAcrossFormats(t *testing.T) {
+	dir := t.TempDir()
+	_ = testutil.WriteTempJSON(t, dir, "parent.yaml", "a:\n  - id: 1.0\n    x: 1\nb: [1.0, 2]\nc: {n: 1.50, m: 10}\n")
+	for _, c := range []struct {
+		name     string
+		child    string
+		expected map[string]any
+	}{
+		{"MergeByKey", `{"$extends": ["parent.yaml"], "$merge": {"a": "mergeByKey:id"}, "a": [{"id": 1, "y": 2}]}`, map[string]any{
+			"a": []any{map[string]any{"id": json.Number("1"), "x": json.Number("1"), "y": json.Number("2")}},
+		}},
+		{"Union", `{"$extends": ["parent.yaml"], "$merge": {"b": "union"}, "b": [1, 2e0, "1", 3]}`, map[string]any{
+			"b": []any{json.Number("1.0"), json.Number("2"), "1", json.Number("3")},
+		}},
+		{"ErrorOnConflict", `{"$extends": ["parent.yaml"], "$merge": {".": "errorOnConflict"}, "c": {"n": 1.5, "m": 1e1}}`, map[string]any{
+			"c": map[string]any{"n": json.Number("1.5"), "m": json.Number("1e1")},
+		}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			child := testutil.WriteTempJSON(t, dir, "child.json", c.child)
+			result, err := LoadAndResolveInheritances(filepath.Dir(child), filepath.Base(child), []string{})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			for k, v := range c.expected {
+				if !reflect.DeepEqual(result.Obj[k], v) {
+					t.Errorf("%s: expected %v, got %v", k, v, result.Obj[k])
+				}
+			}
+		})
+	}
+	child := testutil.WriteTempJSON(t, dir, "child.json", `{"$extends": ["parent.yaml"], "$merge": {".": "errorOnConflict"}, "c": {"n": 1.51}}`)
+	if _, err := LoadAndResolveInheritances(filepath.Dir(child), filepath.Base(child), []string{}); err == nil || !strings.Contains(err.Error(), "conflicting values at .c.n") {
+		t.Errorf("expected a conflict, got %v", err)
+	}
+}
+
+func TestLoadAndResolveInheritances_DeleteDirective(t *testing.T) {
+	dir := t.TempDir()
+	_ = testutil.WriteTempJSON(t, dir, "parent.json", `{"a": 1, "b": {"c": 2, "d": 3}, "e": 4}`)
+	child := testutil.WriteTempJSON(t, dir, "child.json", `{"$extends": ["parent.json"], "$delete": ["a", "b.c"]}`)
+	sibling := testutil.WriteTempJSON(t, dir, "sibling.json", `{"$extends": ["parent.json"], "x": {"$extends": ["parent.json"]}}`)
+	nodepool := NewNodePoolWithBaseSearchPaths(dir, []string{})
+	result, err := nodepool.ReadNodeEntryValue(dir, filepath.Base(child), []*JqModule{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := map[string]any{"b": map[string]any{"d": json.Number("3")}, "e": json.Number("4")}
+	if !reflect.DeepEqual(result.Obj, expected) {
+		t.Errorf("expected %v, got %v", expected, result.Obj)
+	}
+	// The parent cached in the pool must stay intact.
+	result, err = nodepool.ReadNodeEntryValue(dir, filepath.Base(sibling), []*JqModule{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	parent := map[string]any{"a": json.Number("1"), "b": map[string]any{"c": json.Number("2"), "d": json.Number("3")}, "e": json.Number("4")}
+	if !reflect.DeepEqual(result.Obj["b"], parent["b"]) || !reflect.DeepEqual(result.Obj["x"], parent) {
+		t.Errorf("unexpected result: %v", result.Obj)
+	}
+}
+
+func TestLoadAndResolveInheritances_UnsetAndReplace(t *testing.T) {
+	dir := t.TempDir()
+	_ = testutil.WriteTempJSON(t, dir, "grandparent.json", `{"a": 1, "b": {"c": 2, "d": 3}, "n": {"x": 1, "y": 2}}`)
+	_ = testutil.WriteTempJSON(t, dir, "parent.json", `{"$extends": ["grandparent.json"], "a": "$unset", "z": "$unset"}`)
+	child := testutil.WriteTempJSON(t, dir, "child.json", `{
+  "$extends": ["parent.json"],
+  "b": {"$replace": true, "e": 4},
+  "n": {"$extends": ["grandparent.json"], "x": "$unset"}
+}`)
+	result, err := LoadAndResolveInheritances(filepath.Dir(child), filepath.Base(child), []string{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := map[string]any{
+		"b": map[string]any{"e": json.Number("4")},
+		"n": map[string]any{
+			"a": json.Number("1"),
+			"b": map[string]any{"c": json.Number("2"), "d": json.Number("3")},
+			"n": map[string]any{"x": json.Number("1"), "y": json.Number("2")},
+			"y": json.Number("2"),
+		},
+	}
+	if !reflect.DeepEqual(result.Obj, expected) {
+		t.Errorf("expected %v, got %v", expected, result.Obj)
+	}
+}
+
+func TestWithoutMergeMarkers_LeavesGivenValueUntouched(t *testing.T) {
+	shared := map[string]any{"c": json.Number("1")}
+	v := map[string]any{"a": []any{map[string]any{"$replace": true, "b": "$unset"}}, "s": shared, "x": "$unset"}
+	ret, found := withoutMergeMarkers(v)
+	if expected := map[string]any{"a": []any{map[string]any{}}, "s": shared}; !found || !reflect.DeepEqual(ret, expected) {
+		t.Errorf("unexpected result: %v, %v", ret, found)
+	}
+	if expected := map[string]any{"a": []any{map[string]any{"$replace": true, "b": "$unset"}}, "s": shared, "x": "$unset"}; !reflect.DeepEqual(v, expected) {
+		t.Errorf("expected %v to be untouched", v)
+	}
+	if _, found := withoutMergeMarkers(shared); found {
+		t.Errorf("expected no markers in %v", shared)
+	}
+}
+
+func TestLoadAndResolveInheritances_DeleteDirectiveInvalid_ThenFail(t *testing.T) {
+	dir := t.TempDir()
+	child := testutil.WriteTempJSON(t, dir, "child.json", `{"$delete": "a"}`)
+	_, err := LoadAndResolveInheritances(filepath.Dir(child), filepath.Base(child), []string{})
+	if err == nil || !strings.Contains(err.Error(), "$delete must be an array of strings") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestLoadAndResolveInheritancesWithDependencies(t *testing.T) {
+	dir := t.TempDir()
+	grandparent := testutil.WriteTempJSON(t, dir, "grandparent.json", `{"a": 1}`)
+	parent := testutil.WriteTempJSON(t, dir, "parent.json", `{"$extends": ["grandparent.json"], "b": 2}`)
+	module := testutil.WriteTempJSON(t, dir, "funcs.jq", `def f: 1;`)
+	child := testutil.WriteTempJSON(t, dir, "child.json", `{
+  "$extends": ["parent.json", "funcs.jq"],
+  "$local": {"local.json": {"c": 3}},
+  "x": {"$extends": ["local.json"]}
+}`)
+	_, dependencies, err := LoadAndResolveInheritancesWithDependencies(dir, filepath.Base(child), []string{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := Sort([]string{child, parent, grandparent, module}, func(a, b string) bool { return a < b })
+	if !reflect.DeepEqual(dependencies, expected) {
+		t.Errorf("expected %v, got %v", expected, dependencies)
+	}
+}
+
+func TestLoadAndResolveInheritancesWithDependencies_BrokenParent(t *testing.T) {
+	dir := t.TempDir()
+	parent := testutil.WriteTempJSON(t, dir, "parent.json", `{"a": `)
+	child := testutil.WriteTempJSON(t, dir, "child.json", `{"$extends": ["parent.json"]}`)
+	_, dependencies, err := LoadAndResolveInheritancesWithDependencies(dir, filepath.Base(child), []string{})
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if !reflect.DeepEqual(dependencies, []string{child, parent}) {
+		t.Errorf("unexpected dependencies: %v", dependencies)
+	}
+}
+
+func TestLoadAndResolveInheritances_NonObjectDocuments(t *testing.T) {
+	for _, each := range []struct {
+		name     string
+		content  string
+		expected any
+	}{
+		{"hosts.json", `["a", "b"]`, []any{"a", "b"}},
+		{"hosts.yaml", "- a\n- b\n", []any{"a", "b"}},
+		{"hosts.json5", "['a', 'b',]", []any{"a", "b"}},
+		{"hosts.conf", `["a", "b"]`, []any{"a", "b"}},
+		{"answer.json", `42`, json.Number("42")},
+		{"name.yaml", "jqpp\n", "jqpp"},
+	} {
+		t.Run(each.name, func(t *testing.T) {
+			dir := t.TempDir()
+			file := testutil.WriteTempJSON(t, dir, each.name, each.content)
+			result, err := LoadAndResolveInheritances(filepath.Dir(file), filepath.Base(file), []string{})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if document, root := UnwrapDocument(result.Obj); !reflect.DeepEqual(document, each.expected) || !reflect.DeepEqual(root, []any{ValueDirective}) {
+				t.Errorf("expected %v, got %v at %v", each.expected, document, root)
+			}
+		})
+	}
+}
+
+func TestLoadAndResolveInheritances_ExtendsArrays(t *testing.T) {
+	dir := t.TempDir()
+	_ = testutil.WriteTempJSON(t, dir, "hosts.json", `["a", "b"]`)
+	_ = testutil.WriteTempJSON(t, dir, "more.yaml", "- c\n- a\n")
+	child := testutil.WriteTempJSON(t, dir, "child.json", `{
+  "$extends": ["more.yaml", "hosts.json"],
+  "$merge": {".": "union"}
+}`)
+	result, err := LoadAndResolveInheritances(filepath.Dir(child), filepath.Base(child), []string{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := map[string]any{ValueDirective: []any{"a", "b", "c"}}
+	if !reflect.DeepEqual(result.Obj, expected) {
+		t.Errorf("expected %v, got %v", expected, result.Obj)
+	}
+}
+
+func TestLoadAndResolveInheritances_InternalNodesExtendingNonObjects(t *testing.T) {
+	dir := t.TempDir()
+	_ = testutil.WriteTempJSON(t, dir, "hosts.json", `["a", "b"]`)
+	_ = testutil.WriteTempJSON(t, dir, "answer.json", `42`)
+	child := testutil.WriteTempJSON(t, dir, "child.json", `{
+  "allowed": {"$extends": ["hosts.json"]},
+  "extra": {"$extends": ["hosts.json"], "$merge": {".": "append"}, "$value": ["c"]},
+  "answer": {"$extends": ["answer.json"]},
+  "plain": {"$value": {"k": "v"}}
+}`)
+	result, err := LoadAndResolveInheritances(filepath.Dir(child), filepath.Base(child), []string{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := map[string]any{
+		"allowed": []any{"a", "b"},
+		"extra":   []any{"a", "b", "c"},
+		"answer":  json.Number("42"),
+		"plain":   map[string]any{"k": "v"},
+	}
+	if !reflect.DeepEqual(result.Obj, expected) {
+		t.Errorf("expected %v, got %v", expected, result.Obj)
+	}
+}
+
+func TestLoadAndResolveInheritances_ObjectExtendingArray_ThenFail(t *testing.T) {
+	dir := t.TempDir()
+	_ = testutil.WriteTempJSON(t, dir, "hosts.json", `["a", "b"]`)
+	for _, each := range []string{
+		`{"$extends": ["hosts.json"], "x": 1}`,
+		`{"nested": {"$includes": ["hosts.json"], "x": 1}}`,
+	} {
+		child := testutil.WriteTempJSON(t, dir, "child.json", each)
+		_, err := LoadAndResolveInheritances(filepath.Dir(child), filepath.Base(child), []string{})
+		if err == nil || !strings.Contains(err.Error(), "$value: cannot be merged with other keys") || !strings.Contains(err.Error(), ": x") {
+			t.Errorf("%s: unexpected error: %v", each, err)
+		}
+	}
+}
@@ -13,11 +13,28 @@ import (
 // Fields:
 //   - modules: A slice of gojq.CompilerOption values representing modules
 //     required for invocation. These could modify or enrich the behavior of the compiler.
+//   - functions: Native functions registered to the compiler, such as jq-front's built-in functions.
 //   - variables: A map where the keys are variable names (strings) and
 //     values are of type any, representing the parameters for the invocation.
+//   - environ: Environment variables exposed to expressions as `$ENV` and `env`.
 type InvocationSpec struct {
 	modules   []*JqModule
-	variables map[string]any
+	functions []*JqFunction
+	// definitions are jq function definitions (e.g. "def f: .;") placed before the expression.
+	definitions []string
+	variables   map[string]any
+	// environ is the environment, in the form of "NAME=value", visible to expressions through `$ENV` and `env`.
+	// If nil, expressions see an empty environment.
+	environ []string
+}
+
+// JqFunction is a native function made available to jq expressions through gojq.WithFunction.
+type JqFunction struct {
+	Name     string
+	MinArity int
+	MaxArity int
+	// Callback receives the input and the evaluated arguments. Returning an error aborts the evaluation.
+	Callback func(input any, args []any) any
 }
 
 // VariableNames returns a slice of all variable names present in the InvocationSpec.
@@ -83,13 +100,27 @@ func (spec *InvocationSpec) ModuleNames() []string {
 	})
 }
 
+// Definitions returns jq function definitions to be placed before an expression.
+func (spec *InvocationSpec) Definitions() []string {
+	return spec.definitions
+}
+
 func (spec *InvocationSpec) CompilerOptions() []gojq.CompilerOption {
 	if spec.modules == nil {
 		spec.modules = make([]*JqModule, 0)
 	}
-	return Map(spec.modules, func(in *JqModule) gojq.CompilerOption {
-		return in.CompilerOption
-	})
+	ret := append(
+		Map(spec.modules, func(in *JqModule) gojq.CompilerOption {
+			return in.CompilerOption
+		}),
+		Map(spec.functions, func(in *JqFunction) gojq.CompilerOption {
+			return gojq.WithFunction(in.Name, in.MinArity, in.MaxArity, in.Callback)
+		})...)
+	if spec.environ != nil {
+		environ := spec.environ
+		ret = append(ret, gojq.WithEnvironLoader(func() []string { return environ }))
+	}
+	return ret
 }
 
 type InvocationSpecBuilder struct {
@@ -113,7 +144,9 @@ func NewInvocationSpecBuilder() *InvocationSpecBuilder {
 func FromSpec(spec *InvocationSpec) *InvocationSpecBuilder {
 	return &InvocationSpecBuilder{
 		spec: &InvocationSpec{
-			modules: append([]*JqModule{}, spec.modules...),
+			modules:     append([]*JqModule{}, spec.modules...),
+			functions:   append([]*JqFunction{}, spec.functions...),
+			definitions: append([]string{}, spec.definitions...),
 			variables: func() map[string]any {
 				cloned := map[string]any{}
 				for k, v := range spec.variables {
@@ -121,6 +154,7 @@ func FromSpec(spec *InvocationSpec) *InvocationSpecBuilder {
 				}
 				return cloned
 			}(),
+			environ: spec.environ,
 		},
 	}
 }
@@ -130,6 +164,19 @@ func (b *InvocationSpecBuilder) AddModules(modules ...*JqModule) *InvocationSpec
 	return b
 }
 
+// AddFunctions adds native functions to the InvocationSpec.
+// A function added later overrides an earlier one with the same name.
+func (b *InvocationSpecBuilder) AddFunctions(functions ...*JqFunction) *InvocationSpecBuilder {
+	b.spec.functions = append(b.spec.functions, functions...)
+	return b
+}
+
+// AddDefinitions adds jq function definitions, each of which must end with a semicolon.
+func (b *InvocationSpecBuilder) AddDefinitions(definitions ...string) *InvocationSpecBuilder {
+	b.spec.definitions = append(b.spec.definitions, definitions...)
+	return b
+}
+
 // AddVariable adds a variable to the InvocationSpec's variables map.
 func (b *InvocationSpecBuilder) AddVariable(name string, value any) *InvocationSpecBuilder {
 	if b.spec.variables == nil {
@@ -139,6 +186,12 @@ func (b *InvocationSpecBuilder) AddVariable(name string, value any) *InvocationS
 	return b
 }
 
+// SetEnviron sets the environment, each entry of which is "NAME=value", visible to expressions as `$ENV` and `env`.
+func (b *InvocationSpecBuilder) SetEnviron(environ []string) *InvocationSpecBuilder {
+	b.spec.environ = append([]string{}, environ...)
+	return b
+}
+
 // Build returns the built InvocationSpec.
 func (b *InvocationSpecBuilder) Build() *InvocationSpec {
 	return b.spec
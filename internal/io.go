@@ -6,18 +6,17 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
 )
 
-// MaterializeLocalNodes materializes Obj["$local"] into files under dir.
-// Returns dir (absolute) on success.
-func MaterializeLocalNodes(obj map[string]any, localNodeDirectoryBase string) (string, error) {
+// materializeLocalNodes places Obj["$local"] in files under a new directory of overlay, in memory.
+// Returns the directory on success, or "" if obj has no $local nodes.
+// Objects are written as JSON, with their keys in the order given by keyOrder, the KeyOrder of obj.
+func materializeLocalNodes(obj map[string]any, keyOrder *KeyOrder, overlay *overlayFileSystem) (string, error) {
 	if obj == nil {
 		return "", errors.New("Obj is nil")
 	}
-	if strings.TrimSpace(localNodeDirectoryBase) == "" {
-		return "", errors.New("dir is empty")
-	}
 
 	localAny, ok := obj["$local"]
 	if !ok || localAny == nil {
@@ -29,10 +28,7 @@ func MaterializeLocalNodes(obj map[string]any, localNodeDirectoryBase string) (s
 		return "", fmt.Errorf(`"$local" must be an object (map[string]any), got %T`, localAny)
 	}
 
-	absDir, err := os.MkdirTemp(localNodeDirectoryBase, "localnodes-")
-	if err != nil {
-		return "", fmt.Errorf("mkdir temp dir: %w", err)
-	}
+	absDir := overlay.newLocalNodeDirectory()
 
 	for name, v := range localObj {
 		rel, err := sanitizeRelativePath(name)
@@ -51,20 +47,12 @@ func MaterializeLocalNodes(obj map[string]any, localNodeDirectoryBase string) (s
 			return "", fmt.Errorf("path traversal detected for %q", name)
 		}
 
-		// Create parent dirs
-		if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
-			return "", fmt.Errorf("mkdir parent for %q: %w", target, err)
-		}
-
-		data, err := toFileBytes(v)
+		data, err := toFileBytes(keyOrder.Subtree([]any{"$local", name}).Ordered(v))
 		if err != nil {
 			return "", fmt.Errorf("convert content for %q: %w", name, err)
 		}
 
-		// Write file (0644); overwrite if exists
-		if err := os.WriteFile(target, data, 0o644); err != nil {
-			return "", fmt.Errorf("write %q: %w", target, err)
-		}
+		overlay.writeFile(target, data)
 	}
 
 	return absDir, nil
@@ -130,18 +118,15 @@ func SearchPaths() []string {
 	return strings.Split(v, ":")
 }
 
-func CreateSessionDirectory() string {
-	v, ok := os.LookupEnv("JF_SESSION_DIR_BASE")
-	if !ok {
-		v = ""
-	}
-	ret, e := os.MkdirTemp(v, "jq++-session-*")
-	if e != nil {
-		panic(fmt.Sprintf("failed to create session directory: %v", e))
-	}
-	return ret
+// CacheDirectory returns the directory in which resolved nodes are stored across processes, taken from JF_CACHE_DIR.
+// "" means none.
+func CacheDirectory() string {
+	return os.Getenv("JF_CACHE_DIR")
 }
 
+// ErrFileNotFound is returned (wrapped) by ResolveFilePath when a file cannot be found on any of the search paths.
+var ErrFileNotFound = errors.New("file not found")
+
 // ResolveFilePath finds the full path of a referenced file from a list of directories.
 // This function works in the following way:
 // 1. Iterate over the search paths
@@ -152,6 +137,16 @@ func CreateSessionDirectory() string {
 //
 // 2. If the file is not found, return an error.
 func ResolveFilePath(filename string, baseDir string, searchPaths []string) (string, string, error) {
+	return ResolveFilePathIn(OSFileSystem(), filename, baseDir, searchPaths)
+}
+
+// ResolveFilePathIn works like ResolveFilePath for a file in fsys.
+func ResolveFilePathIn(fsys FileSystem, filename string, baseDir string, searchPaths []string) (string, string, error) {
+	return resolveFilePath(fsys, filename, baseDir, searchPaths, func(string) {})
+}
+
+// resolveFilePath works like ResolveFilePathIn, and calls absent with each path looked at in vain.
+func resolveFilePath(fsys FileSystem, filename string, baseDir string, searchPaths []string, absent func(path string)) (string, string, error) {
 	if filepath.IsAbs(filename) {
 		return filename, filepath.Dir(filename), nil
 	}
@@ -171,7 +166,7 @@ func ResolveFilePath(filename string, baseDir string, searchPaths []string) (str
 		// Check if the path exists.
 		// 	If exists, return it.
 		fullPath := filepath.Join(path, filename)
-		if _, err := os.Stat(fullPath); err == nil {
+		if _, err := fsys.Stat(fullPath); err == nil {
 			// If it is a true file, return it.
 			if !os.IsNotExist(err) {
 				return fullPath, filepath.Dir(fullPath), nil
@@ -179,6 +174,116 @@ func ResolveFilePath(filename string, baseDir string, searchPaths []string) (str
 			// If it is a directory, return an error.
 			return "", "", fmt.Errorf("file is a directory: %s", fullPath)
 		}
+		absent(fullPath)
+	}
+	return "", "", fmt.Errorf("%w: %s", ErrFileNotFound, filename)
+}
+
+// resolveFilePaths resolves a name that is a pattern (see isFilePattern) or a directory into the supported files it
+// matches or the directory holds, on the first of baseDir and searchPaths where there is any, in the same order as
+// resolveFilePath looks for a file.
+// The files are returned sorted and relative to the directory they are found in, which is returned as well.
+// A supported file is one detectFileType gives a format to. Files in a directory must have an extension as well, so
+// that files such as READMEs are left out.
+// ok is false if the name is neither a pattern nor a directory, or a file exists at the name as it is, in which case
+// resolveFilePath should be used.
+// listed is called with each directory whose entries are looked at.
+func resolveFilePaths(fsys FileSystem, name string, baseDir string, searchPaths []string, listed func(dir string)) (root string, files []string, ok bool, err error) {
+	dirs := []string{""}
+	if !filepath.IsAbs(name) {
+		dirs = searchPaths
+		if baseDir != "" {
+			dirs = append([]string{baseDir}, searchPaths...)
+		}
+	}
+	pattern := isFilePattern(name)
+	for _, dir := range dirs {
+		fullPath := filepath.Join(dir, name)
+		var candidates []string
+		// A file or a directory at the name itself is preferred to a pattern, e.g., "a[1].json" is the file, if any.
+		info, statErr := fsys.Stat(fullPath)
+		if statErr == nil && !info.IsDir() {
+			return "", nil, false, nil
+		}
+		globbed := statErr != nil && pattern
+		if globbed {
+			if candidates, err = globIn(fsys, fullPath, listed); errors.Is(err, filepath.ErrBadPattern) {
+				// A malformed pattern, e.g., "a[1.json", can only be a file.
+				return "", nil, false, nil
+			} else if err != nil {
+				return "", nil, true, err
+			}
+		} else {
+			if statErr != nil {
+				continue
+			}
+			entries, err := fsys.ReadDir(fullPath)
+			if err != nil {
+				return "", nil, true, err
+			}
+			listed(fullPath)
+			for _, each := range entries {
+				candidates = append(candidates, filepath.Join(fullPath, each.Name()))
+			}
+		}
+		files = []string{}
+		for _, each := range candidates {
+			if _, supported := detectFileType(each); !supported || (!globbed && filepath.Ext(each) == "") {
+				continue
+			}
+			if info, statErr := fsys.Stat(each); statErr != nil || info.IsDir() {
+				continue
+			}
+			if dir != "" {
+				each, _ = filepath.Rel(dir, each)
+			}
+			files = append(files, each)
+		}
+		if len(files) > 0 || !globbed {
+			slices.Sort(files)
+			return dir, files, true, nil
+		}
+	}
+	if !pattern {
+		return "", nil, false, nil
+	}
+	return "", nil, true, fmt.Errorf("%w: %s", ErrFileNotFound, name)
+}
+
+// isFilePattern tells if a name is a pattern of files, i.e., it has "*" or "[". Once it is, "?" in it matches any
+// character as well. See filepath.Match for the syntax.
+func isFilePattern(name string) bool {
+	return strings.ContainsAny(name, "*[")
+}
+
+// globIn returns the names in fsys that match pattern, any element of which may be a pattern, as filepath.Glob does.
+// listed is called with each directory whose entries are looked at.
+func globIn(fsys FileSystem, pattern string, listed func(dir string)) ([]string, error) {
+	dir, file := filepath.Split(pattern)
+	dir = filepath.Clean(dir)
+	dirs := []string{dir}
+	if isFilePattern(dir) {
+		var err error
+		if dirs, err = globIn(fsys, dir, listed); err != nil {
+			return nil, err
+		}
+	}
+	var ret []string
+	for _, each := range dirs {
+		entries, err := fsys.ReadDir(each)
+		if err != nil {
+			continue
+		}
+		listed(each)
+		for _, entry := range entries {
+			matched, err := filepath.Match(file, entry.Name())
+			if err != nil {
+				return nil, err
+			}
+			if matched {
+				ret = append(ret, filepath.Join(each, entry.Name()))
+			}
+		}
 	}
-	return "", "", fmt.Errorf("file not found: %s", filename)
+	return ret, nil
 }
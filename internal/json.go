@@ -1,15 +1,20 @@
 package internal
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/BurntSushi/toml"
 	"github.com/gurkankaymak/hocon"
 	"github.com/itchyny/gojq"
 	"github.com/titanous/json5"
 	"gopkg.in/yaml.v3"
+	"maps"
 	"os"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
 	"unicode"
 )
@@ -26,6 +31,41 @@ const (
 	HOCON FileType = "hocon"
 )
 
+// DetectFileType tells the type of a file from the extension of its name.
+func DetectFileType(name string) (FileType, bool) {
+	return detectFileType(name)
+}
+
+// ParseInputFormat parses the name of a format in which a document can be given, e.g. "yaml".
+func ParseInputFormat(s string) (FileType, error) {
+	switch ft := FileType(s); ft {
+	case JSON, YAML, TOML, JSON5, HCL, HOCON:
+		return ft, nil
+	}
+	return "", fmt.Errorf("unknown input format: %q", s)
+}
+
+// SniffFileType tells the type of a document from its content, i.e., the first of JSON, JSON5, YAML, TOML, and HOCON
+// that can parse it, where YAML is taken only for objects and arrays, since it parses almost any text into a string.
+// HCL is never returned, since HCL documents are mostly TOML ones as well.
+func SniffFileType(data []byte) (FileType, bool) {
+	for _, ft := range []FileType{JSON, JSON5, YAML, TOML, HOCON} {
+		obj, _, err := ParseRawJSON(data, "", ft)
+		if err != nil {
+			continue
+		}
+		document, _ := UnwrapDocument(obj)
+		switch document.(type) {
+		case map[string]any, []any:
+			return ft, true
+		}
+		if ft != YAML {
+			return ft, true
+		}
+	}
+	return "", false
+}
+
 func detectFileType(name string) (FileType, bool) {
 	ext := strings.ToLower(filepath.Ext(name))
 
@@ -54,11 +94,27 @@ func readJSON(targetFileAbsPath string) (map[string]any, *JqModule, error) {
 	if err != nil {
 		return nil, nil, err
 	}
-	var obj map[string]any
-	if err := json.Unmarshal(data, &obj); err != nil {
+	return parseJSON(data, targetFileAbsPath)
+}
+
+func parseJSON(data []byte, targetFileAbsPath string) (map[string]any, *JqModule, error) {
+	var v any
+	if err := UnmarshalJSON(data, &v); err != nil {
+		var syntaxError *json.SyntaxError
+		if errors.As(err, &syntaxError) {
+			return nil, nil, &LoadError{File: targetFileAbsPath, Line: lineAt(data, syntaxError.Offset), Err: err}
+		}
 		return nil, nil, err
 	}
-	return obj, nil, nil
+	return wrapDocument(v), nil, nil
+}
+
+// lineAt returns the 1-based line number of the given byte offset in data.
+func lineAt(data []byte, offset int64) int {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	return bytes.Count(data[:offset], []byte("\n")) + 1
 }
 
 type moduleLoader struct {
@@ -82,14 +138,18 @@ func readJQ(targetFileAbsPath string) (map[string]any, *JqModule, error) {
 	if err != nil {
 		return nil, nil, err
 	}
+	return parseJQ(data, targetFileAbsPath)
+}
+
+// parseJQ parses a jq module, whose name is taken from the file name without extensions.
+func parseJQ(data []byte, targetFileAbsPath string) (map[string]any, *JqModule, error) {
 	query, err := gojq.Parse(string(data))
 	if err != nil {
 		return nil, nil, err
 	}
-	name := filepath.Base(targetFileAbsPath)
-	name = strings.SplitN(filepath.Base(targetFileAbsPath), ".", 2)[0]
+	name := strings.SplitN(filepath.Base(targetFileAbsPath), ".", 2)[0]
 	ret := gojq.WithModuleLoader(newModuleLoader(name, query))
-	return map[string]any{}, &JqModule{Name: name, CompilerOption: ret}, nil
+	return map[string]any{}, &JqModule{Name: name, Path: targetFileAbsPath, CompilerOption: ret}, nil
 }
 
 func readYAML(path string) (map[string]any, *JqModule, error) {
@@ -97,12 +157,90 @@ func readYAML(path string) (map[string]any, *JqModule, error) {
 	if err != nil {
 		return nil, nil, err
 	}
+	return parseYAML(data)
+}
 
-	var m map[string]any
-	if err := yaml.Unmarshal(data, &m); err != nil {
+// parseYAML parses a YAML document, keeping numbers as they are written, e.g., integers beyond 64 bits.
+func parseYAML(data []byte) (map[string]any, *JqModule, error) {
+	var node yaml.Node
+	if err := yaml.Unmarshal(data, &node); err != nil {
 		return nil, nil, err
 	}
-	return m, nil, nil
+	v, err := yamlNodeToAny(&node)
+	if err != nil {
+		return nil, nil, err
+	}
+	return wrapDocument(v), nil, nil
+}
+
+// yamlNodeToAny converts a YAML node into a JSON-compatible value, resolving aliases and merge keys ("<<") as
+// yaml.Unmarshal does.
+func yamlNodeToAny(n *yaml.Node) (any, error) {
+	switch n.Kind {
+	case yaml.DocumentNode:
+		if len(n.Content) == 0 {
+			return nil, nil
+		}
+		return yamlNodeToAny(n.Content[0])
+	case yaml.AliasNode:
+		return yamlNodeToAny(n.Alias)
+	case yaml.SequenceNode:
+		ret := make([]any, 0, len(n.Content))
+		for _, each := range n.Content {
+			v, err := yamlNodeToAny(each)
+			if err != nil {
+				return nil, err
+			}
+			ret = append(ret, v)
+		}
+		return ret, nil
+	case yaml.MappingNode:
+		explicit := map[string]any{}
+		merged := map[string]any{}
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			k, v := n.Content[i], n.Content[i+1]
+			if k.Kind != yaml.ScalarNode {
+				return nil, fmt.Errorf("line %d: unsupported YAML key", k.Line)
+			}
+			value, err := yamlNodeToAny(v)
+			if err != nil {
+				return nil, err
+			}
+			if k.ShortTag() != "!!merge" {
+				explicit[k.Value] = value
+				continue
+			}
+			// Explicit keys take precedence over merged ones, and earlier merged mappings over later ones.
+			sources, ok := value.([]any)
+			if !ok {
+				sources = []any{value}
+			}
+			for _, each := range sources {
+				m, ok := each.(map[string]any)
+				if !ok {
+					return nil, fmt.Errorf("line %d: merged value must be a mapping", v.Line)
+				}
+				for mk, mv := range m {
+					if _, ok := merged[mk]; !ok {
+						merged[mk] = mv
+					}
+				}
+			}
+		}
+		maps.Copy(merged, explicit)
+		return merged, nil
+	default:
+		var ret any
+		if err := n.Decode(&ret); err != nil {
+			return nil, err
+		}
+		if tag := n.ShortTag(); tag == "!!int" || tag == "!!float" {
+			if s := strings.TrimPrefix(n.Value, "+"); jsonNumberPattern.MatchString(s) {
+				return json.Number(s), nil
+			}
+		}
+		return NormalizeNumbers(ret), nil
+	}
 }
 
 func readTOML(path string) (map[string]any, *JqModule, error) {
@@ -113,34 +251,60 @@ func readTOML(path string) (map[string]any, *JqModule, error) {
 	return m, nil, nil
 }
 
+func parseTOML(data []byte) (map[string]any, *JqModule, error) {
+	var m map[string]any
+	if _, err := toml.Decode(string(data), &m); err != nil {
+		return nil, nil, err
+	}
+	return m, nil, nil
+}
+
 func readJSON5(path string) (map[string]any, *JqModule, error) {
 	b, err := os.ReadFile(path)
 	if err != nil {
 		return nil, nil, err
 	}
+	return parseJSON5(b)
+}
 
-	var m map[string]any
-	if err := json5.Unmarshal(b, &m); err != nil {
+func parseJSON5(b []byte) (map[string]any, *JqModule, error) {
+	var v any
+	dec := json5.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	if err := dec.Decode(&v); err != nil {
 		return nil, nil, err
 	}
-	return m, nil, nil
+	return wrapDocument(v), nil, nil
 }
 
 // readHOCON reads a HOCON file and returns it as a JSON-compatible map.
-// Top-level must be an object.
+// A top-level array is held at ValueDirective. See wrapDocument.
 func readHOCON(path string) (map[string]any, *JqModule, error) {
 	conf, err := hocon.ParseResource(path)
 	if err != nil {
 		return nil, nil, err
 	}
+	return hoconConfigToMap(conf)
+}
 
-	root := conf.GetRoot() // Value
-	obj, ok := root.(hocon.Object)
-	if !ok {
-		return nil, nil, fmt.Errorf("HOCON top-level must be an object")
+// parseHOCON parses HOCON text. Since it is not read from a file, "include" is resolved against the working directory.
+func parseHOCON(data []byte) (map[string]any, *JqModule, error) {
+	conf, err := hocon.ParseString(string(data))
+	if err != nil {
+		return nil, nil, err
 	}
+	return hoconConfigToMap(conf)
+}
 
-	return objectToMap(obj), nil, nil
+func hoconConfigToMap(conf *hocon.Config) (map[string]any, *JqModule, error) {
+	switch root := conf.GetRoot().(type) {
+	case hocon.Object:
+		return objectToMap(root), nil, nil
+	case hocon.Array:
+		return wrapDocument(arrayToSlice(root)), nil, nil
+	default:
+		return nil, nil, fmt.Errorf("HOCON top-level must be an object or an array")
+	}
 }
 
 func objectToMap(o hocon.Object) map[string]any {
@@ -188,31 +352,210 @@ func mergeObjects(parent, child map[string]any) map[string]any {
 	return MergeObjects(parent, child, MergePolicyDefault)
 }
 
+// MergeObjects merges b into a, applying policy to every node.
+// Conflicts are resolved in favor of b even under MergePolicyErrorOnConflict. Use MergeObjectsWithRules to detect them.
 func MergeObjects(a, b map[string]interface{}, policy MergePolicy) map[string]interface{} {
+	ret, _ := mergeObjectsAt([]any{}, a, b, MergeRules{pathKey([]any{}): {Policy: policy}}, false)
+	return ret
+}
+
+// MergeObjectsWithRules merges b into a, with b's values taking precedence unless a rule says otherwise.
+// The rule for a node is the one given for its path, or the nearest ancestor's, if any. See MergeRule.
+// An object in b whose ReplaceDirective is true replaces the one in a, and UnsetMarker in b always overrides a; both
+// are left in the result, so that they take effect in subsequent merges.
+// An error is returned if a conflict is found under MergePolicyErrorOnConflict.
+func MergeObjectsWithRules(a, b map[string]any, rules MergeRules) (map[string]any, error) {
+	return mergeObjectsAt([]any{}, a, b, rules, true)
+}
+
+func mergeObjectsAt(p []any, a, b map[string]any, rules MergeRules, failOnConflict bool) (map[string]any, error) {
 	result := make(map[string]interface{})
 	for k, v := range a {
 		result[k] = v
 	}
-	for k, v := range b {
-		if av, ok := result[k].(map[string]interface{}); ok {
-			if bv, ok := v.(map[string]interface{}); ok {
-				result[k] = MergeObjects(av, bv, policy)
-				continue
+	for _, k := range slices.Sorted(maps.Keys(b)) {
+		v := b[k]
+		av, ok := result[k]
+		if !ok {
+			result[k] = v
+			continue
+		}
+		merged, err := mergeValuesAt(append(append([]any{}, p...), k), av, v, rules, failOnConflict)
+		if err != nil {
+			return nil, err
+		}
+		result[k] = merged
+	}
+	return result, nil
+}
+
+func mergeValuesAt(p []any, a, b any, rules MergeRules, failOnConflict bool) (any, error) {
+	if am, ok := a.(map[string]any); ok {
+		if bm, ok := b.(map[string]any); ok {
+			if bm[ReplaceDirective] == true {
+				return bm, nil
 			}
+			return mergeObjectsAt(p, am, bm, rules, failOnConflict)
 		}
-		result[k] = v
 	}
-	return result
+	if b == UnsetMarker {
+		return b, nil
+	}
+	rule := rules.ruleAt(p)
+	if aa, ok := a.([]any); ok {
+		if ba, ok := b.([]any); ok {
+			switch rule.Policy {
+			case MergePolicyAppend:
+				return append(append([]any{}, aa...), ba...), nil
+			case MergePolicyPrepend:
+				return append(append([]any{}, ba...), aa...), nil
+			case MergePolicyUnion:
+				return DistinctBy(append(append([]any{}, aa...), ba...), func(v any) string {
+					// fmt prints map keys sorted, and tells numbers from strings.
+					return fmt.Sprintf("%#v", canonicalNumbers(v))
+				}), nil
+			case MergePolicyMergeByKey:
+				return mergeArraysByKey(p, aa, ba, rule.Key, rules, failOnConflict)
+			}
+		}
+	}
+	if failOnConflict && rule.Policy == MergePolicyErrorOnConflict && !equalValues(a, b) {
+		pe, _ := PathArrayToPathExpression(p)
+		return nil, fmt.Errorf("conflicting values at %s: %v and %v", pe, a, b)
+	}
+	return b, nil
+}
+
+// mergeArraysByKey merges elements of b into the elements of a that have the same value at key.
+// Elements of b that match nothing in a are appended.
+func mergeArraysByKey(p []any, a, b []any, key string, rules MergeRules, failOnConflict bool) ([]any, error) {
+	ret := append([]any{}, a...)
+	for _, each := range b {
+		bm, ok := each.(map[string]any)
+		if !ok || bm[key] == nil {
+			ret = append(ret, each)
+			continue
+		}
+		i := slices.IndexFunc(ret, func(v any) bool {
+			am, ok := v.(map[string]any)
+			return ok && equalValues(am[key], bm[key])
+		})
+		if i < 0 {
+			ret = append(ret, each)
+			continue
+		}
+		merged, err := mergeObjectsAt(append(append([]any{}, p...), i), ret[i].(map[string]any), bm, rules, failOnConflict)
+		if err != nil {
+			return nil, err
+		}
+		ret[i] = merged
+	}
+	return ret, nil
 }
 
 // MergePolicy defines the policy for merging objects.
 type MergePolicy int
 
 const (
+	// MergePolicyDefault merges objects recursively, and lets the overriding side win for anything else.
 	MergePolicyDefault MergePolicy = iota
-	// Add more policies as needed
+	// MergePolicyAppend concatenates arrays, putting the overriding side's elements last.
+	MergePolicyAppend
+	// MergePolicyPrepend concatenates arrays, putting the overriding side's elements first.
+	MergePolicyPrepend
+	// MergePolicyUnion concatenates arrays like MergePolicyAppend, dropping duplicated elements.
+	MergePolicyUnion
+	// MergePolicyMergeByKey merges array elements that are objects having the same value at MergeRule.Key.
+	MergePolicyMergeByKey
+	// MergePolicyErrorOnConflict makes it an error for both sides to have different values at the same path, unless
+	// both are objects.
+	MergePolicyErrorOnConflict
 )
 
+func (m MergePolicy) String() string {
+	switch m {
+	case MergePolicyDefault:
+		return "default"
+	case MergePolicyAppend:
+		return "append"
+	case MergePolicyPrepend:
+		return "prepend"
+	case MergePolicyUnion:
+		return "union"
+	case MergePolicyMergeByKey:
+		return "mergeByKey"
+	case MergePolicyErrorOnConflict:
+		return "errorOnConflict"
+	default:
+		return "unknown"
+	}
+}
+
+// MergeRule is a merge policy given to a node, along with its parameter.
+type MergeRule struct {
+	Policy MergePolicy
+	// Key is the field by which array elements are matched under MergePolicyMergeByKey.
+	Key string
+}
+
+// ParseMergeRule parses a value in a "$merge" directive, i.e., one of "default", "append", "prepend", "union",
+// "mergeByKey:FIELD", and "errorOnConflict".
+func ParseMergeRule(s string) (MergeRule, error) {
+	name, key, hasKey := strings.Cut(s, ":")
+	for _, each := range []MergePolicy{MergePolicyDefault, MergePolicyAppend, MergePolicyPrepend, MergePolicyUnion, MergePolicyMergeByKey, MergePolicyErrorOnConflict} {
+		if each.String() != name {
+			continue
+		}
+		if (each == MergePolicyMergeByKey) != (hasKey && key != "") {
+			break
+		}
+		return MergeRule{Policy: each, Key: key}, nil
+	}
+	return MergeRule{}, fmt.Errorf("unknown merge policy: %q (expected one of default, append, prepend, union, mergeByKey:FIELD, errorOnConflict)", s)
+}
+
+// MergeRules maps paths, keyed by pathKey, to the rules given to them.
+type MergeRules map[string]MergeRule
+
+// ParseMergeDirective parses the value of a "$merge" directive, an object whose keys are paths relative to the node
+// having the directive and whose values are merge policies (see ParseMergeRule).
+// A key is either a path expression (e.g. ".a.b", or "." for the node itself) or a plain key in the node.
+func ParseMergeDirective(v any) (MergeRules, error) {
+	m, ok := v.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("$merge must be an object: %v", v)
+	}
+	ret := MergeRules{}
+	for k, each := range m {
+		s, ok := each.(string)
+		if !ok {
+			return nil, fmt.Errorf("$merge value for %q must be a string: %v", k, each)
+		}
+		rule, err := ParseMergeRule(s)
+		if err != nil {
+			return nil, err
+		}
+		p := []any{k}
+		if strings.HasPrefix(k, ".") {
+			if p, err = PathExpressionToPathArray(k); err != nil {
+				return nil, fmt.Errorf("invalid path in $merge: %q: %w", k, err)
+			}
+		}
+		ret[pathKey(p)] = rule
+	}
+	return ret, nil
+}
+
+// ruleAt returns the rule for path p, i.e., the one given to p or its nearest ancestor.
+func (r MergeRules) ruleAt(p []any) MergeRule {
+	for i := len(p); i >= 0; i-- {
+		if ret, ok := r[pathKey(p[:i])]; ok {
+			return ret
+		}
+	}
+	return MergeRule{Policy: MergePolicyDefault}
+}
+
 // PathArrayToPathExpression converts a "path array" to a "path expression" string.
 func PathArrayToPathExpression(pathArray []any) (string, error) {
 	var result string
@@ -239,6 +582,55 @@ func PathArrayToPathExpression(pathArray []any) (string, error) {
 	return result, nil
 }
 
+// PathExpressionToPathArray converts a "path expression" string (e.g. `.a.b[0]`) to a "path array" (e.g. ["a","b",0]).
+func PathExpressionToPathArray(pathExpression string) ([]any, error) {
+	query, err := gojq.Parse("path(" + pathExpression + ")")
+	if err != nil {
+		return nil, fmt.Errorf("invalid path expression: %q <%w>", pathExpression, err)
+	}
+	iter := query.Run(nil)
+	v, ok := iter.Next()
+	if !ok {
+		return nil, fmt.Errorf("invalid path expression: %q", pathExpression)
+	}
+	if err, isErr := v.(error); isErr {
+		return nil, fmt.Errorf("invalid path expression: %q <%w>", pathExpression, err)
+	}
+	ret, ok := v.([]any)
+	if !ok {
+		return nil, fmt.Errorf("invalid path expression: %q", pathExpression)
+	}
+	return ret, nil
+}
+
+// jsonPointerToPathArray converts a JSON Pointer (RFC 6901), e.g. "/a/0", into a path array in v.
+// A reference token becomes an array index if it refers to an element of an array in v, and a key otherwise.
+// Whether the path exists in v is not checked.
+func jsonPointerToPathArray(v any, pointer string) ([]any, error) {
+	if pointer == "" {
+		return []any{}, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("invalid JSON pointer: %q", pointer)
+	}
+	ret := []any{}
+	for _, token := range strings.Split(pointer[1:], "/") {
+		token = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+		if a, ok := v.([]any); ok {
+			// Indices have no leading zeros.
+			if i, err := strconv.Atoi(token); err == nil && i >= 0 && i < len(a) && strconv.Itoa(i) == token {
+				ret = append(ret, i)
+				v = a[i]
+				continue
+			}
+		}
+		ret = append(ret, token)
+		m, _ := v.(map[string]any)
+		v = m[token]
+	}
+	return ret, nil
+}
+
 // Helper to check if a string is alphanumeric
 func isAlphanumeric(s string) bool {
 	for _, r := range s {
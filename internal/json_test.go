@@ -1,9 +1,11 @@
 package internal
 
 import (
+	"encoding/json"
 	"github.com/dakusui/jqplusplus/internal/testutil"
 	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -17,7 +19,7 @@ b: 2
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
-	expected := map[string]interface{}{"a": int(1), "b": int(2)}
+	expected := map[string]interface{}{"a": json.Number("1"), "b": json.Number("2")}
 	if !reflect.DeepEqual(result.Obj, expected) {
 		t.Errorf("expected %v, got %v", expected, result)
 	}
@@ -33,7 +35,7 @@ func TestLoadAndResolveInheritancesWithToml_NoExtends(t *testing.T) {
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
-	expected := map[string]interface{}{"a": int64(1), "b": int64(2)}
+	expected := map[string]interface{}{"a": json.Number("1"), "b": json.Number("2")}
 	if !reflect.DeepEqual(result.Obj, expected) {
 		t.Errorf("expected %v, got %v", expected, result)
 	}
@@ -50,7 +52,7 @@ func TestLoadAndResolveInheritancesWithJSON5_NoExtends(t *testing.T) {
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
-	expected := map[string]interface{}{"a": float64(1), "b": float64(2)}
+	expected := map[string]interface{}{"a": json.Number("1"), "b": json.Number("2")}
 	if !reflect.DeepEqual(result.Obj, expected) {
 		t.Errorf("expected %v, got %v", expected, result)
 	}
@@ -66,7 +68,7 @@ b = 2
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
-	expected := map[string]interface{}{"a": int(1), "b": int(2)}
+	expected := map[string]interface{}{"a": json.Number("1"), "b": json.Number("2")}
 	if !reflect.DeepEqual(result.Obj, expected) {
 		t.Errorf("expected %v, got %v", expected, result)
 	}
@@ -161,3 +163,175 @@ func TestMergeObjects(t *testing.T) {
 		}
 	})
 }
+
+func TestMergeObjectsWithRules(t *testing.T) {
+	t.Run("array policies", func(t *testing.T) {
+		a := map[string]any{"ap": []any{1, 2}, "pre": []any{1, 2}, "un": []any{1, 2}, "rep": []any{1, 2}}
+		b := map[string]any{"ap": []any{2, 3}, "pre": []any{2, 3}, "un": []any{2, 3}, "rep": []any{2, 3}}
+		rules := MergeRules{
+			pathKey([]any{"ap"}):  {Policy: MergePolicyAppend},
+			pathKey([]any{"pre"}): {Policy: MergePolicyPrepend},
+			pathKey([]any{"un"}):  {Policy: MergePolicyUnion},
+		}
+		expected := map[string]any{"ap": []any{1, 2, 2, 3}, "pre": []any{2, 3, 1, 2}, "un": []any{1, 2, 3}, "rep": []any{2, 3}}
+		result, err := MergeObjectsWithRules(a, b, rules)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !reflect.DeepEqual(result, expected) {
+			t.Errorf("expected %v, got %v", expected, result)
+		}
+	})
+
+	t.Run("merge by key", func(t *testing.T) {
+		a := map[string]any{"servers": []any{
+			map[string]any{"name": "web", "port": 80, "tls": false},
+			map[string]any{"name": "db", "port": 5432},
+		}}
+		b := map[string]any{"servers": []any{
+			map[string]any{"name": "web", "port": 443},
+			map[string]any{"name": "cache", "port": 6379},
+		}}
+		rule, err := ParseMergeRule("mergeByKey:name")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		expected := map[string]any{"servers": []any{
+			map[string]any{"name": "web", "port": 443, "tls": false},
+			map[string]any{"name": "db", "port": 5432},
+			map[string]any{"name": "cache", "port": 6379},
+		}}
+		result, err := MergeObjectsWithRules(a, b, MergeRules{pathKey([]any{"servers"}): rule})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !reflect.DeepEqual(result, expected) {
+			t.Errorf("expected %v, got %v", expected, result)
+		}
+	})
+
+	t.Run("error on conflict", func(t *testing.T) {
+		a := map[string]any{"x": map[string]any{"y": 1, "z": 2}}
+		b := map[string]any{"x": map[string]any{"y": 1, "z": 3}}
+		_, err := MergeObjectsWithRules(a, b, MergeRules{pathKey([]any{}): {Policy: MergePolicyErrorOnConflict}})
+		if err == nil || !strings.Contains(err.Error(), "conflicting values at .x.z") {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
+
+func TestParseMergeRule_Invalid(t *testing.T) {
+	for _, s := range []string{"mergeByKey", "mergeByKey:", "append:name", "sideways"} {
+		if _, err := ParseMergeRule(s); err == nil {
+			t.Errorf("expected an error for %q", s)
+		}
+	}
+}
+
+func TestLoadAndResolveInheritancesWithHCL_NoExtends(t *testing.T) {
+	dir := t.TempDir()
+	file := testutil.WriteTempJSON(t, dir, "base.hcl", `
+a = 1
+b = 2
+`)
+	result, err := LoadAndResolveInheritances(filepath.Dir(file), filepath.Base(file), []string{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := map[string]interface{}{"a": json.Number("1"), "b": json.Number("2")}
+	if !reflect.DeepEqual(result.Obj, expected) {
+		t.Errorf("expected %v, got %v", expected, result)
+	}
+}
+
+func TestLoadAndResolveInheritancesWithHCL_BlocksAndExpressions(t *testing.T) {
+	dir := t.TempDir()
+	file := testutil.WriteTempJSON(t, dir, "vars.hcl", `
+region = "ap-northeast-1"
+ratio  = 0.5
+tags   = { env = "prod", owner = var.owner }
+zones  = ["a", upper("b")]
+greeting = "hello ${var.name}"
+
+variable "instance_type" {
+  default = "t3.micro"
+}
+
+variable "count" {
+  default = 2
+}
+
+provisioner {
+  command = "echo 1"
+}
+
+provisioner {
+  command = "echo 2"
+}
+`)
+	result, err := LoadAndResolveInheritances(filepath.Dir(file), filepath.Base(file), []string{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := map[string]any{
+		"region":   "ap-northeast-1",
+		"ratio":    json.Number("0.5"),
+		"tags":     map[string]any{"env": "prod", "owner": "${var.owner}"},
+		"zones":    []any{"a", `${upper("b")}`},
+		"greeting": "hello ${var.name}",
+		"variable": map[string]any{
+			"instance_type": map[string]any{"default": "t3.micro"},
+			"count":         map[string]any{"default": json.Number("2")},
+		},
+		"provisioner": []any{
+			map[string]any{"command": "echo 1"},
+			map[string]any{"command": "echo 2"},
+		},
+	}
+	if !reflect.DeepEqual(result.Obj, expected) {
+		t.Errorf("expected %v, got %v", expected, result.Obj)
+	}
+}
+
+func TestLoadAndResolveInheritancesWithHCL_Extends(t *testing.T) {
+	dir := t.TempDir()
+	_ = testutil.WriteTempJSON(t, dir, "base.hcl", `
+variable "region" {
+  default = "us-east-1"
+}
+`)
+	child := testutil.WriteTempJSON(t, dir, "child.json", `{"$extends": ["base.hcl"], "variable": {"region": {"description": "d"}}}`)
+	result, err := LoadAndResolveInheritances(filepath.Dir(child), filepath.Base(child), []string{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := map[string]any{"variable": map[string]any{"region": map[string]any{"default": "us-east-1", "description": "d"}}}
+	if !reflect.DeepEqual(result.Obj, expected) {
+		t.Errorf("expected %v, got %v", expected, result.Obj)
+	}
+}
+
+func TestSniffFileType(t *testing.T) {
+	for _, each := range []struct {
+		data     string
+		expected FileType
+	}{
+		{`{"a": 1}`, JSON},
+		{"{a: 1, // comment\n}", JSON5},
+		{"a: 1\nb: [1]\n", YAML},
+		{"a = 1\n[s]\nb = 2\n", TOML},
+		{"a { b = 1 }\n", HOCON},
+		{`[1, "x"]`, JSON},
+		{`42`, JSON},
+		{"[1, 'x',]", JSON5},
+		{"- 1\n- x\n", YAML},
+	} {
+		ft, ok := SniffFileType([]byte(each.data))
+		if !ok || ft != each.expected {
+			t.Errorf("%q: expected %s, got %s (%v)", each.data, each.expected, ft, ok)
+		}
+	}
+	if _, ok := SniffFileType([]byte("x")); ok {
+		t.Errorf("expected no file type for a scalar")
+	}
+}
@@ -0,0 +1,682 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"reflect"
+	"slices"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/titanous/json5"
+	"gopkg.in/yaml.v3"
+)
+
+// KeyOrderPolicy tells how the keys of a node are ordered relative to the ones it inherits.
+type KeyOrderPolicy int
+
+const (
+	// KeyOrderInheritedFirst places the keys a node inherits first, followed by the ones the node adds.
+	KeyOrderInheritedFirst KeyOrderPolicy = iota
+	// KeyOrderChildFirst places the keys of a node first, followed by the ones it only inherits.
+	KeyOrderChildFirst
+	// KeyOrderSorted sorts keys, regardless of the order they are written in.
+	KeyOrderSorted
+)
+
+func (p KeyOrderPolicy) String() string {
+	switch p {
+	case KeyOrderInheritedFirst:
+		return "inherited-first"
+	case KeyOrderChildFirst:
+		return "child-first"
+	case KeyOrderSorted:
+		return "sorted"
+	default:
+		return fmt.Sprintf("KeyOrderPolicy(%d)", int(p))
+	}
+}
+
+// ParseKeyOrderPolicy converts a command-line value (`inherited-first`, `child-first`, or `sorted`) into a
+// KeyOrderPolicy.
+func ParseKeyOrderPolicy(s string) (KeyOrderPolicy, error) {
+	switch s {
+	case "inherited-first":
+		return KeyOrderInheritedFirst, nil
+	case "child-first":
+		return KeyOrderChildFirst, nil
+	case "sorted":
+		return KeyOrderSorted, nil
+	default:
+		return 0, fmt.Errorf("unknown key order: %q (expected inherited-first, child-first, or sorted)", s)
+	}
+}
+
+// KeyOrder records the order of the keys of the objects in a value, so that they are rendered in the order they are
+// written in the files the value comes from, rather than sorted.
+// Objects are identified by their paths, keyed by pathKey, so that each element of an array has its own order.
+// Keys that are not recorded, e.g., the ones made by templating, are placed after the recorded ones, sorted.
+//
+// A KeyOrder is never modified once created, so that it can be shared among NodeEntryValues in a NodePool cache, as
+// Provenance is.
+// A nil *KeyOrder means keys are sorted.
+type KeyOrder struct {
+	keys map[string][]string
+}
+
+// newKeyOrder creates a KeyOrder of obj from the keys recorded by a loader, keyed by pathKey, which may be nil. Objects whose keys are not recorded have them sorted.
+func newKeyOrder(obj map[string]any, recorded map[string][]string) *KeyOrder {
+	ret := &KeyOrder{keys: map[string][]string{}}
+	var walk func(p []any, v any)
+	walk = func(p []any, v any) {
+		switch x := v.(type) {
+		case map[string]any:
+			k := pathKey(p)
+			ret.keys[k] = appendKeys(slices.Clone(recorded[k]), slices.Sorted(maps.Keys(x))...)
+			for key, each := range x {
+				walk(append(slices.Clone(p), key), each)
+			}
+		case []any:
+			for i, each := range x {
+				walk(append(slices.Clone(p), i), each)
+			}
+		}
+	}
+	walk([]any{}, obj)
+	return ret
+}
+
+// Keys returns the keys of obj, the object at path, in order.
+func (o *KeyOrder) Keys(path []any, obj map[string]any) []string {
+	var ret []string
+	if o != nil {
+		ret = Filter(o.keys[pathKey(path)], func(k string) bool {
+			_, ok := obj[k]
+			return ok
+		})
+	}
+	return appendKeys(ret, slices.Sorted(maps.Keys(obj))...)
+}
+
+// Ordered returns v with its objects replaced with values whose keys are in order, which the JSON encoder and the
+// encoders of OutputFormat respect. If o is nil, v is returned as it is.
+func (o *KeyOrder) Ordered(v any) any {
+	if o == nil {
+		return v
+	}
+	return o.ordered([]any{}, v)
+}
+
+func (o *KeyOrder) ordered(p []any, v any) any {
+	switch x := v.(type) {
+	case map[string]any:
+		ret := make(orderedObject, 0, len(x))
+		for _, k := range o.Keys(p, x) {
+			ret = append(ret, orderedEntry{key: k, value: o.ordered(append(slices.Clone(p), k), x[k])})
+		}
+		return ret
+	case []any:
+		ret := make([]any, len(x))
+		for i, each := range x {
+			ret[i] = o.ordered(append(slices.Clone(p), i), each)
+		}
+		return ret
+	default:
+		return v
+	}
+}
+
+// mergeKeyOrders returns the key order of merged, the object MergeObjectsWithRules(a, b, rules) returns, where aOrder
+// and bOrder are the key orders of a and b. The keys of a are placed before the ones only b has if aFirst, and after
+// them otherwise.
+// See walkMerged for how the objects in merged are matched with the ones of a and b.
+func mergeKeyOrders(merged, a map[string]any, aOrder *KeyOrder, b map[string]any, bOrder *KeyOrder, rules MergeRules, aFirst bool) *KeyOrder {
+	if aOrder == nil && bOrder == nil {
+		return nil
+	}
+	ret := &KeyOrder{keys: map[string][]string{}}
+	walkMerged(merged, a, b, rules, func(p []any, v any, ap, bp []any) {
+		if _, ok := v.(map[string]any); !ok {
+			return
+		}
+		var aKeys, bKeys []string
+		if ap != nil {
+			aKeys = aOrder.recorded(ap)
+		}
+		if bp != nil {
+			bKeys = bOrder.recorded(bp)
+		}
+		if aFirst {
+			ret.keys[pathKey(p)] = appendKeys(slices.Clone(aKeys), bKeys...)
+		} else {
+			ret.keys[pathKey(p)] = appendKeys(slices.Clone(bKeys), aKeys...)
+		}
+	})
+	return ret
+}
+
+// walkMerged calls visit for every value v in merged, the object MergeObjectsWithRules(a, b, rules) returns, with the
+// paths ap and bp of the values of a and b that v comes from. ap or bp is nil if v does not come from that side.
+//
+// The values in merged are matched with the ones of a and b at the same paths, except for the elements of arrays, which
+// follow the elements they come from, e.g., the elements of b in an array made by MergePolicyAppend are shifted by the
+// length of the array of a. Values MergeObjectsWithRules takes as they are, e.g., an array of b overriding the one of a,
+// are told by identity, and come from the side they are taken from only.
+func walkMerged(merged, a, b map[string]any, rules MergeRules, visit func(p []any, v any, ap, bp []any)) {
+	var walk func(p []any, v any, ap []any, av any, bp []any, bv any)
+	walk = func(p []any, v any, ap []any, av any, bp []any, bv any) {
+		if isSameValue(v, bv) {
+			ap, av = nil, nil
+		} else if isSameValue(v, av) {
+			bp, bv = nil, nil
+		}
+		visit(p, v, ap, bp)
+		switch x := v.(type) {
+		case map[string]any:
+			am, _ := av.(map[string]any)
+			bm, _ := bv.(map[string]any)
+			for k, each := range x {
+				walk(append(slices.Clone(p), k), each, childPath(ap, am != nil, k), am[k], childPath(bp, bm != nil, k), bm[k])
+			}
+		case []any:
+			aa, _ := av.([]any)
+			ba, _ := bv.([]any)
+			rule := rules.ruleAt(p)
+			for i, each := range x {
+				ai, bi := arrayElementSources(each, i, aa, ba, rule)
+				var ae, be any
+				if ai >= 0 {
+					ae = aa[ai]
+				}
+				if bi >= 0 {
+					be = ba[bi]
+				}
+				walk(append(slices.Clone(p), i), each, childPath(ap, ai >= 0, ai), ae, childPath(bp, bi >= 0, bi), be)
+			}
+		}
+	}
+	walk([]any{}, merged, []any{}, a, []any{}, b)
+}
+
+// childPath returns the path to the child of the value at p having key k, or nil if p is nil or ok is false.
+func childPath(p []any, ok bool, k any) []any {
+	if p == nil || !ok {
+		return nil
+	}
+	return append(slices.Clone(p), k)
+}
+
+// arrayElementSources returns the indices of the elements of a and b that v, the i-th element of an array made by
+// merging a and b under rule, comes from, or -1 for a side it does not come from.
+func arrayElementSources(v any, i int, a, b []any, rule MergeRule) (int, int) {
+	if a == nil || b == nil {
+		// The array is taken as it is from one side.
+		if a != nil && i < len(a) {
+			return i, -1
+		}
+		if b != nil && i < len(b) {
+			return -1, i
+		}
+		return -1, -1
+	}
+	isSame := func(e any) bool { return isSameValue(v, e) }
+	isEqual := func(e any) bool { return equalValues(v, e) }
+	switch rule.Policy {
+	case MergePolicyAppend:
+		if i < len(a) {
+			return i, -1
+		}
+		return -1, i - len(a)
+	case MergePolicyPrepend:
+		if i < len(b) {
+			return -1, i
+		}
+		return i - len(b), -1
+	case MergePolicyUnion:
+		// The first of the equal elements is kept, looking at the ones of a first.
+		if j := slices.IndexFunc(a, isEqual); j >= 0 {
+			return j, -1
+		}
+		return -1, slices.IndexFunc(b, isEqual)
+	case MergePolicyMergeByKey:
+		m, ok := v.(map[string]any)
+		if i < len(a) {
+			if !ok || isSameValue(v, a[i]) {
+				return i, -1
+			}
+			// An element merged by key stays where the one of a is, and is merged with the first element of b having
+			// the same key.
+			return i, slices.IndexFunc(b, func(e any) bool {
+				em, ok := e.(map[string]any)
+				return ok && em[rule.Key] != nil && equalValues(em[rule.Key], m[rule.Key])
+			})
+		}
+		if j := slices.IndexFunc(b, isSame); j >= 0 {
+			return -1, j
+		}
+		return -1, slices.IndexFunc(b, isEqual)
+	}
+	if j := slices.IndexFunc(b, isSame); j >= 0 {
+		return -1, j
+	}
+	if j := slices.IndexFunc(a, isSame); j >= 0 {
+		return j, -1
+	}
+	return -1, -1
+}
+
+// isSameValue tells if a and b are the same object or the same array, rather than equal ones.
+func isSameValue(a, b any) bool {
+	switch x := a.(type) {
+	case map[string]any:
+		y, ok := b.(map[string]any)
+		return ok && x != nil && reflect.ValueOf(x).UnsafePointer() == reflect.ValueOf(y).UnsafePointer()
+	case []any:
+		y, ok := b.([]any)
+		return ok && len(x) > 0 && len(x) == len(y) && &x[0] == &y[0]
+	default:
+		return false
+	}
+}
+
+// recorded returns the keys recorded for the object at p, in order.
+func (o *KeyOrder) recorded(p []any) []string {
+	if o == nil {
+		return nil
+	}
+	return o.keys[pathKey(p)]
+}
+
+// Subtree returns the key order of the node at prefix, with paths relative to it.
+func (o *KeyOrder) Subtree(prefix []any) *KeyOrder {
+	if o == nil {
+		return nil
+	}
+	k := pathKey(prefix)
+	ret := &KeyOrder{keys: map[string][]string{}}
+	for each, keys := range o.keys {
+		if rest, ok := strings.CutPrefix(each, k); ok {
+			ret.keys[rest] = keys
+		}
+	}
+	return ret
+}
+
+// graft returns a key order in which the orders at and under prefix are taken from sub, whose paths are relative to
+// prefix. Keys sub does not have follow the ones it has.
+func (o *KeyOrder) graft(prefix []any, sub *KeyOrder) *KeyOrder {
+	if o == nil || sub == nil {
+		return o
+	}
+	k := pathKey(prefix)
+	ret := &KeyOrder{keys: maps.Clone(o.keys)}
+	for each, keys := range sub.keys {
+		ret.keys[k+each] = appendKeys(slices.Clone(keys), o.keys[k+each]...)
+	}
+	return ret
+}
+
+// renameKey returns the key order after the key at path is replaced with keys, each of which holds a copy of its
+// value, as ProcessKeySide does. The new keys take the place of the old one.
+func (o *KeyOrder) renameKey(path []any, keys []string) *KeyOrder {
+	if o == nil {
+		return nil
+	}
+	parent := DropLast(path)
+	from := pathKey(path)
+	ret := &KeyOrder{keys: maps.Clone(o.keys)}
+	var renamed []string
+	for _, each := range o.keys[pathKey(parent)] {
+		if each == path[len(path)-1] {
+			renamed = appendKeys(renamed, keys...)
+		} else {
+			renamed = appendKeys(renamed, each)
+		}
+	}
+	ret.keys[pathKey(parent)] = renamed
+	for each, order := range o.keys {
+		rest, ok := strings.CutPrefix(each, from)
+		if !ok {
+			continue
+		}
+		for _, k := range keys {
+			to := pathKey(append(slices.Clone(parent), k)) + rest
+			ret.keys[to] = appendKeys(slices.Clone(ret.keys[to]), order...)
+		}
+	}
+	return ret
+}
+
+// appendKeys appends the keys that are not in list yet.
+func appendKeys(list []string, keys ...string) []string {
+	for _, each := range keys {
+		if !slices.Contains(list, each) {
+			list = append(list, each)
+		}
+	}
+	return list
+}
+
+// orderedObject is an object whose entries are in order. It is made by KeyOrder.Ordered.
+type orderedObject []orderedEntry
+
+type orderedEntry struct {
+	key   string
+	value any
+}
+
+func (o orderedObject) MarshalJSON() ([]byte, error) {
+	var b bytes.Buffer
+	b.WriteByte('{')
+	for i, e := range o {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		k, err := json.Marshal(e.key)
+		if err != nil {
+			return nil, err
+		}
+		v, err := json.Marshal(e.value)
+		if err != nil {
+			return nil, err
+		}
+		b.Write(k)
+		b.WriteByte(':')
+		b.Write(v)
+	}
+	b.WriteByte('}')
+	return b.Bytes(), nil
+}
+
+// objectEntries returns the entries of v if it is an object, i.e., an orderedObject as it is, or a map with its keys
+// sorted.
+func objectEntries(v any) (orderedObject, bool) {
+	switch x := v.(type) {
+	case orderedObject:
+		return x, true
+	case map[string]any:
+		return (*KeyOrder)(nil).ordered([]any{}, x).(orderedObject), true
+	default:
+		return nil, false
+	}
+}
+
+// loadKeyOrder returns the keys of the objects in a file in fsys in the order they are written, keyed by pathKey.
+// The format is told from the extension, or from the content if the extension tells none, e.g., for stdin.
+// nil is returned for HOCON files, whose parser does not keep the order, and for files that cannot be read.
+func loadKeyOrder(fsys FileSystem, path string) map[string][]string {
+	data, err := fsys.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	ft, ok := detectFileType(path)
+	if !ok {
+		if ft, ok = SniffFileType(data); !ok {
+			return nil
+		}
+	}
+	switch ft {
+	case JSON:
+		return jsonKeyOrder(data)
+	case YAML:
+		return yamlKeyOrder(data)
+	case TOML:
+		return tomlKeyOrder(data)
+	case JSON5:
+		return json5KeyOrder(data)
+	case HCL:
+		return hclKeyOrder(data, path)
+	default:
+		return nil
+	}
+}
+
+func jsonKeyOrder(data []byte) map[string][]string {
+	ret := map[string][]string{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var walk func(p []any) error
+	walk = func(p []any) error {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		switch tok {
+		case json.Delim('{'):
+			k := pathKey(p)
+			for dec.More() {
+				key, err := dec.Token()
+				if err != nil {
+					return err
+				}
+				ret[k] = appendKeys(ret[k], key.(string))
+				if err := walk(append(slices.Clone(p), key)); err != nil {
+					return err
+				}
+			}
+			_, err = dec.Token()
+			return err
+		case json.Delim('['):
+			for i := 0; dec.More(); i++ {
+				if err := walk(append(slices.Clone(p), i)); err != nil {
+					return err
+				}
+			}
+			_, err = dec.Token()
+			return err
+		}
+		return nil
+	}
+	if err := walk(documentRoot(bytes.HasPrefix(bytes.TrimLeft(data, " \t\r\n"), []byte("{")))); err != nil {
+		return nil
+	}
+	return ret
+}
+
+func yamlKeyOrder(data []byte) map[string][]string {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil || len(doc.Content) == 0 {
+		return nil
+	}
+	ret := map[string][]string{}
+	var walk func(p []any, n *yaml.Node)
+	walk = func(p []any, n *yaml.Node) {
+		if n.Kind == yaml.AliasNode && n.Alias != nil {
+			n = n.Alias
+		}
+		switch n.Kind {
+		case yaml.MappingNode:
+			k := pathKey(p)
+			for i := 0; i+1 < len(n.Content); i += 2 {
+				key, value := n.Content[i], n.Content[i+1]
+				if key.ShortTag() != "!!merge" {
+					ret[k] = appendKeys(ret[k], key.Value)
+					walk(append(slices.Clone(p), key.Value), value)
+					continue
+				}
+				// The keys of merged mappings take the place of the merge key.
+				if value.Kind == yaml.SequenceNode {
+					for _, each := range value.Content {
+						walk(p, each)
+					}
+				} else {
+					walk(p, value)
+				}
+			}
+		case yaml.SequenceNode:
+			for i, each := range n.Content {
+				walk(append(slices.Clone(p), i), each)
+			}
+		}
+	}
+	walk(documentRoot(doc.Content[0].Kind == yaml.MappingNode), doc.Content[0])
+	return ret
+}
+
+func tomlKeyOrder(data []byte) map[string][]string {
+	var obj map[string]any
+	md, err := toml.Decode(string(data), &obj)
+	if err != nil {
+		return nil
+	}
+	ret := map[string][]string{}
+	// counts holds the number of elements of each array seen so far, keyed by pathKey.
+	counts := map[string]int{}
+	for _, key := range md.Keys() {
+		// Keys do not tell arrays, which the decoded object does. A key of an array of tables is given for each table,
+		// while the one of an inline array is given once, followed by the keys of all its tables.
+		var p []any
+		var cur any = obj
+		for j, each := range key {
+			m, _ := cur.(map[string]any)
+			cur = m[each]
+			if j == len(key)-1 {
+				k := pathKey(p)
+				ret[k] = appendKeys(ret[k], each)
+			}
+			p = append(p, each)
+			var a []any
+			switch x := cur.(type) {
+			case []map[string]any:
+				// Arrays of tables are decoded this way.
+				a = ToAnySlice(x)
+				if j == len(key)-1 {
+					counts[pathKey(p)]++
+				}
+			case []any:
+				a = x
+				if j == len(key)-1 {
+					counts[pathKey(p)] = 1
+				} else if j == len(key)-2 && slices.Contains(ret[pathKey(append(slices.Clone(p), counts[pathKey(p)]-1))], key[j+1]) {
+					// A key seen in the current table of an inline array starts the next one.
+					counts[pathKey(p)]++
+				}
+			default:
+				continue
+			}
+			if j == len(key)-1 {
+				break
+			}
+			i := max(counts[pathKey(p)]-1, 0)
+			p = append(p, i)
+			cur = nil
+			if i < len(a) {
+				cur = a[i]
+			}
+		}
+	}
+	return ret
+}
+
+// json5KeyOrder scans JSON5 text for the keys of objects, since the JSON5 decoder tells nothing but values.
+// data must be valid JSON5, i.e., it must have been decoded successfully.
+func json5KeyOrder(data []byte) map[string][]string {
+	type container struct {
+		path   []any
+		object bool
+		// key is the key of the entry being scanned, if object.
+		key string
+		// index is the index of the element being scanned, if not object.
+		index int
+	}
+	ret := map[string][]string{}
+	var stack []*container
+	var root []any
+	// valuePath returns the path of the value to be scanned next.
+	valuePath := func() []any {
+		if len(stack) == 0 {
+			return root
+		}
+		top := stack[len(stack)-1]
+		if top.object {
+			return append(slices.Clone(top.path), top.key)
+		}
+		return append(slices.Clone(top.path), top.index)
+	}
+	// skip returns the index of the first byte of the next token at or after i.
+	skip := func(i int) int {
+		for i < len(data) {
+			switch {
+			case strings.IndexByte(" \t\r\n\v\f", data[i]) >= 0:
+				i++
+			case bytes.HasPrefix(data[i:], []byte("//")):
+				for i < len(data) && data[i] != '\n' {
+					i++
+				}
+			case bytes.HasPrefix(data[i:], []byte("/*")):
+				end := bytes.Index(data[i+2:], []byte("*/"))
+				if end < 0 {
+					return len(data)
+				}
+				i += 2 + end + 2
+			default:
+				return i
+			}
+		}
+		return i
+	}
+	// skipString returns the index next to the end of the string starting at i.
+	skipString := func(i int) int {
+		for j := i + 1; j < len(data); j++ {
+			if data[j] == '\\' {
+				j++
+			} else if data[j] == data[i] {
+				return j + 1
+			}
+		}
+		return len(data)
+	}
+	root = documentRoot(skip(0) < len(data) && data[skip(0)] == '{')
+	expectsKey := false
+	for i := skip(0); i < len(data); i = skip(i) {
+		c := data[i]
+		if expectsKey && c != '}' {
+			top := stack[len(stack)-1]
+			var end int
+			if c == '"' || c == '\'' {
+				end = skipString(i)
+				if err := json5.Unmarshal(data[i:end], &top.key); err != nil {
+					return nil
+				}
+			} else {
+				for end = i; end < len(data) && data[end] != ':' && strings.IndexByte(" \t\r\n\v\f/", data[end]) < 0; end++ {
+				}
+				top.key = string(data[i:end])
+			}
+			k := pathKey(top.path)
+			ret[k] = appendKeys(ret[k], top.key)
+			// The colon is skipped as well.
+			i = skip(end) + 1
+			expectsKey = false
+			continue
+		}
+		switch c {
+		case '{', '[':
+			stack = append(stack, &container{path: valuePath(), object: c == '{'})
+			expectsKey = c == '{'
+			i++
+		case '}', ']':
+			if len(stack) == 0 {
+				return nil
+			}
+			stack = stack[:len(stack)-1]
+			expectsKey = false
+			i++
+		case ',':
+			if len(stack) > 0 {
+				top := stack[len(stack)-1]
+				expectsKey = top.object
+				top.index++
+			}
+			i++
+		case '"', '\'':
+			i = skipString(i)
+		default:
+			for i++; i < len(data) && strings.IndexByte(",]} \t\r\n\v\f/", data[i]) < 0; i++ {
+			}
+		}
+	}
+	return ret
+}
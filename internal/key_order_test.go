@@ -0,0 +1,199 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/dakusui/jqplusplus/internal/testutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestKeyOrder_Loaders(t *testing.T) {
+	for _, c := range []struct {
+		name    string
+		content string
+	}{
+		{"doc.json", `{"zeta": 1, "alpha": {"y": true, "b": [{"q": 1, "p": 2}]}, "mid": "x"}`},
+		{"doc.yaml", "zeta: 1\nalpha:\n  y: true\n  b:\n    - q: 1\n      p: 2\nmid: x\n"},
+		{"doc.toml", "zeta = 1\nmid = \"x\"\n[alpha]\ny = true\n[[alpha.b]]\nq = 1\np = 2\n"},
+		{"doc.json5", "{zeta: 1, // comment\n 'alpha': {y: true, b: [{q: 1, \"p\": 2}]}, mid: 'x',}"},
+		{"doc.hcl", "zeta = 1\nalpha {\n  y = true\n  b = [{ q = 1, p = 2 }]\n}\nmid = \"x\"\n"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			dir := t.TempDir()
+			file := testutil.WriteTempJSON(t, dir, c.name, c.content)
+			result, err := LoadAndResolveInheritances(filepath.Dir(file), filepath.Base(file), []string{})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			output, err := OutputJSON.EncodeWithKeyOrder(result.Obj, result.KeyOrder)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			expected := `{"zeta":1,"alpha":{"y":true,"b":[{"q":1,"p":2}]},"mid":"x"}`
+			if filepath.Ext(c.name) == ".toml" {
+				// Tables come after the keys of the table they belong to.
+				expected = `{"zeta":1,"mid":"x","alpha":{"y":true,"b":[{"q":1,"p":2}]}}`
+			}
+			if compacted := compactJSON(t, output); compacted != expected {
+				t.Errorf("expected %v, got %v", expected, compacted)
+			}
+		})
+	}
+}
+
+func TestKeyOrder_ArrayElements(t *testing.T) {
+	for _, c := range []struct {
+		name    string
+		content string
+	}{
+		{"doc.json", `{"xs": [{"b": 1, "a": 2}, {"a": 1, "b": 2}]}`},
+		{"doc.yaml", "xs:\n  - b: 1\n    a: 2\n  - a: 1\n    b: 2\n"},
+		{"doc.toml", "[[xs]]\nb = 1\na = 2\n[[xs]]\na = 1\nb = 2\n"},
+		{"inline.toml", "xs = [{b = 1, a = 2}, {a = 1, b = 2}]\n"},
+		{"doc.json5", "{xs: [{b: 1, a: 2}, {a: 1, b: 2},]}"},
+		{"doc.hcl", "xs = [{ b = 1, a = 2 }, { a = 1, b = 2 }]\n"},
+		{"blocks.hcl", "xs {\n  b = 1\n  a = 2\n}\nxs {\n  a = 1\n  b = 2\n}\n"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			dir := t.TempDir()
+			file := testutil.WriteTempJSON(t, dir, c.name, c.content)
+			result, err := LoadAndResolveInheritances(filepath.Dir(file), filepath.Base(file), []string{})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			output, err := OutputJSON.EncodeWithKeyOrder(result.Obj, result.KeyOrder)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			expected := `{"xs":[{"b":1,"a":2},{"a":1,"b":2}]}`
+			if compacted := compactJSON(t, output); compacted != expected {
+				t.Errorf("expected %v, got %v", expected, compacted)
+			}
+		})
+	}
+}
+
+func TestKeyOrder_MergedArrayElements(t *testing.T) {
+	dir := t.TempDir()
+	_ = testutil.WriteTempJSON(t, dir, "parent.json", `{"xs": [{"id": 1, "b": 1, "a": 1}, {"a": 2, "id": 2}]}`)
+	for _, c := range []struct {
+		policy   string
+		child    string
+		expected string
+	}{
+		{"append", `[{"z": 3, "id": 3}]`, `{"xs":[{"id":1,"b":1,"a":1},{"a":2,"id":2},{"z":3,"id":3}]}`},
+		{"prepend", `[{"z": 3, "id": 3}]`, `{"xs":[{"z":3,"id":3},{"id":1,"b":1,"a":1},{"a":2,"id":2}]}`},
+		{"mergeByKey:id", `[{"c": 4, "id": 2}, {"z": 3, "id": 3}]`, `{"xs":[{"id":1,"b":1,"a":1},{"a":2,"id":2,"c":4},{"z":3,"id":3}]}`},
+		{"union", `[{"a": 2, "id": 2}, {"z": 3, "id": 3}]`, `{"xs":[{"id":1,"b":1,"a":1},{"a":2,"id":2},{"z":3,"id":3}]}`},
+		{"default", `[{"z": 3, "id": 3}]`, `{"xs":[{"z":3,"id":3}]}`},
+	} {
+		t.Run(c.policy, func(t *testing.T) {
+			child := testutil.WriteTempJSON(t, dir, "child.json", `{"$extends": ["parent.json"], "$merge": {"xs": "`+c.policy+`"}, "xs": `+c.child+`}`)
+			result, err := LoadAndResolveInheritances(filepath.Dir(child), filepath.Base(child), []string{})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			output, err := OutputJSON.EncodeWithKeyOrder(result.Obj, result.KeyOrder)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if compacted := compactJSON(t, output); compacted != c.expected {
+				t.Errorf("expected %v, got %v", c.expected, compacted)
+			}
+		})
+	}
+}
+
+func TestKeyOrder_Merge(t *testing.T) {
+	dir := t.TempDir()
+	_ = testutil.WriteTempJSON(t, dir, "parent.json", `{"b": 1, "a": {"y": 1, "x": 1}}`)
+	child := testutil.WriteTempJSON(t, dir, "child.json", `{"$extends": ["parent.json"], "d": 2, "a": {"z": 2, "x": 2}, "c": 2}`)
+	for _, c := range []struct {
+		policy   KeyOrderPolicy
+		expected string
+	}{
+		{KeyOrderInheritedFirst, `{"b":1,"a":{"y":1,"x":2,"z":2},"d":2,"c":2}`},
+		{KeyOrderChildFirst, `{"d":2,"a":{"z":2,"x":2,"y":1},"c":2,"b":1}`},
+		{KeyOrderSorted, `{"a":{"x":2,"y":1,"z":2},"b":1,"c":2,"d":2}`},
+	} {
+		t.Run(c.policy.String(), func(t *testing.T) {
+			session := NewSession([]string{}, SessionOptions{KeyOrderPolicy: c.policy})
+			result, _, err := session.LoadAndResolveInheritances(filepath.Dir(child), filepath.Base(child))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if c.policy == KeyOrderSorted && result.KeyOrder != nil {
+				t.Errorf("expected no key order, got %v", result.KeyOrder)
+			}
+			output, err := OutputJSON.EncodeWithKeyOrder(result.Obj, result.KeyOrder)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if compacted := compactJSON(t, output); compacted != c.expected {
+				t.Errorf("expected %v, got %v", c.expected, compacted)
+			}
+		})
+	}
+}
+
+func TestKeyOrder_LocalNodesAndKeySide(t *testing.T) {
+	dir := t.TempDir()
+	child := testutil.WriteTempJSON(t, dir, "child.json", `{
+  "$local": {"base": {"port": 80, "host": "localhost"}},
+  "server": {"$extends": ["base"], "name": "web"},
+  "eval:\"renamed\"": {"k": 1},
+  "last": true
+}`)
+	result, err := LoadAndResolveInheritances(filepath.Dir(child), filepath.Base(child), []string{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	obj, keyOrder, err := ProcessKeySideWithKeyOrder(result.Obj, result.KeyOrder, 7, EmptyInvocationSpec())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	output, err := OutputJSON.EncodeWithKeyOrder(obj, keyOrder)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := `{"server":{"port":80,"host":"localhost","name":"web"},"renamed":{"k":1},"last":true}`
+	if compacted := compactJSON(t, output); compacted != expected {
+		t.Errorf("expected %v, got %v", expected, compacted)
+	}
+}
+
+func TestKeyOrder_Outputs(t *testing.T) {
+	dir := t.TempDir()
+	file := testutil.WriteTempJSON(t, dir, "doc.json", `{"zeta": 1, "alpha": {"y": true, "b": "x"}, "mid": [1]}`)
+	result, err := LoadAndResolveInheritances(filepath.Dir(file), filepath.Base(file), []string{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, c := range []struct {
+		format   OutputFormat
+		expected string
+	}{
+		{OutputYAML, "zeta: 1\nalpha:\n  y: true\n  b: x\nmid:\n  - 1"},
+		{OutputTOML, "zeta = 1\nmid = [1]\n\n[alpha]\n  y = true\n  b = \"x\""},
+		{OutputJSON5, "{\n  zeta: 1,\n  alpha: {\n    y: true,\n    b: \"x\",\n  },\n  mid: [\n    1,\n  ],\n}"},
+		{OutputEnv, "ZETA=1\nALPHA_Y=true\nALPHA_B='x'\nMID_0=1"},
+	} {
+		output, err := c.format.EncodeWithKeyOrder(result.Obj, result.KeyOrder)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if output != c.expected {
+			t.Errorf("%s: expected %q, got %q", c.format, c.expected, output)
+		}
+	}
+}
+
+func compactJSON(t *testing.T, s string) string {
+	t.Helper()
+	var b bytes.Buffer
+	if err := json.Compact(&b, []byte(s)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return b.String()
+}
@@ -2,15 +2,40 @@ package internal
 
 import (
 	"github.com/itchyny/gojq"
+	"maps"
 	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
 )
 
 type NodePool interface {
 	ReadNodeEntryValue(baseDir, filename string, compilerOptions []*JqModule) (*NodeEntryValue, error)
 	IsVisited(absPath string) bool
 	MarkVisited(absPath string)
+	// MarkAbsent records a file that was looked for but did not exist, on which the nodes read depend as well, since
+	// creating it may change them.
+	MarkAbsent(absPath string)
+	// MarkListed records a directory whose entries were looked at for a pattern or a directory in "$extends" or
+	// "$includes", on which the nodes read depend as well, since adding files to it may change them.
+	MarkListed(absPath string)
 	SearchPaths() []string
-	SessionDirectory() string
+	// FileSystem returns the file system files are loaded from.
+	FileSystem() FileSystem
+	// MaterializeLocalNodes places the "$local" nodes of obj in a new directory, which is returned, keeping the keys of
+	// the nodes in the order given by keyOrder, the KeyOrder of obj.
+	// "" is returned if obj has no "$local" nodes.
+	MaterializeLocalNodes(obj map[string]any, keyOrder *KeyOrder) (string, error)
+	// TracksProvenance tells if NodeEntryValues read through this pool should carry their Provenance.
+	TracksProvenance() bool
+	// KeyOrderPolicy tells how NodeEntryValues read through this pool order their keys. Unless it is KeyOrderSorted,
+	// they carry their KeyOrder.
+	KeyOrderPolicy() KeyOrderPolicy
+	// DefaultMergeRule returns the rule for merging parents into a node whose "$merge" directive gives no rule for the
+	// node itself.
+	DefaultMergeRule() MergeRule
+	// LoadFile loads a file as a JSON-compatible map, or as a jq module.
+	LoadFile(absPath string) (map[string]any, *JqModule, error)
 	Enter(localNodeDirectory string)
 	Leave(localNodeDirectory string)
 }
@@ -29,16 +54,22 @@ func NewNodeEntryKey(baseDir, filename string) NodeEntryKey {
 // jq queries.
 //
 // Fields:
-// - Obj: A map containing arbitrary data associated with the NodeEntry.
+// - Obj: A map containing arbitrary data associated with the NodeEntry. See UnwrapDocument for non-object documents.
 // - CompilerOptions: A list of options applied when compiling jq queries.
+// - Provenance: The origins of the leaves in Obj, or nil if provenance is not tracked.
+// - KeyOrder: The order of the keys of the objects in Obj, or nil if they are sorted.
 type NodeEntryValue struct {
 	Obj             map[string]any
 	CompilerOptions []*JqModule
+	Provenance      *Provenance
+	KeyOrder        *KeyOrder
 }
 
 type JqModule struct {
 	CompilerOption gojq.CompilerOption
 	Name           string
+	// Path is the file the module is loaded from.
+	Path string
 }
 
 func (e NodeEntryKey) BaseDir() string {
@@ -59,50 +90,238 @@ func NewNodeEntry(baseDir, filename string) NodeEntryKey {
 
 type NodePoolImpl struct {
 	baseDir              string
-	sessionDirectory     string
 	localNodeSearchPaths []string
+	// fs is the file system files are read from.
+	fs FileSystem
+	// local holds $local nodes in memory. It may be shared with other pools, see Session.
+	local *overlayFileSystem
 	// Paths from which files to be inherited are searched for.
 	baseSearchPaths []string
-	// cache holds the mapping of NodeEntryKey to NodeEntryValue, providing
-	// a mechanism for caching node entries that have been processed. This
-	// ensures that previously resolved entries can be retrieved efficiently
-	// without redundant operations.
-	cache   map[NodeEntryKey]NodeEntryValue
+	// cache holds node entries that have been processed, so that previously resolved entries can be retrieved
+	// efficiently without redundant operations. It may be shared with other pools, see Session.
+	cache *nodeCache
+	// visited holds the files being visited in this traversal, for detecting circular inheritances.
 	visited map[string]bool
+	// dependencies holds the files the nodes read through this pool depend on, including the ones of cached nodes.
+	dependencies map[string]bool
+	// absent holds the files looked for but not found while reading the nodes.
+	absent  map[string]bool
+	options SessionOptions
 }
 
-func NewNodePoolWithBaseSearchPaths(baseDir, sessionDirectory string, searchPaths []string) *NodePoolImpl {
+func NewNodePoolWithBaseSearchPaths(baseDir string, searchPaths []string) *NodePoolImpl {
+	return newNodePool(baseDir, newOverlayFileSystem(OSFileSystem()), searchPaths, newNodeCache())
+}
+
+func newNodePool(baseDir string, local *overlayFileSystem, searchPaths []string, cache *nodeCache) *NodePoolImpl {
 	return &NodePoolImpl{
 		baseDir:              baseDir,
-		sessionDirectory:     sessionDirectory,
 		localNodeSearchPaths: []string{},
+		fs:                   local,
+		local:                local,
 		baseSearchPaths:      searchPaths,
-		cache:                map[NodeEntryKey]NodeEntryValue{},
+		cache:                cache,
 		visited:              map[string]bool{},
+		dependencies:         map[string]bool{},
+		absent:               map[string]bool{},
 	}
 }
 
+// nodeCache holds resolved node entries together with the files they depend on.
+// It is safe for concurrent use by pools in different goroutines. A node requested by several pools at the same time
+// is loaded only once, by the first one, and the others wait for it.
+type nodeCache struct {
+	mu    sync.Mutex
+	calls map[nodeCacheKey]*nodeCacheCall
+	// waiting maps a pool to the call it waits for, so that waiting in a cycle can be detected.
+	waiting map[*NodePoolImpl]*nodeCacheCall
+}
+
+// nodeCacheKey identifies a node entry.
+// Since the same name can refer to different $local nodes, the directories of the $local nodes in scope are part of
+// the key.
+type nodeCacheKey struct {
+	NodeEntryKey
+	localNodeSearchPaths string
+}
+
+type nodeCacheEntry struct {
+	value        NodeEntryValue
+	dependencies []string
+}
+
+// nodeCacheCall is a load of a node entry, which is in progress until done is closed.
+type nodeCacheCall struct {
+	done  chan struct{}
+	owner *NodePoolImpl
+	entry nodeCacheEntry
+	err   error
+}
+
+func newNodeCache() *nodeCache {
+	return &nodeCache{calls: map[nodeCacheKey]*nodeCacheCall{}, waiting: map[*NodePoolImpl]*nodeCacheCall{}}
+}
+
+// get returns the entry for key, calling load to make it if no other pool has done or is doing so.
+// A failed load is not cached, while the pools waiting for it receive the error.
+//
+// If waiting for the entry would never end, i.e., the pool itself is loading it, or the pool loading it waits for
+// this pool directly or indirectly, the file-level inheritance is circular. In that case, load is called without
+// caching, so that the pool reports the cycle in the usual way.
+func (c *nodeCache) get(key nodeCacheKey, pool *NodePoolImpl, load func() (nodeCacheEntry, error)) (nodeCacheEntry, error) {
+	c.mu.Lock()
+	if call, ok := c.calls[key]; ok {
+		if !call.isDone() && c.waitsFor(call.owner, pool) {
+			c.mu.Unlock()
+			return load()
+		}
+		c.waiting[pool] = call
+		c.mu.Unlock()
+		<-call.done
+		c.mu.Lock()
+		delete(c.waiting, pool)
+		c.mu.Unlock()
+		return call.entry, call.err
+	}
+	call := &nodeCacheCall{done: make(chan struct{}), owner: pool}
+	c.calls[key] = call
+	c.mu.Unlock()
+
+	call.entry, call.err = load()
+	if call.err != nil {
+		c.mu.Lock()
+		delete(c.calls, key)
+		c.mu.Unlock()
+	}
+	close(call.done)
+	return call.entry, call.err
+}
+
+// waitsFor tells if pool from is, or waits for, pool to, directly or indirectly. c.mu must be held.
+func (c *nodeCache) waitsFor(from, to *NodePoolImpl) bool {
+	for cur := from; cur != to; {
+		call, ok := c.waiting[cur]
+		if !ok {
+			return false
+		}
+		cur = call.owner
+	}
+	return true
+}
+
+func (call *nodeCacheCall) isDone() bool {
+	select {
+	case <-call.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// ReadNodeEntryValue reads a node entry through the cache, loading and resolving it if it is not cached yet.
+// A NodePoolImpl is meant for a single traversal, i.e., the inheritance graph of one target, and must not be used by
+// multiple goroutines, while the cache may be shared with pools of other traversals.
 func (p *NodePoolImpl) ReadNodeEntryValue(baseDir, filename string, compilerOptions []*JqModule) (*NodeEntryValue, error) {
-	nodeEntryKey := NodeEntryKey{filename: filename, baseDir: baseDir}
-	ret, ok := p.cache[nodeEntryKey]
-	if !ok {
+	key := nodeCacheKey{
+		NodeEntryKey:         NodeEntryKey{filename: filename, baseDir: baseDir},
+		localNodeSearchPaths: strings.Join(p.localNodeSearchPaths, string(filepath.ListSeparator)),
+	}
+	entry, err := p.cache.get(key, p, func() (nodeCacheEntry, error) {
+		persistentPath, persistent := p.persistentCachePath(key)
+		if persistent {
+			if ret, ok := p.options.persistentCache().load(p.fs, persistentPath); ok {
+				return ret, nil
+			}
+		}
+		before := maps.Clone(p.dependencies)
+		beforeAbsent := maps.Clone(p.absent)
 		nodeEntryValue, err := LoadAndResolveInheritancesRecursively(baseDir, filename, p)
 		if err != nil {
-			return nil, err
+			return nodeCacheEntry{}, err
+		}
+		ret := nodeCacheEntry{value: *nodeEntryValue}
+		for k := range p.dependencies {
+			if !before[k] {
+				ret.dependencies = append(ret.dependencies, k)
+			}
+		}
+		if persistent {
+			var absent []string
+			for k := range p.absent {
+				if !beforeAbsent[k] {
+					absent = append(absent, k)
+				}
+			}
+			p.options.persistentCache().store(p.fs, persistentPath, ret, absent)
 		}
-		p.cache[nodeEntryKey] = *nodeEntryValue
-		ret = *nodeEntryValue
+		return ret, nil
+	})
+	if err != nil {
+		return nil, err
 	}
+	for _, each := range entry.dependencies {
+		p.dependencies[each] = true
+	}
+	ret := entry.value
 	ret.CompilerOptions = append(compilerOptions, ret.CompilerOptions...)
 	return &ret, nil
 }
 
+// persistentCachePath returns the file of the persistent cache for a node, and whether the node can be stored there at
+// all. Nodes in the scope of $local nodes cannot, since their directories differ from process to process.
+func (p *NodePoolImpl) persistentCachePath(key nodeCacheKey) (string, bool) {
+	if p.options.CacheDirectory == "" || p.options.TracksProvenance || len(p.options.Loaders) > 0 || len(p.localNodeSearchPaths) > 0 {
+		return "", false
+	}
+	ret, err := p.options.persistentCache().path(p.fs, key, p.SearchPaths(), p.options.DefaultMergeRule, p.options.KeyOrderPolicy)
+	if err != nil {
+		return "", false
+	}
+	return ret, true
+}
+
+func (p *NodePoolImpl) MarkAbsent(absPath string) {
+	if !isLocalNodePath(absPath) {
+		p.absent[absPath] = true
+	}
+}
+
+func (p *NodePoolImpl) MarkListed(absPath string) {
+	if !isLocalNodePath(absPath) {
+		p.dependencies[absPath] = true
+	}
+}
+
 func (p *NodePoolImpl) IsVisited(absPath string) bool {
 	return p.visited[absPath]
 }
 
 func (p *NodePoolImpl) MarkVisited(absPath string) {
 	p.visited[absPath] = true
+	p.dependencies[absPath] = true
+}
+
+// VisitedFiles returns the files the nodes read through this pool depend on, sorted, whether they are visited in this
+// traversal or read from the cache.
+// Script directives are represented by their programs, and $local nodes, which live in memory, are represented by the
+// files that define them, which are visited anyway. Directories listed for patterns are included as they are.
+func (p *NodePoolImpl) VisitedFiles() []string {
+	ret := []string{}
+	for k := range p.dependencies {
+		file := k
+		if _, err := p.fs.Stat(file); err != nil {
+			// A script directive is visited by a key made of its program and arguments, separated by semicolons.
+			file, _, _ = strings.Cut(k, ";")
+		}
+		if isLocalNodePath(file) {
+			continue
+		}
+		if !slices.Contains(ret, file) {
+			ret = append(ret, file)
+		}
+	}
+	slices.Sort(ret)
+	return ret
 }
 
 func (p *NodePoolImpl) Enter(localNodeDirectory string) {
@@ -116,8 +335,38 @@ func (p *NodePoolImpl) Leave(localNodeDirectory string) {
 	p.localNodeSearchPaths = p.localNodeSearchPaths[:len(p.localNodeSearchPaths)-1]
 }
 
-func (p *NodePoolImpl) SessionDirectory() string {
-	return p.sessionDirectory
+func (p *NodePoolImpl) FileSystem() FileSystem {
+	return p.fs
+}
+
+func (p *NodePoolImpl) MaterializeLocalNodes(obj map[string]any, keyOrder *KeyOrder) (string, error) {
+	return materializeLocalNodes(obj, keyOrder, p.local)
+}
+
+func (p *NodePoolImpl) TracksProvenance() bool {
+	return p.options.TracksProvenance
+}
+
+func (p *NodePoolImpl) KeyOrderPolicy() KeyOrderPolicy {
+	return p.options.KeyOrderPolicy
+}
+
+func (p *NodePoolImpl) DefaultMergeRule() MergeRule {
+	return p.options.DefaultMergeRule
+}
+
+// LoadFile loads a file with the loader registered for its extension, if any, or with LoadFileAsRawJSONIn otherwise.
+func (p *NodePoolImpl) LoadFile(absPath string) (map[string]any, *JqModule, error) {
+	loader, ok := p.options.Loaders[strings.ToLower(filepath.Ext(absPath))]
+	if !ok {
+		return LoadFileAsRawJSONIn(p.fs, absPath)
+	}
+	data, err := p.fs.ReadFile(absPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	obj, err := loader(data, absPath)
+	return withNormalizedNumbers(obj, nil, err)
 }
 
 func (p *NodePoolImpl) SearchPaths() []string {
@@ -0,0 +1,169 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/titanous/json5"
+	"math"
+	"math/big"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Numbers are represented by json.Number everywhere in objects, i.e., in what loaders produce, in what templates
+// evaluate to, and in what encoders print, so that integers (e.g. IDs and epoch nanoseconds) and decimals (e.g. money
+// values) are kept as they are written, regardless of the format they come from. gojq accepts json.Number as it is.
+
+var jsonNumberPattern = regexp.MustCompile(`^-?(0|[1-9][0-9]*)(\.[0-9]+)?([eE][+-]?[0-9]+)?$`)
+
+// NormalizeNumbers replaces numbers of any Go type in v, such as int64 and float32, with json.Number, and returns v.
+// Maps and slices are modified in place.
+// Numbers that JSON cannot represent, i.e., NaN and infinities, are left as float64.
+func NormalizeNumbers(v any) any {
+	switch x := v.(type) {
+	case map[string]any:
+		for k, each := range x {
+			x[k] = NormalizeNumbers(each)
+		}
+		return x
+	case []any:
+		for i, each := range x {
+			x[i] = NormalizeNumbers(each)
+		}
+		return x
+	case []map[string]any:
+		// The TOML decoder gives arrays of tables this way.
+		ret := make([]any, len(x))
+		for i, each := range x {
+			ret[i] = NormalizeNumbers(each)
+		}
+		return ret
+	case json.Number:
+		return normalizeNumberLiteral(string(x))
+	case json5.Number:
+		return normalizeNumberLiteral(string(x))
+	case int:
+		return json.Number(strconv.FormatInt(int64(x), 10))
+	case int8:
+		return json.Number(strconv.FormatInt(int64(x), 10))
+	case int16:
+		return json.Number(strconv.FormatInt(int64(x), 10))
+	case int32:
+		return json.Number(strconv.FormatInt(int64(x), 10))
+	case int64:
+		return json.Number(strconv.FormatInt(x, 10))
+	case uint:
+		return json.Number(strconv.FormatUint(uint64(x), 10))
+	case uint8:
+		return json.Number(strconv.FormatUint(uint64(x), 10))
+	case uint16:
+		return json.Number(strconv.FormatUint(uint64(x), 10))
+	case uint32:
+		return json.Number(strconv.FormatUint(uint64(x), 10))
+	case uint64:
+		return json.Number(strconv.FormatUint(x, 10))
+	case float32:
+		return floatNumber(float64(x), 32)
+	case float64:
+		return floatNumber(x, 64)
+	case *big.Int:
+		return json.Number(x.String())
+	case *big.Float:
+		return bigFloatNumber(x)
+	default:
+		return v
+	}
+}
+
+// UnmarshalJSON works like json.Unmarshal, except that numbers are decoded into json.Number.
+func UnmarshalJSON(data []byte, v any) error {
+	if !json.Valid(data) {
+		// json.Unmarshal tells where the syntax error is.
+		return json.Unmarshal(data, v)
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	return dec.Decode(v)
+}
+
+// normalizeNumberLiteral makes a json.Number of a number literal, which may be written in a form JSON does not allow,
+// e.g., "+1", ".5", and "0x1F" in JSON5 and YAML.
+func normalizeNumberLiteral(s string) any {
+	if jsonNumberPattern.MatchString(s) {
+		return json.Number(s)
+	}
+	t := strings.ReplaceAll(strings.TrimPrefix(s, "+"), "_", "")
+	if jsonNumberPattern.MatchString(t) {
+		return json.Number(t)
+	}
+	if i, ok := new(big.Int).SetString(t, 0); ok {
+		return json.Number(i.String())
+	}
+	if f, ok := new(big.Float).SetPrec(512).SetString(t); ok {
+		return bigFloatNumber(f)
+	}
+	if f, err := strconv.ParseFloat(t, 64); err == nil {
+		return floatNumber(f, 64)
+	}
+	return json.Number(s)
+}
+
+// floatNumber makes a json.Number of the shortest representation of f that is read back as f, e.g., 19.99 rather than
+// 19.989999999999998.
+func floatNumber(f float64, bitSize int) any {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return f
+	}
+	if f == math.Trunc(f) && math.Abs(f) < 1e21 {
+		return json.Number(strconv.FormatFloat(f, 'f', -1, bitSize))
+	}
+	return json.Number(strconv.FormatFloat(f, 'g', -1, bitSize))
+}
+
+func bigFloatNumber(f *big.Float) any {
+	if f.IsInf() {
+		return math.Inf(f.Sign())
+	}
+	if f.IsInt() {
+		return json.Number(f.Text('f', 0))
+	}
+	return json.Number(f.Text('g', -1))
+}
+
+// equalValues tells if a and b are equal as JSON values, i.e., numbers are compared by their values rather than by how
+// they are written, e.g., 1.0 in YAML equals 1 in JSON.
+func equalValues(a, b any) bool {
+	return reflect.DeepEqual(canonicalNumbers(a), canonicalNumbers(b))
+}
+
+// canonicalNumber is the form canonicalNumbers gives to a number, which is shared by all the numbers of the same value.
+// It is a struct, so that fmt's "%#v" tells it from a string.
+type canonicalNumber struct {
+	rat string
+}
+
+// canonicalNumbers returns a copy of v in which json.Numbers are replaced with canonicalNumbers, so that equal numbers
+// written differently compare equal by reflect.DeepEqual, and print the same by fmt's "%#v".
+func canonicalNumbers(v any) any {
+	switch x := v.(type) {
+	case map[string]any:
+		ret := make(map[string]any, len(x))
+		for k, each := range x {
+			ret[k] = canonicalNumbers(each)
+		}
+		return ret
+	case []any:
+		ret := make([]any, len(x))
+		for i, each := range x {
+			ret[i] = canonicalNumbers(each)
+		}
+		return ret
+	case json.Number:
+		if r, ok := new(big.Rat).SetString(string(x)); ok {
+			return canonicalNumber{rat: r.RatString()}
+		}
+	}
+	return v
+}
@@ -0,0 +1,146 @@
+package internal
+
+import (
+	"encoding/json"
+	"github.com/dakusui/jqplusplus/internal/testutil"
+	"math"
+	"math/big"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestNumbers_RoundTrip(t *testing.T) {
+	for _, c := range []struct {
+		name    string
+		content string
+	}{
+		{"parent.json", `{"id": 12345678901234567, "createdAt": 1700000000123456789, "price": 19.99, "fee": 0.10}`},
+		{"parent.yaml", "id: 12345678901234567\ncreatedAt: 1700000000123456789\nprice: 19.99\nfee: 0.10\n"},
+		{"parent.toml", "id = 12345678901234567\ncreatedAt = 1700000000123456789\nprice = 19.99\nfee = 0.10\n"},
+		{"parent.json5", "{id: 12345678901234567, createdAt: 1700000000123456789, price: 19.99, fee: .10,}"},
+		{"parent.hocon", "id = 12345678901234567\ncreatedAt = 1700000000123456789\nprice = 19.99\nfee = 0.10\n"},
+		{"parent.hcl", "id = 12345678901234567\ncreatedAt = 1700000000123456789\nprice = 19.99\nfee = 0.10\n"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			dir := t.TempDir()
+			_ = testutil.WriteTempJSON(t, dir, c.name, c.content)
+			child := testutil.WriteTempJSON(t, dir, "child.json", `{
+  "$extends": ["`+c.name+`"],
+  "nextId": "eval:number:ref(\".id\") + 1",
+  "expiresAt": "eval:number:ref(\".createdAt\") + 1000000000",
+  "total": 39.98
+}`)
+			result, err := LoadAndResolveInheritances(filepath.Dir(child), filepath.Base(child), []string{})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			obj, err := ProcessValueSide(result.Obj, 7, EmptyInvocationSpec())
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			expected := map[string]any{
+				"id":        json.Number("12345678901234567"),
+				"nextId":    json.Number("12345678901234568"),
+				"createdAt": json.Number("1700000000123456789"),
+				"expiresAt": json.Number("1700000001123456789"),
+				"price":     json.Number("19.99"),
+				"total":     json.Number("39.98"),
+			}
+			for k, v := range expected {
+				if obj[k] != v {
+					t.Errorf("%s: expected %v, got %#v", k, v, obj[k])
+				}
+			}
+			if fee, ok := obj["fee"].(json.Number); !ok || (fee != "0.10" && fee != "0.1") {
+				t.Errorf("fee: unexpected value: %#v", obj["fee"])
+			}
+			delete(obj, "fee")
+			for _, f := range []struct {
+				format   OutputFormat
+				expected []string
+			}{
+				{OutputJSON, []string{`"id": 12345678901234567`, `"nextId": 12345678901234568`, `"createdAt": 1700000000123456789`, `"expiresAt": 1700000001123456789`, `"price": 19.99`, `"total": 39.98`}},
+				{OutputYAML, []string{"id: 12345678901234567", "nextId: 12345678901234568", "createdAt: 1700000000123456789", "expiresAt: 1700000001123456789", "price: 19.99", "total: 39.98"}},
+				{OutputTOML, []string{"id = 12345678901234567", "nextId = 12345678901234568", "createdAt = 1700000000123456789", "expiresAt = 1700000001123456789", "price = 19.99", "total = 39.98"}},
+			} {
+				output, err := f.format.Encode(obj)
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				for _, each := range f.expected {
+					if !strings.Contains(output, each) {
+						t.Errorf("%s: expected %q in %v", f.format, each, output)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestNumbers_BeyondInt64(t *testing.T) {
+	for _, c := range []struct {
+		name    string
+		content string
+	}{
+		{"big.json", `{"n": 123456789012345678901234567890}`},
+		{"big.yaml", "n: 123456789012345678901234567890\n"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			dir := t.TempDir()
+			file := testutil.WriteTempJSON(t, dir, c.name, c.content)
+			result, err := LoadAndResolveInheritances(filepath.Dir(file), filepath.Base(file), []string{})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if expected := map[string]any{"n": json.Number("123456789012345678901234567890")}; !reflect.DeepEqual(result.Obj, expected) {
+				t.Errorf("expected %v, got %v", expected, result.Obj)
+			}
+			output, err := OutputYAML.Encode(result.Obj)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if output != `"n": 123456789012345678901234567890` {
+				t.Errorf("unexpected output: %v", output)
+			}
+			if _, err := OutputTOML.Encode(result.Obj); err == nil || !strings.Contains(err.Error(), "not representable in TOML") {
+				t.Errorf("expected an error for an integer beyond 64 bits, got %v", err)
+			}
+		})
+	}
+}
+
+func TestNormalizeNumbers(t *testing.T) {
+	input := map[string]any{
+		"int":     int(1),
+		"int64":   int64(math.MaxInt64),
+		"uint64":  uint64(math.MaxUint64),
+		"float32": float32(19.99),
+		"float64": 0.1,
+		"big":     new(big.Int).Lsh(big.NewInt(1), 70),
+		"literal": json.Number("+0x1F"),
+		"nan":     math.NaN(),
+		"list":    []any{float64(2), "x"},
+		"tables":  []map[string]any{{"n": int64(3)}},
+	}
+	result := NormalizeNumbers(input).(map[string]any)
+	if nan, ok := result["nan"].(float64); !ok || !math.IsNaN(nan) {
+		t.Errorf("unexpected NaN: %#v", result["nan"])
+	}
+	delete(result, "nan")
+	expected := map[string]any{
+		"int":     json.Number("1"),
+		"int64":   json.Number("9223372036854775807"),
+		"uint64":  json.Number("18446744073709551615"),
+		"float32": json.Number("19.99"),
+		"float64": json.Number("0.1"),
+		"big":     json.Number("1180591620717411303424"),
+		"literal": json.Number("31"),
+		"list":    []any{json.Number("2"), "x"},
+		"tables":  []any{map[string]any{"n": json.Number("3")}},
+	}
+	if !reflect.DeepEqual(result, expected) {
+		t.Errorf("expected %v, got %v", expected, result)
+	}
+}
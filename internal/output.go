@@ -0,0 +1,448 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"math"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// OutputFormat is a format in which rendered objects are printed.
+type OutputFormat string
+
+const (
+	OutputJSON  OutputFormat = "json"
+	OutputYAML  OutputFormat = "yaml"
+	OutputTOML  OutputFormat = "toml"
+	OutputJSON5 OutputFormat = "json5"
+	OutputHOCON OutputFormat = "hocon"
+	// OutputEnv is a flattened `KEY=value` form, which can be sourced by shells.
+	OutputEnv OutputFormat = "env"
+)
+
+// Encoder renders a document as text in a specific format, without a trailing newline.
+// An object is given either as a map, whose keys are rendered sorted, or as a value made by KeyOrder.Ordered.
+type Encoder func(obj any) (string, error)
+
+// objectFormats are the output formats that can only render objects.
+var objectFormats = []OutputFormat{OutputTOML, OutputHOCON, OutputEnv}
+
+// encoders holds the encoder for each output format.
+var encoders = map[OutputFormat]Encoder{
+	OutputJSON:  encodeJSON,
+	OutputYAML:  encodeYAML,
+	OutputTOML:  encodeTOML,
+	OutputJSON5: encodeJSON5,
+	OutputHOCON: encodeHOCON,
+	OutputEnv:   encodeEnv,
+}
+
+// OutputFormats returns the names of available output formats, sorted.
+func OutputFormats() []string {
+	return Map(slices.Sorted(maps.Keys(encoders)), func(f OutputFormat) string { return string(f) })
+}
+
+// ParseOutputFormat converts a command-line value into an OutputFormat.
+func ParseOutputFormat(s string) (OutputFormat, error) {
+	if _, ok := encoders[OutputFormat(s)]; !ok {
+		return "", fmt.Errorf("unknown output format: %q (expected one of %s)", s, strings.Join(OutputFormats(), ", "))
+	}
+	return OutputFormat(s), nil
+}
+
+// Extension returns the file name extension, without a dot, conventionally used for the format.
+func (f OutputFormat) Extension() string {
+	switch f {
+	case OutputHOCON:
+		return "conf"
+	case "":
+		return string(OutputJSON)
+	default:
+		return string(f)
+	}
+}
+
+// Encode renders a document, i.e., an object, an array, or a scalar, in the format.
+// Keys of maps are sorted, so that the output is stable; a value made by KeyOrder.Ordered keeps its order.
+// A map holding a document other than an object is rendered as the document. See UnwrapDocument.
+func (f OutputFormat) Encode(v any) (string, error) {
+	encoder, ok := encoders[f]
+	if !ok {
+		return "", fmt.Errorf("unknown output format: %q", string(f))
+	}
+	if obj, ok := v.(map[string]any); ok {
+		v, _ = UnwrapDocument(obj)
+	}
+	switch v.(type) {
+	case map[string]any, orderedObject:
+	default:
+		if slices.Contains(objectFormats, f) {
+			return "", fmt.Errorf("a value that is not an object cannot be printed as %s: %T", f, v)
+		}
+	}
+	return encoder(v)
+}
+
+// EncodeWithKeyOrder renders obj in the format like Encode, with the keys of its objects in the order given by
+// keyOrder, the KeyOrder of obj. If keyOrder is nil, keys are sorted.
+func (f OutputFormat) EncodeWithKeyOrder(obj map[string]any, keyOrder *KeyOrder) (string, error) {
+	document, root := UnwrapDocument(obj)
+	return f.Encode(keyOrder.Subtree(root).Ordered(document))
+}
+
+func encodeJSON(obj any) (string, error) {
+	data, err := json.MarshalIndent(obj, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+func encodeYAML(obj any) (string, error) {
+	v, err := toYAMLValue(obj)
+	if err != nil {
+		return "", err
+	}
+	var b bytes.Buffer
+	encoder := yaml.NewEncoder(&b)
+	encoder.SetIndent(2)
+	// yaml.v3 sorts keys of maps by itself.
+	if err := encoder.Encode(v); err != nil {
+		return "", err
+	}
+	if err := encoder.Close(); err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(b.String(), "\n"), nil
+}
+
+// toYAMLValue converts numbers in v into YAML scalars, since yaml.v3 would render json.Number as a string, and
+// ordered objects into mappings.
+func toYAMLValue(v any) (any, error) {
+	switch x := v.(type) {
+	case map[string]any:
+		ret := make(map[string]any, len(x))
+		for k, each := range x {
+			w, err := toYAMLValue(each)
+			if err != nil {
+				return nil, err
+			}
+			ret[k] = w
+		}
+		return ret, nil
+	case orderedObject:
+		ret := &yaml.Node{Kind: yaml.MappingNode}
+		for _, e := range x {
+			w, err := toYAMLValue(e.value)
+			if err != nil {
+				return nil, err
+			}
+			value := &yaml.Node{}
+			if err := value.Encode(w); err != nil {
+				return nil, err
+			}
+			ret.Content = append(ret.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: e.key}, value)
+		}
+		return ret, nil
+	case []any:
+		ret := make([]any, len(x))
+		for i, each := range x {
+			w, err := toYAMLValue(each)
+			if err != nil {
+				return nil, err
+			}
+			ret[i] = w
+		}
+		return ret, nil
+	case json.Number:
+		// Without a tag, the literal is written as it is, even if it is an integer too large for YAML's !!int.
+		return &yaml.Node{Kind: yaml.ScalarNode, Value: string(x)}, nil
+	default:
+		return x, nil
+	}
+}
+
+// encodeTOML renders obj as TOML.
+// Values that TOML cannot represent, i.e., null and arrays whose elements are of different types, are reported as
+// errors.
+func encodeTOML(obj any) (string, error) {
+	v, err := toTOMLValue([]any{}, obj)
+	if err != nil {
+		return "", err
+	}
+	var b bytes.Buffer
+	if err := toml.NewEncoder(&b).Encode(v); err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(b.String(), "\n"), nil
+}
+
+// toTOMLValue checks that v is representable in TOML, converting integral numbers into int64 so that they are not
+// rendered as floats (e.g. `1.0`). Integers beyond 64 bits are reported as errors, since TOML cannot represent them.
+//
+// Ordered objects are converted into structs, whose fields the TOML encoder renders in order, while it sorts the keys
+// of maps.
+func toTOMLValue(p []any, v any) (any, error) {
+	switch x := v.(type) {
+	case nil:
+		return nil, fmt.Errorf("null is not representable in TOML: %s", formatPathChain([][]any{p}))
+	case map[string]any:
+		ret := make(map[string]any, len(x))
+		for k, each := range x {
+			w, err := toTOMLValue(append(append([]any{}, p...), k), each)
+			if err != nil {
+				return nil, err
+			}
+			ret[k] = w
+		}
+		return ret, nil
+	case orderedObject:
+		fields := make([]reflect.StructField, len(x))
+		values := make([]any, len(x))
+		ordered := true
+		for i, e := range x {
+			w, err := toTOMLValue(append(append([]any{}, p...), e.key), e.value)
+			if err != nil {
+				return nil, err
+			}
+			values[i] = w
+			fields[i] = reflect.StructField{Name: fmt.Sprintf("F%d", i), Type: reflect.TypeFor[any](), Tag: reflect.StructTag("toml:" + strconv.Quote(e.key))}
+			// The encoder cannot take these keys from tags.
+			if e.key == "" || e.key == "-" || strings.Contains(e.key, ",") {
+				ordered = false
+			}
+		}
+		if !ordered {
+			ret := make(map[string]any, len(x))
+			for i, e := range x {
+				ret[e.key] = values[i]
+			}
+			return ret, nil
+		}
+		ret := reflect.New(reflect.StructOf(fields)).Elem()
+		for i, w := range values {
+			ret.Field(i).Set(reflect.ValueOf(w))
+		}
+		return ret.Interface(), nil
+	case []any:
+		ret := make([]any, len(x))
+		for i, each := range x {
+			if i > 0 && jsonTypeName(each) != jsonTypeName(x[0]) {
+				return nil, fmt.Errorf("array with elements of different types (%s and %s) is not representable in TOML: %s", jsonTypeName(x[0]), jsonTypeName(each), formatPathChain([][]any{p}))
+			}
+			w, err := toTOMLValue(append(append([]any{}, p...), i), each)
+			if err != nil {
+				return nil, err
+			}
+			ret[i] = w
+		}
+		return ret, nil
+	case float64:
+		if x == math.Trunc(x) && math.Abs(x) < 1<<53 {
+			return int64(x), nil
+		}
+		return x, nil
+	case json.Number:
+		if strings.ContainsAny(string(x), ".eE") {
+			return x.Float64()
+		}
+		i, err := x.Int64()
+		if err != nil {
+			return nil, fmt.Errorf("integer %s is not representable in TOML: %s", x, formatPathChain([][]any{p}))
+		}
+		return i, nil
+	default:
+		return x, nil
+	}
+}
+
+func jsonTypeName(v any) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case map[string]any, orderedObject:
+		return "object"
+	case []any:
+		return "array"
+	default:
+		return "number"
+	}
+}
+
+var (
+	json5IdentifierPattern  = regexp.MustCompile(`^[A-Za-z_$][A-Za-z0-9_$]*$`)
+	hoconUnquotedKeyPattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+	envInvalidCharPattern   = regexp.MustCompile(`[^A-Za-z0-9_]`)
+)
+
+// encodeJSON5 renders obj as JSON5, leaving keys that are identifiers unquoted.
+func encodeJSON5(obj any) (string, error) {
+	var b strings.Builder
+	err := writeTree(&b, obj, "", treeSyntax{
+		key: func(k string) string {
+			if json5IdentifierPattern.MatchString(k) {
+				return k
+			}
+			return quoteJSON(k)
+		},
+		separator:       ": ",
+		objectSeparator: ": ",
+		trailer:         ",",
+	})
+	return b.String(), err
+}
+
+// encodeHOCON renders obj as HOCON, writing objects as `key { ... }` and other values as `key = value`.
+func encodeHOCON(obj any) (string, error) {
+	var b strings.Builder
+	err := writeTree(&b, obj, "", treeSyntax{
+		key: func(k string) string {
+			if hoconUnquotedKeyPattern.MatchString(k) {
+				return k
+			}
+			return quoteJSON(k)
+		},
+		separator:       " = ",
+		objectSeparator: " ",
+	})
+	return b.String(), err
+}
+
+// treeSyntax describes the differences between JSON-like formats rendered by writeTree.
+type treeSyntax struct {
+	key func(k string) string
+	// separator is written between a key and its value, and objectSeparator is used instead when the value is an object.
+	separator       string
+	objectSeparator string
+	// trailer is written after each entry of an object or an array.
+	trailer string
+}
+
+func writeTree(b *strings.Builder, v any, indent string, syntax treeSyntax) error {
+	if entries, ok := objectEntries(v); ok {
+		if len(entries) == 0 {
+			b.WriteString("{}")
+			return nil
+		}
+		b.WriteString("{\n")
+		for _, e := range entries {
+			b.WriteString(indent + "  " + syntax.key(e.key))
+			if _, ok := objectEntries(e.value); ok {
+				b.WriteString(syntax.objectSeparator)
+			} else {
+				b.WriteString(syntax.separator)
+			}
+			if err := writeTree(b, e.value, indent+"  ", syntax); err != nil {
+				return err
+			}
+			b.WriteString(syntax.trailer + "\n")
+		}
+		b.WriteString(indent + "}")
+		return nil
+	}
+	switch x := v.(type) {
+	case []any:
+		if len(x) == 0 {
+			b.WriteString("[]")
+			return nil
+		}
+		b.WriteString("[\n")
+		for _, each := range x {
+			b.WriteString(indent + "  ")
+			if err := writeTree(b, each, indent+"  ", syntax); err != nil {
+				return err
+			}
+			b.WriteString(syntax.trailer + "\n")
+		}
+		b.WriteString(indent + "]")
+	default:
+		data, err := json.Marshal(x)
+		if err != nil {
+			return err
+		}
+		b.Write(data)
+	}
+	return nil
+}
+
+// encodeEnv flattens obj into `KEY=value` lines, in the order of the leaves if obj is ordered, or sorted by keys
+// otherwise.
+//
+// A key is made by joining the path to a leaf with underscores, turning characters other than letters, digits, and
+// underscores into underscores, and upper-casing the result, e.g., ".db.host-name" becomes DB_HOST_NAME and ".a[0]"
+// becomes A_0.
+// Strings are single-quoted for shells, null becomes an empty value, and empty objects and arrays are omitted.
+// Different paths that end up with the same key are reported as an error.
+func encodeEnv(obj any) (string, error) {
+	lines := map[string]string{}
+	var keys []string
+	origins := map[string][]any{}
+	var walk func(p []any, v any) error
+	walk = func(p []any, v any) error {
+		if entries, ok := objectEntries(v); ok {
+			for _, e := range entries {
+				if err := walk(append(append([]any{}, p...), e.key), e.value); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		switch x := v.(type) {
+		case []any:
+			for i, each := range x {
+				if err := walk(append(append([]any{}, p...), i), each); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		key := strings.ToUpper(envInvalidCharPattern.ReplaceAllString(strings.Join(Map(p, func(e any) string {
+			return fmt.Sprint(e)
+		}), "_"), "_"))
+		if q, ok := origins[key]; ok {
+			return fmt.Errorf("paths %s and %s are both flattened into %s", formatPathChain([][]any{q}), formatPathChain([][]any{p}), key)
+		}
+		origins[key] = p
+		keys = append(keys, key)
+		switch x := v.(type) {
+		case nil:
+			lines[key] = ""
+		case string:
+			lines[key] = "'" + strings.ReplaceAll(x, "'", `'\''`) + "'"
+		default:
+			data, err := json.Marshal(x)
+			if err != nil {
+				return err
+			}
+			lines[key] = string(data)
+		}
+		return nil
+	}
+	if err := walk([]any{}, obj); err != nil {
+		return "", err
+	}
+	if _, ok := obj.(orderedObject); !ok {
+		slices.Sort(keys)
+	}
+	return strings.Join(Map(keys, func(k string) string {
+		return k + "=" + lines[k]
+	}), "\n"), nil
+}
+
+func quoteJSON(s string) string {
+	data, _ := json.Marshal(s)
+	return string(data)
+}
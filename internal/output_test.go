@@ -0,0 +1,127 @@
+package internal
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEncode_TOML(t *testing.T) {
+	obj := map[string]any{"a": float64(1), "b": map[string]any{"c": 2.5, "d": []any{"x", "y"}}}
+	result, err := OutputTOML.Encode(obj)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := `a = 1
+
+[b]
+  c = 2.5
+  d = ["x", "y"]`
+	if result != expected {
+		t.Errorf("expected %v, got %v", expected, result)
+	}
+}
+
+func TestEncode_TOML_Null_ThenError(t *testing.T) {
+	_, err := OutputTOML.Encode(map[string]any{"a": map[string]any{"b": nil}})
+	if err == nil || !strings.Contains(err.Error(), ".a.b") {
+		t.Errorf("expected an error mentioning .a.b, got %v", err)
+	}
+}
+
+func TestEncode_TOML_HeterogeneousArray_ThenError(t *testing.T) {
+	_, err := OutputTOML.Encode(map[string]any{"a": []any{float64(1), "x"}})
+	if err == nil || !strings.Contains(err.Error(), "number and string") {
+		t.Errorf("expected an error for a heterogeneous array, got %v", err)
+	}
+}
+
+func TestEncode_JSON5(t *testing.T) {
+	result, err := OutputJSON5.Encode(map[string]any{"a": float64(1), "b-c": []any{"x"}, "d": map[string]any{}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := `{
+  a: 1,
+  "b-c": [
+    "x",
+  ],
+  d: {},
+}`
+	if result != expected {
+		t.Errorf("expected %v, got %v", expected, result)
+	}
+}
+
+func TestEncode_HOCON(t *testing.T) {
+	result, err := OutputHOCON.Encode(map[string]any{"a": map[string]any{"b": "x"}, "c.d": true})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := `{
+  a {
+    b = "x"
+  }
+  "c.d" = true
+}`
+	if result != expected {
+		t.Errorf("expected %v, got %v", expected, result)
+	}
+}
+
+func TestEncode_Env(t *testing.T) {
+	obj := map[string]any{
+		"db":   map[string]any{"host-name": "it's", "port": float64(5432)},
+		"list": []any{true, nil},
+	}
+	result, err := OutputEnv.Encode(obj)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := `DB_HOST_NAME='it'\''s'
+DB_PORT=5432
+LIST_0=true
+LIST_1=`
+	if result != expected {
+		t.Errorf("expected %v, got %v", expected, result)
+	}
+}
+
+func TestEncode_Env_Collision_ThenError(t *testing.T) {
+	_, err := OutputEnv.Encode(map[string]any{"a-b": "x", "a_b": "y"})
+	if err == nil || !strings.Contains(err.Error(), "A_B") {
+		t.Errorf("expected a collision error for A_B, got %v", err)
+	}
+}
+
+func TestParseOutputFormat_Unknown_ThenError(t *testing.T) {
+	if _, err := ParseOutputFormat("xml"); err == nil {
+		t.Errorf("expected error for unknown output format")
+	}
+}
+
+func TestEncode_NonObjects(t *testing.T) {
+	for _, each := range []struct {
+		format   OutputFormat
+		v        any
+		expected string
+	}{
+		{OutputJSON, []any{"a", map[string]any{"b": true}}, "[\n  \"a\",\n  {\n    \"b\": true\n  }\n]"},
+		{OutputYAML, []any{"a", map[string]any{"b": true}}, "- a\n- b: true"},
+		{OutputJSON5, []any{"a"}, "[\n  \"a\",\n]"},
+		{OutputYAML, "x", "x"},
+		{OutputJSON, map[string]any{ValueDirective: []any{"a"}}, "[\n  \"a\"\n]"},
+	} {
+		result, err := each.format.Encode(each.v)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if result != each.expected {
+			t.Errorf("%s: expected %q, got %q", each.format, each.expected, result)
+		}
+	}
+	for _, format := range []OutputFormat{OutputTOML, OutputHOCON, OutputEnv} {
+		if _, err := format.Encode([]any{"a"}); err == nil || !strings.Contains(err.Error(), "not an object") {
+			t.Errorf("%s: expected an error for an array, got %v", format, err)
+		}
+	}
+}
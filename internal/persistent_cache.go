@@ -0,0 +1,181 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// persistentCacheVersion is a part of every key, and must be changed whenever the format of entries or the way nodes
+// are resolved changes, so that entries made by other versions are never used.
+const persistentCacheVersion = "7"
+
+func init() {
+	// Values of these types can be held by objects, and therefore by entries, through interfaces.
+	gob.Register(map[string]any{})
+	gob.Register([]any{})
+	gob.Register(time.Time{})
+	gob.Register(json.Number(""))
+}
+
+// persistentCache stores resolved nodes in a directory, so that they are reused by other processes.
+// An entry is keyed by the node, i.e., its file name, the directory it is referenced from, the search paths, and the
+// policies for merging and ordering keys.
+// It records the hashes of the files the node depends on, as well as the files looked for in vain, and is used only
+// while none of them changes. Storing and using entries are best-effort, i.e., failures are treated as misses.
+type persistentCache struct {
+	directory string
+}
+
+type persistentCacheEntry struct {
+	Obj          map[string]any
+	KeyOrder     map[string][]string
+	Modules      []string
+	Dependencies []persistentCacheDependency
+	Absent       []string
+}
+
+type persistentCacheDependency struct {
+	File   string
+	SHA256 string
+}
+
+// path returns the file that holds the entry for a node.
+func (c *persistentCache) path(fsys FileSystem, key nodeCacheKey, searchPaths []string, rule MergeRule, policy KeyOrderPolicy) (string, error) {
+	h := sha256.New()
+	write := func(s string) {
+		h.Write([]byte(s))
+		h.Write([]byte{0})
+	}
+	write(persistentCacheVersion)
+	write(key.baseDir)
+	write(key.filename)
+	write(fmt.Sprintf("%#v", rule))
+	write(policy.String())
+	for _, each := range searchPaths {
+		// Relative search paths depend on the working directory.
+		abs, err := fsys.Abs(each)
+		if err != nil {
+			return "", err
+		}
+		write(abs)
+	}
+	return filepath.Join(c.directory, hex.EncodeToString(h.Sum(nil))), nil
+}
+
+// load returns the entry stored at path, if any, and if the files it depends on are unchanged.
+func (c *persistentCache) load(fsys FileSystem, path string) (nodeCacheEntry, bool) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nodeCacheEntry{}, false
+	}
+	var stored persistentCacheEntry
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&stored); err != nil {
+		return nodeCacheEntry{}, false
+	}
+	ret := nodeCacheEntry{value: NodeEntryValue{Obj: stored.Obj}}
+	if stored.KeyOrder != nil {
+		ret.value.KeyOrder = &KeyOrder{keys: stored.KeyOrder}
+	}
+	for _, each := range stored.Dependencies {
+		if sum, err := fileSHA256(fsys, each.File); err != nil || sum != each.SHA256 {
+			return nodeCacheEntry{}, false
+		}
+		ret.dependencies = append(ret.dependencies, each.File)
+	}
+	for _, each := range stored.Absent {
+		if _, err := fsys.Stat(each); !errors.Is(err, fs.ErrNotExist) {
+			return nodeCacheEntry{}, false
+		}
+	}
+	for _, each := range stored.Modules {
+		_, module, err := LoadFileAsRawJSONIn(fsys, each)
+		if err != nil || module == nil {
+			return nodeCacheEntry{}, false
+		}
+		ret.value.CompilerOptions = append(ret.value.CompilerOptions, module)
+	}
+	if ret.value.Obj == nil {
+		ret.value.Obj = map[string]any{}
+	}
+	return ret, true
+}
+
+// store stores entry at path, unless it depends on something other than the content of files, e.g. outputs of
+// scripts.
+func (c *persistentCache) store(fsys FileSystem, path string, entry nodeCacheEntry, absent []string) {
+	stored := persistentCacheEntry{Obj: entry.value.Obj, Absent: absent}
+	if entry.value.KeyOrder != nil {
+		stored.KeyOrder = entry.value.KeyOrder.keys
+	}
+	for _, each := range entry.dependencies {
+		if isLocalNodePath(each) {
+			// $local nodes are given by the files that define them, which are dependencies as well.
+			continue
+		}
+		data, err := fsys.ReadFile(each)
+		if err != nil {
+			// Script directives and directories listed for patterns are not files.
+			return
+		}
+		if ft, ok := detectFileType(each); ok && ft == HOCON && bytes.Contains(data, []byte("include")) {
+			// Files included by HOCON files are not known.
+			return
+		}
+		stored.Dependencies = append(stored.Dependencies, persistentCacheDependency{File: each, SHA256: sha256Hex(data)})
+	}
+	for _, each := range entry.value.CompilerOptions {
+		if each.Path == "" || isLocalNodePath(each.Path) {
+			return
+		}
+		stored.Modules = append(stored.Modules, each.Path)
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(stored); err != nil {
+		return
+	}
+	if err := os.MkdirAll(c.directory, 0o755); err != nil {
+		return
+	}
+	// The entry is renamed into place, so that other processes never see a partially written one.
+	f, err := os.CreateTemp(c.directory, ".tmp-*")
+	if err != nil {
+		return
+	}
+	_, err = f.Write(buf.Bytes())
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+	}
+}
+
+func isLocalNodePath(path string) bool {
+	return strings.HasPrefix(path, localNodeRoot+string(filepath.Separator))
+}
+
+func fileSHA256(fsys FileSystem, path string) (string, error) {
+	data, err := fsys.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return sha256Hex(data), nil
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
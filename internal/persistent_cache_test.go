@@ -0,0 +1,113 @@
+package internal
+
+import (
+	"encoding/json"
+	"github.com/dakusui/jqplusplus/internal/testutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestSession_CacheDirectory(t *testing.T) {
+	dir := t.TempDir()
+	lib := t.TempDir()
+	cacheDir := t.TempDir()
+	_ = testutil.WriteTempJSON(t, lib, "parent.yaml", "a: 1\nb: null\nc: [x, {d: 1.5}]\n")
+	_ = testutil.WriteTempJSON(t, lib, "more.toml", "e = 2\n")
+	_ = testutil.WriteTempJSON(t, lib, "m.jq", "def f: 1;")
+	_ = testutil.WriteTempJSON(t, dir, "child.json", `{"$extends": ["parent.yaml", "more.toml", "m.jq"], "g": 3}`)
+	options := SessionOptions{CacheDirectory: cacheDir}
+
+	expected, dependencies, err := NewSession([]string{lib}, SessionOptions{}).LoadAndResolveInheritances(dir, "child.json")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		result, d, err := NewSession([]string{lib}, options).LoadAndResolveInheritances(dir, "child.json")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !reflect.DeepEqual(result.Obj, expected.Obj) || !reflect.DeepEqual(d, dependencies) {
+			t.Errorf("expected %v (%v), got %v (%v)", expected.Obj, dependencies, result.Obj, d)
+		}
+		names := func(v *NodeEntryValue) []string {
+			return Map(v.CompilerOptions, func(m *JqModule) string { return m.Name })
+		}
+		if !reflect.DeepEqual(names(result), names(expected)) {
+			t.Errorf("expected modules %v, got %v", names(expected), names(result))
+		}
+	}
+
+	nodepool := newNodePool(dir, newOverlayFileSystem(OSFileSystem()), []string{lib}, newNodeCache())
+	nodepool.options = options
+	path, ok := nodepool.persistentCachePath(nodeCacheKey{NodeEntryKey: NewNodeEntryKey(dir, "child.json")})
+	if !ok {
+		t.Fatalf("expected the node to be stored")
+	}
+	cache := options.persistentCache()
+	if _, ok := cache.load(nodepool.fs, path); !ok {
+		t.Fatalf("expected an entry at %s", path)
+	}
+	// An entry is stale once a file it depends on changes, or a file looked for in vain appears.
+	_ = testutil.WriteTempJSON(t, dir, "more.toml", "e = 4\n")
+	if _, ok := cache.load(nodepool.fs, path); ok {
+		t.Errorf("expected a stale entry")
+	}
+	result, _, err := NewSession([]string{lib}, options).LoadAndResolveInheritances(dir, "child.json")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if result.Obj["e"] != json.Number("4") {
+		t.Errorf("expected the new value, got %v", result.Obj)
+	}
+	if err := os.Remove(filepath.Join(dir, "more.toml")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	_ = testutil.WriteTempJSON(t, lib, "more.toml", "e = 5\n")
+	result, _, err = NewSession([]string{lib}, options).LoadAndResolveInheritances(dir, "child.json")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if result.Obj["e"] != json.Number("5") {
+		t.Errorf("expected the changed value, got %v", result.Obj)
+	}
+}
+
+func TestSession_CacheDirectory_LocalNodes(t *testing.T) {
+	dir := t.TempDir()
+	cacheDir := t.TempDir()
+	_ = testutil.WriteTempJSON(t, dir, "child.json", `{"$local": {"l.json": {"a": 1}}, "x": {"$extends": ["l.json"]}}`)
+	for i := 0; i < 2; i++ {
+		result, _, err := NewSession([]string{}, SessionOptions{CacheDirectory: cacheDir}).LoadAndResolveInheritances(dir, "child.json")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if expected := map[string]any{"x": map[string]any{"a": json.Number("1")}}; !reflect.DeepEqual(result.Obj, expected) {
+			t.Errorf("expected %v, got %v", expected, result.Obj)
+		}
+	}
+}
+
+func TestSession_CacheDirectory_Patterns(t *testing.T) {
+	dir := t.TempDir()
+	cacheDir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "conf.d"), 0o755); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	_ = testutil.WriteTempJSON(t, dir, "conf.d/a.json", `{"a": 1}`)
+	_ = testutil.WriteTempJSON(t, dir, "child.json", `{"$extends": ["conf.d/*.json"]}`)
+	options := SessionOptions{CacheDirectory: cacheDir}
+	if _, _, err := NewSession([]string{}, options).LoadAndResolveInheritances(dir, "child.json"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// A file added to a directory listed for a pattern is inherited, i.e., nodes depending on patterns are not stored.
+	_ = testutil.WriteTempJSON(t, dir, "conf.d/b.json", `{"b": 2}`)
+	result, _, err := NewSession([]string{}, options).LoadAndResolveInheritances(dir, "child.json")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if expected := map[string]any{"a": json.Number("1"), "b": json.Number("2")}; !reflect.DeepEqual(result.Obj, expected) {
+		t.Errorf("expected %v, got %v", expected, result.Obj)
+	}
+}
@@ -0,0 +1,348 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Origin tells where a value was defined.
+type Origin struct {
+	// File is the resolved path of the file (or the script directive) that defined the value.
+	File string `json:"file"`
+	// Line is the 1-based line number of the value in File, or 0 if the loader cannot tell it.
+	Line int `json:"line,omitempty"`
+}
+
+func (o Origin) String() string {
+	if o.Line > 0 {
+		return fmt.Sprintf("%s:%d", o.File, o.Line)
+	}
+	return o.File
+}
+
+// ProvenanceEntry is the origin chain of a leaf.
+type ProvenanceEntry struct {
+	Path []any
+	// Origins lists the origins of the values given to the leaf, the effective one first, followed by the ones it
+	// overrides, in the order of precedence.
+	Origins []Origin
+}
+
+// Provenance records the origins of the leaves in an object, i.e., scalars, empty objects, and empty arrays.
+// The elements of arrays are recorded one by one, so that the ones of an array combined by a merge policy, e.g.,
+// MergePolicyAppend, keep the origins of the sides they come from.
+//
+// A Provenance is never modified once created, so that it can be shared among NodeEntryValues in a NodePool cache.
+// A nil *Provenance means provenance is not tracked, and its methods treat it as empty.
+type Provenance struct {
+	entries map[string]ProvenanceEntry
+}
+
+// newProvenance creates a Provenance whose leaves all come from file.
+// lines gives the line numbers of the leaves, keyed by pathKey, and may be nil.
+func newProvenance(obj map[string]any, file string, lines map[string]int) *Provenance {
+	ret := &Provenance{entries: map[string]ProvenanceEntry{}}
+	for _, p := range leafPaths(obj) {
+		k := pathKey(p)
+		ret.entries[k] = ProvenanceEntry{Path: p, Origins: []Origin{{File: file, Line: lines[k]}}}
+	}
+	return ret
+}
+
+// Lookup returns the origin chain of the leaf at path p.
+// If p is not a leaf recorded in the provenance, the chain of the nearest ancestor that is, is returned. This happens
+// when templating replaces a leaf with a container.
+// Otherwise, if p is a container, the origins of the leaves under it are returned, each once, in the order of their
+// paths.
+func (p *Provenance) Lookup(path []any) ([]Origin, bool) {
+	if p == nil {
+		return nil, false
+	}
+	for i := len(path); i >= 0; i-- {
+		if e, ok := p.entries[pathKey(path[:i])]; ok {
+			return e.Origins, true
+		}
+	}
+	var ret []Origin
+	for _, e := range p.EntriesUnder(path) {
+		for _, o := range e.Origins {
+			if !slices.Contains(ret, o) {
+				ret = append(ret, o)
+			}
+		}
+	}
+	return ret, len(ret) > 0
+}
+
+// Entries returns the recorded leaves sorted by their paths.
+func (p *Provenance) Entries() []ProvenanceEntry {
+	if p == nil {
+		return nil
+	}
+	ret := make([]ProvenanceEntry, 0, len(p.entries))
+	for _, e := range p.entries {
+		ret = append(ret, e)
+	}
+	return Sort(ret, func(a, b ProvenanceEntry) bool {
+		return lessPathArrays(a.Path, b.Path)
+	})
+}
+
+// EntriesUnder returns the recorded leaves at or under the path prefix, sorted by their paths.
+func (p *Provenance) EntriesUnder(prefix []any) []ProvenanceEntry {
+	return Filter(p.Entries(), func(e ProvenanceEntry) bool {
+		return isPathPrefix(prefix, e.Path)
+	})
+}
+
+// MarshalJSON renders the provenance as an object that maps path expressions to origin chains.
+func (p *Provenance) MarshalJSON() ([]byte, error) {
+	ret := map[string][]Origin{}
+	for _, e := range p.Entries() {
+		pe, err := PathArrayToPathExpression(e.Path)
+		if err != nil {
+			return nil, err
+		}
+		if pe == "" {
+			pe = "."
+		}
+		ret[pe] = e.Origins
+	}
+	return json.Marshal(ret)
+}
+
+// mergeProvenance returns the provenance of merged, the object MergeObjectsWithRules(loser, winner, rules) returns.
+// Chains of leaves defined on both sides are concatenated, winner's first.
+// See walkMerged for how the leaves in merged are matched with the ones of winner and loser.
+// If neither side tracks provenance, nil is returned.
+func mergeProvenance(merged, winner map[string]any, winnerProvenance *Provenance, loser map[string]any, loserProvenance *Provenance, rules MergeRules) *Provenance {
+	if winnerProvenance == nil && loserProvenance == nil {
+		return nil
+	}
+	ret := &Provenance{entries: map[string]ProvenanceEntry{}}
+	walkMerged(merged, loser, winner, rules, func(p []any, v any, loserPath, winnerPath []any) {
+		if len(p) == 0 || !isLeaf(v) {
+			return
+		}
+		var origins []Origin
+		if winnerPath != nil {
+			origins = append(origins, winnerProvenance.origins(winnerPath)...)
+		}
+		if loserPath != nil {
+			origins = append(origins, loserProvenance.origins(loserPath)...)
+		}
+		if len(origins) > 0 {
+			ret.entries[pathKey(p)] = ProvenanceEntry{Path: p, Origins: origins}
+		}
+	})
+	return ret
+}
+
+// origins returns the origin chain recorded for the leaf at path, or nil if there is none.
+func (p *Provenance) origins(path []any) []Origin {
+	if p == nil {
+		return nil
+	}
+	return p.entries[pathKey(path)].Origins
+}
+
+// restrictTo returns the provenance of the leaves that still exist in obj, e.g., after directives are removed from it.
+func (p *Provenance) restrictTo(obj map[string]any) *Provenance {
+	if p == nil {
+		return nil
+	}
+	ret := &Provenance{entries: map[string]ProvenanceEntry{}}
+	for _, path := range leafPaths(obj) {
+		if e, ok := p.entries[pathKey(path)]; ok {
+			ret.entries[pathKey(path)] = e
+		}
+	}
+	return ret
+}
+
+// Subtree returns the provenance of the node at prefix, with paths relative to it.
+func (p *Provenance) Subtree(prefix []any) *Provenance {
+	if p == nil {
+		return nil
+	}
+	ret := &Provenance{entries: map[string]ProvenanceEntry{}}
+	for _, e := range p.entries {
+		if isPathPrefix(prefix, e.Path) {
+			q := e.Path[len(prefix):]
+			ret.entries[pathKey(q)] = ProvenanceEntry{Path: q, Origins: e.Origins}
+		}
+	}
+	return ret
+}
+
+// graft returns a provenance in which the entries at and under prefix are replaced with sub, whose paths are relative
+// to prefix.
+func (p *Provenance) graft(prefix []any, sub *Provenance) *Provenance {
+	if p == nil {
+		return nil
+	}
+	ret := &Provenance{entries: map[string]ProvenanceEntry{}}
+	for k, e := range p.entries {
+		if !isPathPrefix(prefix, e.Path) {
+			ret.entries[k] = e
+		}
+	}
+	if sub != nil {
+		for _, e := range sub.entries {
+			q := append(append([]any{}, prefix...), e.Path...)
+			ret.entries[pathKey(q)] = ProvenanceEntry{Path: q, Origins: e.Origins}
+		}
+	}
+	return ret
+}
+
+// leafPaths returns the paths to the leaves in obj. See Provenance for what a leaf is.
+func leafPaths(obj map[string]any) [][]any {
+	var ret [][]any
+	var walk func(p []any, v any)
+	walk = func(p []any, v any) {
+		switch x := v.(type) {
+		case map[string]any:
+			if len(x) > 0 {
+				for k, w := range x {
+					walk(append(append([]any{}, p...), k), w)
+				}
+				return
+			}
+		case []any:
+			if len(x) > 0 {
+				for i, w := range x {
+					walk(append(append([]any{}, p...), i), w)
+				}
+				return
+			}
+		}
+		ret = append(ret, p)
+	}
+	for k, v := range obj {
+		walk([]any{k}, v)
+	}
+	return ret
+}
+
+// isLeaf tells if v is a leaf. See Provenance for what a leaf is.
+func isLeaf(v any) bool {
+	switch x := v.(type) {
+	case map[string]any:
+		return len(x) == 0
+	case []any:
+		return len(x) == 0
+	default:
+		return true
+	}
+}
+
+// loadLeafLines returns the line numbers of the leaves in a file in fsys, keyed by pathKey.
+// Only JSON and YAML files are supported; nil is returned for other files and for files that cannot be read.
+func loadLeafLines(fsys FileSystem, path string) map[string]int {
+	ft, ok := detectFileType(path)
+	if !ok || (ft != JSON && ft != YAML) {
+		return nil
+	}
+	data, err := fsys.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	if ft == JSON {
+		return jsonLeafLines(data)
+	}
+	return yamlLeafLines(data)
+}
+
+func jsonLeafLines(data []byte) map[string]int {
+	ret := map[string]int{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	var walk func(p []any) error
+	walk = func(p []any) error {
+		offset := dec.InputOffset()
+		for offset < int64(len(data)) && strings.IndexByte(" \t\r\n:,", data[offset]) >= 0 {
+			offset++
+		}
+		line := lineAt(data, offset)
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		switch tok {
+		case json.Delim('{'):
+			empty := true
+			for dec.More() {
+				empty = false
+				k, err := dec.Token()
+				if err != nil {
+					return err
+				}
+				if err := walk(append(append([]any{}, p...), k.(string))); err != nil {
+					return err
+				}
+			}
+			if _, err := dec.Token(); err != nil {
+				return err
+			}
+			if empty && len(p) > 0 {
+				ret[pathKey(p)] = line
+			}
+		case json.Delim('['):
+			i := 0
+			for ; dec.More(); i++ {
+				if err := walk(append(append([]any{}, p...), i)); err != nil {
+					return err
+				}
+			}
+			if _, err := dec.Token(); err != nil {
+				return err
+			}
+			if i == 0 && len(p) > 0 {
+				ret[pathKey(p)] = line
+			}
+		default:
+			ret[pathKey(p)] = line
+		}
+		return nil
+	}
+	if err := walk(documentRoot(bytes.HasPrefix(bytes.TrimLeft(data, " \t\r\n"), []byte("{")))); err != nil {
+		return nil
+	}
+	return ret
+}
+
+func yamlLeafLines(data []byte) map[string]int {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil || len(doc.Content) == 0 {
+		return nil
+	}
+	ret := map[string]int{}
+	var walk func(p []any, n *yaml.Node)
+	walk = func(p []any, n *yaml.Node) {
+		if n.Kind == yaml.AliasNode && n.Alias != nil {
+			n = n.Alias
+		}
+		if n.Kind == yaml.MappingNode && len(n.Content) > 0 {
+			for i := 0; i+1 < len(n.Content); i += 2 {
+				walk(append(append([]any{}, p...), n.Content[i].Value), n.Content[i+1])
+			}
+			return
+		}
+		if n.Kind == yaml.SequenceNode && len(n.Content) > 0 {
+			for i, each := range n.Content {
+				walk(append(append([]any{}, p...), i), each)
+			}
+			return
+		}
+		if len(p) > 0 {
+			ret[pathKey(p)] = n.Line
+		}
+	}
+	walk(documentRoot(doc.Content[0].Kind == yaml.MappingNode), doc.Content[0])
+	return ret
+}
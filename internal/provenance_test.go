@@ -0,0 +1,106 @@
+package internal
+
+import (
+	"encoding/json"
+	"github.com/dakusui/jqplusplus/internal/testutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLoadAndResolveInheritancesWithProvenance(t *testing.T) {
+	dir := t.TempDir()
+	grandparent := testutil.WriteTempJSON(t, dir, "grandparent.json", `{"a": 1, "b": {"c": 2}}`)
+	parent := testutil.WriteTempJSON(t, dir, "parent.yaml", "$extends:\n  - grandparent.json\nb:\n  c: 3\n")
+	child := testutil.WriteTempJSON(t, dir, "child.json", "{\n  \"$extends\": [\"parent.yaml\"],\n  \"d\": {\n    \"$extends\": [\"grandparent.json\"]\n  }\n}")
+	result, err := LoadAndResolveInheritancesWithProvenance(filepath.Dir(child), filepath.Base(child), []string{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := map[string][]Origin{
+		".a":     {{File: grandparent, Line: 1}},
+		".b.c":   {{File: parent, Line: 4}, {File: grandparent, Line: 1}},
+		".d.a":   {{File: grandparent, Line: 1}},
+		".d.b.c": {{File: grandparent, Line: 1}},
+	}
+	data, err := json.Marshal(result.Provenance)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var actual map[string][]Origin
+	if err := json.Unmarshal(data, &actual); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(expected, actual) {
+		t.Errorf("expected %v, got %v", expected, actual)
+	}
+}
+
+func TestLoadAndResolveInheritances_ProvenanceNotTracked(t *testing.T) {
+	dir := t.TempDir()
+	file := testutil.WriteTempJSON(t, dir, "base.json", `{"a": 1}`)
+	result, err := LoadAndResolveInheritances(filepath.Dir(file), filepath.Base(file), []string{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if result.Provenance != nil {
+		t.Errorf("expected no provenance, got %v", result.Provenance)
+	}
+}
+
+func TestProvenance_Lookup_FallsBackToAncestor(t *testing.T) {
+	provenance := newProvenance(map[string]any{"a": "eval:object:{}"}, "f.json", nil)
+	origins, ok := provenance.Lookup([]any{"a", "b"})
+	if !ok || !reflect.DeepEqual(origins, []Origin{{File: "f.json"}}) {
+		t.Errorf("unexpected origins: %v (%v)", origins, ok)
+	}
+}
+
+func TestJSONLeafLines(t *testing.T) {
+	lines := jsonLeafLines([]byte("{\n  \"a\": 1,\n  \"b\": {\n    \"c\": [\n      1\n    ],\n    \"d\": {}\n  }\n}"))
+	expected := map[string]int{
+		pathKey([]any{"a"}):         2,
+		pathKey([]any{"b", "c", 0}): 5,
+		pathKey([]any{"b", "d"}):    7,
+	}
+	if !reflect.DeepEqual(expected, lines) {
+		t.Errorf("expected %v, got %v", expected, lines)
+	}
+}
+
+func TestLoadAndResolveInheritancesWithProvenance_MergedArrays(t *testing.T) {
+	dir := t.TempDir()
+	base := testutil.WriteTempJSON(t, dir, "base.json", "{\n  \"servers\": [{\"name\": \"a\"}],\n  \"users\": [\n    {\"id\": 1, \"role\": \"dev\"},\n    {\"id\": 2, \"role\": \"dev\"}\n  ],\n  \"tags\": [\"x\"]\n}")
+	child := testutil.WriteTempJSON(t, dir, "child.json", `{
+  "$extends": ["base.json"],
+  "$merge": {".servers": "append", ".users": "mergeByKey:id", ".tags": "union"},
+  "servers": [{"name": "b"}],
+  "users": [{"id": 2, "role": "admin"}],
+  "tags": ["x", "y"]
+}`)
+	result, err := LoadAndResolveInheritancesWithProvenance(filepath.Dir(child), filepath.Base(child), []string{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := map[string][]Origin{
+		".servers[0].name": {{File: base, Line: 2}},
+		".servers[1].name": {{File: child, Line: 4}},
+		".users[0].id":     {{File: base, Line: 4}},
+		".users[0].role":   {{File: base, Line: 4}},
+		".users[1].id":     {{File: child, Line: 5}, {File: base, Line: 5}},
+		".users[1].role":   {{File: child, Line: 5}, {File: base, Line: 5}},
+		".tags[0]":         {{File: base, Line: 7}},
+		".tags[1]":         {{File: child, Line: 6}},
+	}
+	data, err := json.Marshal(result.Provenance)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var actual map[string][]Origin
+	if err := json.Unmarshal(data, &actual); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(expected, actual) {
+		t.Errorf("expected %v, got %v", expected, actual)
+	}
+}
@@ -0,0 +1,121 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// DefaultScriptTimeout is used when JF_SCRIPT_TIMEOUT is not set.
+const DefaultScriptTimeout = 60 * time.Second
+
+// ScriptDirective is a parsed script invocation directive found in "$extends" or "$includes", e.g. "SS.sh;bash -eu;dir1/J.json".
+//
+// The string is split by semicolons.
+// The first token is a program searched for in the same way as an inherited file, the second one is an interpreter with
+// which the program is executed, and the rest are passed to the program as arguments.
+type ScriptDirective struct {
+	Program string
+	// Interpreter is the command line of the interpreter. If empty, the program is executed directly.
+	Interpreter []string
+	Args        []string
+}
+
+// IsScriptDirective tells if a string in "$extends" or "$includes" should be treated as a script invocation directive.
+// By inserting one or more semicolons, the syntax is triggered.
+func IsScriptDirective(s string) bool {
+	return strings.Contains(s, ";")
+}
+
+// ParseScriptDirective parses a script invocation directive.
+func ParseScriptDirective(s string) (*ScriptDirective, error) {
+	tokens := strings.Split(s, ";")
+	program := strings.TrimSpace(tokens[0])
+	if program == "" {
+		return nil, fmt.Errorf("script directive has no program: %q", s)
+	}
+	ret := &ScriptDirective{Program: program}
+	if len(tokens) > 1 {
+		ret.Interpreter = strings.Fields(tokens[1])
+	}
+	if len(ret.Interpreter) == 1 && ret.Interpreter[0] == "SOURCE" {
+		return nil, fmt.Errorf("SOURCE directive is not supported: %q", s)
+	}
+	if len(tokens) > 2 {
+		ret.Args = tokens[2:]
+	}
+	return ret, nil
+}
+
+func (d *ScriptDirective) String() string {
+	return strings.Join(append([]string{d.Program, strings.Join(d.Interpreter, " ")}, d.Args...), ";")
+}
+
+// Run executes the program with its interpreter and returns the JSON value it prints to stdout, which is held at
+// ValueDirective if it is not an object.
+// The program is resolved from baseDir and searchPaths, and is executed in baseDir.
+// If the program does not finish within the timeout, it is killed and an error is returned.
+// Errors contain whatever the program wrote to stderr.
+func (d *ScriptDirective) Run(baseDir string, searchPaths []string, timeout time.Duration) (map[string]any, error) {
+	programPath, _, err := ResolveFilePath(d.Program, baseDir, searchPaths)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	commandLine := append(append(append([]string{}, d.Interpreter...), programPath), d.Args...)
+	cmd := exec.CommandContext(ctx, commandLine[0], commandLine[1:]...)
+	cmd.Dir = baseDir
+	// Do not wait for grandchildren that keep stdout or stderr open after the program is killed.
+	cmd.WaitDelay = time.Second
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err = cmd.Run()
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return nil, fmt.Errorf("script %q timed out after %s; stderr: %q", d.String(), timeout, stderr.String())
+	}
+	if err != nil {
+		return nil, fmt.Errorf("script %q failed: %w; stderr: %q", d.String(), err, stderr.String())
+	}
+	var v any
+	if err := UnmarshalJSON(stdout.Bytes(), &v); err != nil {
+		return nil, fmt.Errorf("script %q did not print a JSON value: %w; stderr: %q", d.String(), err, stderr.String())
+	}
+	obj := wrapDocument(v)
+	if obj == nil {
+		obj = map[string]any{}
+	}
+	return obj, nil
+}
+
+// ResolvedKey returns a string that identifies this directive regardless of the directory it is referenced from.
+// It is used for detecting circular inheritances.
+func (d *ScriptDirective) ResolvedKey(baseDir string, searchPaths []string) (string, string, error) {
+	programPath, programDir, err := ResolveFilePath(d.Program, baseDir, searchPaths)
+	if err != nil {
+		return "", "", err
+	}
+	return strings.Join(append([]string{programPath, strings.Join(d.Interpreter, " ")}, d.Args...), ";"), programDir, nil
+}
+
+// ScriptTimeout returns the timeout for script invocation directives, taken from JF_SCRIPT_TIMEOUT (e.g. "30s").
+// If the variable is invalid, DefaultScriptTimeout is returned along with an error telling so, which the caller may
+// report as a warning.
+func ScriptTimeout() (time.Duration, error) {
+	v, ok := os.LookupEnv("JF_SCRIPT_TIMEOUT")
+	if !ok {
+		return DefaultScriptTimeout, nil
+	}
+	ret, err := time.ParseDuration(v)
+	if err != nil || ret <= 0 {
+		return DefaultScriptTimeout, fmt.Errorf("invalid JF_SCRIPT_TIMEOUT: %q, falling back to %s", v, DefaultScriptTimeout)
+	}
+	return ret, nil
+}
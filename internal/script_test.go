@@ -0,0 +1,90 @@
+package internal
+
+import (
+	"encoding/json"
+	"github.com/dakusui/jqplusplus/internal/testutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseScriptDirective(t *testing.T) {
+	d, err := ParseScriptDirective("SS.sh;bash -eu;dir1/J.json;x")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := &ScriptDirective{Program: "SS.sh", Interpreter: []string{"bash", "-eu"}, Args: []string{"dir1/J.json", "x"}}
+	if !reflect.DeepEqual(d, expected) {
+		t.Errorf("expected %v, got %v", expected, d)
+	}
+}
+
+func TestParseScriptDirective_Source_ThenFail(t *testing.T) {
+	_, err := ParseScriptDirective("SS.sh;SOURCE")
+	if err == nil || !strings.Contains(err.Error(), "SOURCE") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestLoadAndResolveInheritances_ScriptDirective(t *testing.T) {
+	dir := t.TempDir()
+	_ = testutil.WriteTempJSON(t, dir, "gen.sh", `echo "{\"a\": \"$1\", \"b\": 2}"`)
+	child := testutil.WriteTempJSON(t, dir, "child.json", `{"$extends": ["gen.sh;bash -eu;hello"], "b": 3}`)
+	result, err := LoadAndResolveInheritances(filepath.Dir(child), filepath.Base(child), []string{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := map[string]any{"a": "hello", "b": json.Number("3")}
+	if !reflect.DeepEqual(result.Obj, expected) {
+		t.Errorf("expected %v, got %v", expected, result.Obj)
+	}
+}
+
+func TestLoadAndResolveInheritances_ScriptDirectiveFromSearchPath(t *testing.T) {
+	dir := t.TempDir()
+	scriptDir := t.TempDir()
+	_ = testutil.WriteTempJSON(t, scriptDir, "gen.sh", `echo '{"a": 1}'`)
+	child := testutil.WriteTempJSON(t, dir, "child.json", `{"x": {"$extends": ["gen.sh;bash"]}}`)
+	result, err := LoadAndResolveInheritances(filepath.Dir(child), filepath.Base(child), []string{scriptDir})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := map[string]any{"x": map[string]any{"a": json.Number("1")}}
+	if !reflect.DeepEqual(result.Obj, expected) {
+		t.Errorf("expected %v, got %v", expected, result.Obj)
+	}
+}
+
+func TestLoadAndResolveInheritances_ScriptDirectiveFailing_ThenFail(t *testing.T) {
+	dir := t.TempDir()
+	_ = testutil.WriteTempJSON(t, dir, "gen.sh", `echo "something went wrong" >&2; exit 3`)
+	child := testutil.WriteTempJSON(t, dir, "child.json", `{"$extends": ["gen.sh;bash -eu"]}`)
+	_, err := LoadAndResolveInheritances(filepath.Dir(child), filepath.Base(child), []string{})
+	if err == nil || !strings.Contains(err.Error(), "exit status 3") || !strings.Contains(err.Error(), "something went wrong") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestLoadAndResolveInheritances_ScriptDirectiveTimeout_ThenFail(t *testing.T) {
+	t.Setenv("JF_SCRIPT_TIMEOUT", "100ms")
+	dir := t.TempDir()
+	_ = testutil.WriteTempJSON(t, dir, "gen.sh", `echo "sleeping" >&2; sleep 5; echo '{}'`)
+	child := testutil.WriteTempJSON(t, dir, "child.json", `{"$extends": ["gen.sh;bash -eu"]}`)
+	_, err := LoadAndResolveInheritances(filepath.Dir(child), filepath.Base(child), []string{})
+	if err == nil || !strings.Contains(err.Error(), "timed out after 100ms") || !strings.Contains(err.Error(), "sleeping") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestScriptTimeout(t *testing.T) {
+	t.Setenv("JF_SCRIPT_TIMEOUT", "2m")
+	if timeout, err := ScriptTimeout(); err != nil || timeout != 2*time.Minute {
+		t.Errorf("unexpected result: %v, %v", timeout, err)
+	}
+	t.Setenv("JF_SCRIPT_TIMEOUT", "soon")
+	if timeout, err := ScriptTimeout(); err == nil || !strings.Contains(err.Error(), "invalid JF_SCRIPT_TIMEOUT") || timeout != DefaultScriptTimeout {
+		t.Errorf("unexpected result: %v, %v", timeout, err)
+	}
+}
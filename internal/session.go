@@ -0,0 +1,113 @@
+package internal
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// Session loads targets one after another, sharing the nodes resolved for a target with the following ones, so that
+// parents common to many targets are parsed only once.
+type Session struct {
+	searchPaths []string
+	options     SessionOptions
+	cache       *nodeCache
+	// local holds the $local nodes of all the targets in memory, over the file system of the options.
+	local *overlayFileSystem
+}
+
+// SessionOptions configures how a Session loads files.
+type SessionOptions struct {
+	// TracksProvenance makes loaded values carry their Provenance.
+	TracksProvenance bool
+	// DefaultMergeRule is the rule for merging parents into a node whose "$merge" directive gives no rule for the node
+	// itself. The zero value is MergePolicyDefault.
+	DefaultMergeRule MergeRule
+	// KeyOrderPolicy tells how the keys of a node are ordered relative to the ones it inherits. The zero value is
+	// KeyOrderInheritedFirst.
+	KeyOrderPolicy KeyOrderPolicy
+	// Loaders are used for files with the extensions they are keyed by (e.g. ".ini"), in preference to the built-in
+	// ones.
+	Loaders map[string]FileLoader
+	// FileSystem is where files are loaded from. If nil, the OS's one is used.
+	// Programs of script directives and schemas for validation are always read from the OS.
+	FileSystem FileSystem
+	// CacheDirectory is a directory in which resolved nodes are stored, so that other sessions, even in other
+	// processes, use them as long as the files they depend on are unchanged. If empty, nodes are not stored.
+	// Nodes are not stored while provenance is tracked or Loaders are given.
+	CacheDirectory string
+}
+
+func (o SessionOptions) persistentCache() *persistentCache {
+	return &persistentCache{directory: o.CacheDirectory}
+}
+
+// FileLoader parses the content of a file into a JSON-compatible map. name is the path of the file.
+type FileLoader func(data []byte, name string) (map[string]any, error)
+
+// NewSession creates a Session that searches for files to be inherited in searchPaths.
+func NewSession(searchPaths []string, options SessionOptions) *Session {
+	fsys := options.FileSystem
+	if fsys == nil {
+		fsys = OSFileSystem()
+	}
+	return &Session{
+		searchPaths: searchPaths,
+		options:     options,
+		cache:       newNodeCache(),
+		local:       newOverlayFileSystem(fsys),
+	}
+}
+
+// LoadAndResolveInheritances loads a target and resolves its inheritances, like the function of the same name.
+// The absolute paths of the files the result depends on are returned as well, even on failure, as far as they are
+// known.
+func (s *Session) LoadAndResolveInheritances(baseDir string, filename string) (*NodeEntryValue, []string, error) {
+	baseDir, err := s.local.Abs(baseDir)
+	if err != nil {
+		return nil, nil, err
+	}
+	nodepool := newNodePool(baseDir, s.local, s.searchPaths, s.cache)
+	nodepool.options = s.options
+	ret, err := nodepool.ReadNodeEntryValue(baseDir, filename, []*JqModule{})
+	return s.result(nodepool, filename, ret, err)
+}
+
+// LoadAndResolveInheritancesOfData works like LoadAndResolveInheritances for a target whose content is given as data
+// rather than read from a file.
+// name is the path the content is supposed to be at, against which relative parents are resolved. It does not need
+// to exist. The result is not cached, since the content may differ from the one of the file at name.
+// The content is parsed by the loader in Loaders keyed by ft prefixed with a dot (e.g. ".ini" for "ini"), if any, or as
+// ft otherwise.
+func (s *Session) LoadAndResolveInheritancesOfData(name string, data []byte, ft FileType) (*NodeEntryValue, []string, error) {
+	absPath, err := s.local.Abs(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	nodepool := newNodePool(filepath.Dir(absPath), s.local, s.searchPaths, s.cache)
+	nodepool.options = s.options
+	// The content is visible at name to this traversal only, e.g. for the line numbers of its provenance.
+	root := newOverlayFileSystem(s.local)
+	root.writeFile(absPath, data)
+	nodepool.fs = root
+	ret, err := loadAndResolveNode(absPath, filepath.Dir(absPath), func() (map[string]any, *JqModule, error) {
+		if loader, ok := s.options.Loaders["."+strings.ToLower(string(ft))]; ok {
+			obj, err := loader(data, absPath)
+			return withNormalizedNumbers(obj, nil, err)
+		}
+		return ParseRawJSON(data, absPath, ft)
+	}, nodepool)
+	return s.result(nodepool, name, ret, err)
+}
+
+// result makes the return values of the load methods from the ones of a load through nodepool.
+func (s *Session) result(nodepool *NodePoolImpl, filename string, ret *NodeEntryValue, err error) (*NodeEntryValue, []string, error) {
+	if err != nil {
+		if _, ok := asLocatedError(err); !ok {
+			return nil, nodepool.VisitedFiles(), &LoadError{File: filename, Err: err}
+		}
+		return nil, nodepool.VisitedFiles(), err
+	}
+	// The object is copied since the caller may modify it, while the cache holds it for the following targets.
+	ret.Obj = DeepCopyAs(ret.Obj)
+	return ret, nodepool.VisitedFiles(), nil
+}
@@ -0,0 +1,131 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/dakusui/jqplusplus/internal/testutil"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSession_SharesParentsAmongTargets(t *testing.T) {
+	dir := t.TempDir()
+	parent := testutil.WriteTempJSON(t, dir, "parent.json", `{"a": 1}`)
+	first := testutil.WriteTempJSON(t, dir, "first.json", `{"$extends": ["parent.json"], "b": 2}`)
+	second := testutil.WriteTempJSON(t, dir, "second.json", `{"$extends": ["parent.json"], "c": 3}`)
+	session := NewSession([]string{}, SessionOptions{})
+
+	result, _, err := session.LoadAndResolveInheritances(dir, "first.json")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// Modifying a result must not affect the following targets.
+	result.Obj["a"] = "modified"
+	// The parent is not parsed again, so a change to it is not visible in the same session.
+	_ = testutil.WriteTempJSON(t, dir, "parent.json", `{"a": 100}`)
+
+	result, dependencies, err := session.LoadAndResolveInheritances(dir, "second.json")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if expected := map[string]any{"a": json.Number("1"), "c": json.Number("3")}; !reflect.DeepEqual(result.Obj, expected) {
+		t.Errorf("expected %v, got %v", expected, result.Obj)
+	}
+	if expected := []string{parent, second}; !reflect.DeepEqual(dependencies, expected) {
+		t.Errorf("expected dependencies %v, got %v", expected, dependencies)
+	}
+	_, dependencies, err = session.LoadAndResolveInheritances(dir, "first.json")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if expected := []string{first, parent}; !reflect.DeepEqual(dependencies, expected) {
+		t.Errorf("expected dependencies %v, got %v", expected, dependencies)
+	}
+}
+
+func TestSession_LocalNodesOfDifferentTargets(t *testing.T) {
+	dir := t.TempDir()
+	_ = testutil.WriteTempJSON(t, dir, "first.json", `{"$local": {"l.json": {"a": 1}}, "x": {"$extends": ["l.json"]}}`)
+	_ = testutil.WriteTempJSON(t, dir, "second.json", `{"$local": {"l.json": {"a": 2}}, "x": {"$extends": ["l.json"]}}`)
+	session := NewSession([]string{}, SessionOptions{})
+
+	for _, each := range []struct {
+		filename string
+		expected any
+	}{{"first.json", json.Number("1")}, {"second.json", json.Number("2")}} {
+		result, _, err := session.LoadAndResolveInheritances(dir, each.filename)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if v, _ := GetAtPath(result.Obj, []any{"x", "a"}); v != each.expected {
+			t.Errorf("%s: expected %v, got %v", each.filename, each.expected, v)
+		}
+	}
+}
+
+func TestSession_ConcurrentLoads(t *testing.T) {
+	dir := t.TempDir()
+	_ = testutil.WriteTempJSON(t, dir, "grandparent.json", `{"a": {"b": 1, "c": [1, 2]}}`)
+	_ = testutil.WriteTempJSON(t, dir, "parent.json", `{"$extends": ["grandparent.json"], "$delete": [".a.c"], "d": 2}`)
+	const n = 16
+	for i := 0; i < n; i++ {
+		_ = testutil.WriteTempJSON(t, dir, fmt.Sprintf("target%d.json", i), fmt.Sprintf(`{"$extends": ["parent.json"], "a": {"i": %d}}`, i))
+	}
+	session := NewSession([]string{}, SessionOptions{})
+
+	var wg sync.WaitGroup
+	results := make([]map[string]any, n)
+	errs := make([]error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			v, _, err := session.LoadAndResolveInheritances(dir, fmt.Sprintf("target%d.json", i))
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			results[i] = v.Obj
+		}(i)
+	}
+	wg.Wait()
+	for i := 0; i < n; i++ {
+		if errs[i] != nil {
+			t.Fatalf("unexpected error: %v", errs[i])
+		}
+		expected := map[string]any{"a": map[string]any{"b": json.Number("1"), "i": json.Number(strconv.Itoa(i))}, "d": json.Number("2")}
+		if !reflect.DeepEqual(results[i], expected) {
+			t.Errorf("target%d: expected %v, got %v", i, expected, results[i])
+		}
+	}
+}
+
+func TestSession_ConcurrentCircularInheritance_ThenError(t *testing.T) {
+	dir := t.TempDir()
+	_ = testutil.WriteTempJSON(t, dir, "a.json", `{"$extends": ["b.json"]}`)
+	_ = testutil.WriteTempJSON(t, dir, "b.json", `{"$extends": ["a.json"]}`)
+	for round := 0; round < 20; round++ {
+		session := NewSession([]string{}, SessionOptions{})
+		done := make(chan error, 2)
+		for _, each := range []string{"a.json", "b.json"} {
+			go func(filename string) {
+				_, _, err := session.LoadAndResolveInheritances(dir, filename)
+				done <- err
+			}(each)
+		}
+		for i := 0; i < 2; i++ {
+			select {
+			case err := <-done:
+				if err == nil || !strings.Contains(err.Error(), "circular") {
+					t.Errorf("expected a circular inheritance error, got %v", err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("loads did not finish")
+			}
+		}
+	}
+}
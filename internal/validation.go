@@ -0,0 +1,189 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/santhosh-tekuri/jsonschema/v6"
+	"golang.org/x/text/language"
+	"golang.org/x/text/message"
+)
+
+// SchemaKey is the key through which a rendered object declares the JSON Schema it should conform to.
+const SchemaKey = "$schema"
+
+// ErrSchemaNotLocal is returned by ValidateWithSchemaKey when "$schema" does not name a local file, e.g., when it is a
+// URL, which is not fetched.
+var ErrSchemaNotLocal = errors.New("schema is not a local file")
+
+// ValidationMode controls how the validation stage treats schema violations.
+type ValidationMode int
+
+const (
+	// ValidationNo skips validation entirely.
+	ValidationNo ValidationMode = iota
+	// ValidationStrict makes any violation an error.
+	ValidationStrict
+	// ValidationLenient reports violations as warnings only.
+	ValidationLenient
+)
+
+func (m ValidationMode) String() string {
+	switch m {
+	case ValidationNo:
+		return "no"
+	case ValidationStrict:
+		return "strict"
+	case ValidationLenient:
+		return "lenient"
+	default:
+		return "unknown"
+	}
+}
+
+// ParseValidationMode converts a command-line value (`no`, `strict`, or `lenient`) into a ValidationMode.
+func ParseValidationMode(s string) (ValidationMode, error) {
+	switch s {
+	case "no":
+		return ValidationNo, nil
+	case "strict":
+		return ValidationStrict, nil
+	case "lenient":
+		return ValidationLenient, nil
+	default:
+		return ValidationNo, fmt.Errorf("unknown validation mode: %q (expected one of no, strict, lenient)", s)
+	}
+}
+
+// Violation is a single schema violation found in a rendered object.
+type Violation struct {
+	// Path is a path array pointing to the offending node.
+	Path    []any
+	Message string
+}
+
+func (v Violation) String() string {
+	p, err := PathArrayToPathExpression(v.Path)
+	if err != nil || p == "" {
+		p = "."
+	}
+	return p + ": " + v.Message
+}
+
+// ValidateWithSchemaKey validates a rendered object against the schema named by its "$schema" key.
+//
+// The schema file is resolved in the same way as files referenced by "$extends", i.e., from baseDir first and then from
+// searchPaths.
+// The object is validated without the "$schema" key itself, which is left in it, so that a rendered object does not
+// depend on whether it is validated.
+// If the object has no "$schema" key, no violations are returned.
+// If the key is a URL, an error wrapping ErrSchemaNotLocal is returned, so that the caller can skip the validation.
+//
+// The returned error is reserved for problems with the schema itself (missing, malformed, etc.); violations found in
+// the object are returned as a slice, sorted by their paths.
+func ValidateWithSchemaKey(obj map[string]any, baseDir string, searchPaths []string) ([]Violation, error) {
+	schemaRef, ok := obj[SchemaKey]
+	if !ok {
+		return nil, nil
+	}
+	schemaFile, ok := schemaRef.(string)
+	if !ok {
+		return nil, fmt.Errorf("%s must be a string: %v", SchemaKey, schemaRef)
+	}
+	if u, err := url.Parse(schemaFile); err == nil && len(u.Scheme) > 1 {
+		// A scheme of a single letter is taken for a drive letter.
+		return nil, fmt.Errorf("%w: %s", ErrSchemaNotLocal, schemaFile)
+	}
+	absPath, _, err := ResolveFilePath(schemaFile, baseDir, searchPaths)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve schema: %w", err)
+	}
+	instance := maps.Clone(obj)
+	delete(instance, SchemaKey)
+	return ValidateAgainstSchemaFile(instance, absPath)
+}
+
+// ValidateAgainstSchemaFile validates obj against the JSON Schema stored in schemaFile, which must be an absolute path.
+// Any format readable by LoadFileAsRawJSON can be used for the schema.
+func ValidateAgainstSchemaFile(obj map[string]any, schemaFile string) ([]Violation, error) {
+	doc, _, err := LoadFileAsRawJSON(schemaFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load schema %s: %w", schemaFile, err)
+	}
+	compiler := jsonschema.NewCompiler()
+	if err := compiler.AddResource(schemaFile, doc); err != nil {
+		return nil, fmt.Errorf("failed to add schema %s: %w", schemaFile, err)
+	}
+	schema, err := compiler.Compile(schemaFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compile schema %s: %w", schemaFile, err)
+	}
+	err = schema.Validate(obj)
+	if err == nil {
+		return nil, nil
+	}
+	var validationError *jsonschema.ValidationError
+	if !errors.As(err, &validationError) {
+		return nil, err
+	}
+	// The POSIX variant prints numbers without grouping their digits, i.e., as they are written in documents.
+	printer := message.NewPrinter(language.MustParse("en-US-POSIX"))
+	var violations []Violation
+	collectViolations(obj, validationError, printer, &violations)
+	sort.SliceStable(violations, func(i, j int) bool {
+		return lessPathArrays(violations[i].Path, violations[j].Path)
+	})
+	return violations, nil
+}
+
+// collectViolations flattens the tree of validation errors into its leaves, each of which is a concrete violation.
+func collectViolations(root any, e *jsonschema.ValidationError, printer *message.Printer, out *[]Violation) {
+	if len(e.Causes) == 0 {
+		*out = append(*out, Violation{
+			Path:    instanceLocationToPathArray(root, e.InstanceLocation),
+			Message: e.ErrorKind.LocalizedString(printer),
+		})
+		return
+	}
+	for _, c := range e.Causes {
+		collectViolations(root, c, printer, out)
+	}
+}
+
+// instanceLocationToPathArray converts JSON Pointer tokens into a path array, turning tokens that index arrays into ints.
+func instanceLocationToPathArray(root any, tokens []string) []any {
+	ret := make([]any, 0, len(tokens))
+	cur := root
+	for _, t := range tokens {
+		if arr, ok := cur.([]any); ok {
+			if i, err := strconv.Atoi(t); err == nil {
+				ret = append(ret, i)
+				if i >= 0 && i < len(arr) {
+					cur = arr[i]
+				} else {
+					cur = nil
+				}
+				continue
+			}
+		}
+		ret = append(ret, t)
+		if m, ok := cur.(map[string]any); ok {
+			cur = m[t]
+		} else {
+			cur = nil
+		}
+	}
+	return ret
+}
+
+// FormatViolations renders violations one per line, prefixed with indent.
+func FormatViolations(violations []Violation, indent string) string {
+	return strings.Join(Map(violations, func(v Violation) string {
+		return indent + v.String()
+	}), "\n")
+}
@@ -0,0 +1,118 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/dakusui/jqplusplus/internal/testutil"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testSchema = `{
+  "type": "object",
+  "properties": {
+    "name": {"type": "string"},
+    "ports": {"type": "array", "items": {"type": "integer"}}
+  },
+  "required": ["name"]
+}`
+
+func TestValidateWithSchemaKey_Valid(t *testing.T) {
+	dir := t.TempDir()
+	_ = testutil.WriteTempJSON(t, dir, "schema.json", testSchema)
+	obj := map[string]any{"$schema": "schema.json", "name": "web", "ports": []any{float64(80)}}
+	violations, err := ValidateWithSchemaKey(obj, dir, []string{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(violations) != 0 {
+		t.Errorf("expected no violations, got %v", violations)
+	}
+	expected := map[string]any{"$schema": "schema.json", "name": "web", "ports": []any{float64(80)}}
+	if !reflect.DeepEqual(obj, expected) {
+		t.Errorf("expected %v to be left as it is", obj)
+	}
+}
+
+func TestValidateWithSchemaKey_ReportsEveryViolationWithPath(t *testing.T) {
+	dir := t.TempDir()
+	_ = testutil.WriteTempJSON(t, dir, "schema.json", testSchema)
+	obj := map[string]any{"$schema": "schema.json", "ports": []any{float64(80), "http"}}
+	violations, err := ValidateWithSchemaKey(obj, dir, []string{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(violations) != 2 {
+		t.Fatalf("expected 2 violations, got %v", violations)
+	}
+	if !reflect.DeepEqual(violations[0].Path, []any{}) || !strings.Contains(violations[0].Message, "name") {
+		t.Errorf("unexpected violation: %v", violations[0])
+	}
+	if !strings.HasPrefix(violations[1].String(), ".ports[1]: ") {
+		t.Errorf("unexpected violation: %v", violations[1])
+	}
+}
+
+func TestValidateWithSchemaKey_SchemaFromSearchPath(t *testing.T) {
+	dir := t.TempDir()
+	schemaDir := t.TempDir()
+	_ = testutil.WriteTempJSON(t, schemaDir, "schema.json", testSchema)
+	obj := map[string]any{"$schema": "schema.json", "name": 1}
+	violations, err := ValidateWithSchemaKey(obj, dir, []string{schemaDir})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(violations) != 1 || !strings.HasPrefix(violations[0].String(), ".name: ") {
+		t.Errorf("unexpected violations: %v", violations)
+	}
+}
+
+func TestValidateWithSchemaKey_NumbersNotGrouped(t *testing.T) {
+	dir := t.TempDir()
+	_ = testutil.WriteTempJSON(t, dir, "schema.json", `{"properties": {"n": {"maximum": 100}}}`)
+	obj := map[string]any{"$schema": "schema.json", "n": json.Number("1000")}
+	violations, err := ValidateWithSchemaKey(obj, dir, []string{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(violations) != 1 || violations[0].String() != ".n: maximum: got 1000, want 100" {
+		t.Errorf("unexpected violations: %v", violations)
+	}
+}
+
+func TestValidateWithSchemaKey_NoSchemaKey(t *testing.T) {
+	obj := map[string]any{"a": "b"}
+	violations, err := ValidateWithSchemaKey(obj, t.TempDir(), []string{})
+	if err != nil || len(violations) != 0 {
+		t.Errorf("unexpected result: %v, %v", violations, err)
+	}
+}
+
+func TestValidateWithSchemaKey_URL_ThenNotLocal(t *testing.T) {
+	obj := map[string]any{"$schema": "https://json-schema.org/draft/2020-12/schema"}
+	_, err := ValidateWithSchemaKey(obj, t.TempDir(), []string{})
+	if !errors.Is(err, ErrSchemaNotLocal) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestValidateWithSchemaKey_MissingSchema_ThenFail(t *testing.T) {
+	obj := map[string]any{"$schema": "missing.json"}
+	_, err := ValidateWithSchemaKey(obj, t.TempDir(), []string{})
+	if err == nil || !strings.Contains(err.Error(), "file not found") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestParseValidationMode(t *testing.T) {
+	for _, m := range []ValidationMode{ValidationNo, ValidationStrict, ValidationLenient} {
+		parsed, err := ParseValidationMode(m.String())
+		if err != nil || parsed != m {
+			t.Errorf("failed to round-trip %v: %v, %v", m, parsed, err)
+		}
+	}
+	if _, err := ParseValidationMode("unknown"); err == nil {
+		t.Errorf("expected error for unknown mode")
+	}
+}
@@ -0,0 +1,53 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+// ReadSlurpFile reads all the JSON values in a file into an array, as `jq --slurpfile` does.
+func ReadSlurpFile(filename string) ([]any, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+	ret := []any{}
+	dec := json.NewDecoder(f)
+	dec.UseNumber()
+	for {
+		var v any
+		if err := dec.Decode(&v); err != nil {
+			if errors.Is(err, io.EOF) {
+				return ret, nil
+			}
+			return nil, fmt.Errorf("failed to read %s: %w", filename, err)
+		}
+		ret = append(ret, v)
+	}
+}
+
+// AllowedEnviron returns the entries in environ, each of which is "NAME=value", whose names match any of patterns.
+// A pattern is either a name or a glob understood by path.Match, e.g., "APP_*".
+// The result is never nil, so that nothing from the environment is visible to expressions unless allowed.
+func AllowedEnviron(environ []string, patterns []string) ([]string, error) {
+	for _, p := range patterns {
+		if _, err := path.Match(p, ""); err != nil {
+			return nil, fmt.Errorf("invalid environment variable pattern: %q: %w", p, err)
+		}
+	}
+	return Filter(append([]string{}, environ...), func(kv string) bool {
+		name, _, _ := strings.Cut(kv, "=")
+		for _, p := range patterns {
+			if ok, _ := path.Match(p, name); ok {
+				return true
+			}
+		}
+		return false
+	}), nil
+}
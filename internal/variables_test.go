@@ -0,0 +1,57 @@
+package internal
+
+import (
+	"encoding/json"
+	"github.com/dakusui/jqplusplus/internal/testutil"
+	"reflect"
+	"testing"
+)
+
+func TestReadSlurpFile(t *testing.T) {
+	dir := t.TempDir()
+	file := testutil.WriteTempJSON(t, dir, "values.json", "1\n\"x\" {\"a\": [true]}\n")
+	result, err := ReadSlurpFile(file)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(result, []any{json.Number("1"), "x", map[string]any{"a": []any{true}}}) {
+		t.Errorf("unexpected result: %v", result)
+	}
+}
+
+func TestReadSlurpFile_Broken_ThenError(t *testing.T) {
+	dir := t.TempDir()
+	file := testutil.WriteTempJSON(t, dir, "values.json", `1 {`)
+	if _, err := ReadSlurpFile(file); err == nil {
+		t.Errorf("expected an error")
+	}
+}
+
+func TestAllowedEnviron(t *testing.T) {
+	environ := []string{"HOME=/root", "APP_A=1", "APP_B=2", "SECRET=x"}
+	result, err := AllowedEnviron(environ, []string{"HOME", "APP_*"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(result, []string{"HOME=/root", "APP_A=1", "APP_B=2"}) {
+		t.Errorf("unexpected result: %v", result)
+	}
+	result, err = AllowedEnviron(environ, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if result == nil || len(result) != 0 {
+		t.Errorf("expected an empty, non-nil environment, got %#v", result)
+	}
+}
+
+func TestApplyJQExpression_Environ(t *testing.T) {
+	spec := NewInvocationSpecBuilder().SetEnviron([]string{"A=1"}).Build()
+	result, err := ApplyJQExpression(nil, `[$ENV.A, env.B]`, []JSONType{Array}, *spec)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(result, []any{"1", nil}) {
+		t.Errorf("unexpected result: %v", result)
+	}
+}
@@ -0,0 +1,249 @@
+// Package jqpp renders jq++ files in process, for Go programs that embed jq++.
+//
+// A Renderer is configured once with options and can then be used by multiple goroutines:
+//
+//	r, err := jqpp.NewRenderer(jqpp.WithSearchPaths("/etc/app/base"), jqpp.WithVariable("env", "prod"))
+//	if err != nil {
+//		return err
+//	}
+//	result, err := r.Render(ctx, "app.json")
+package jqpp
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/dakusui/jqplusplus/internal"
+)
+
+// DefaultTTL is the default number of times templating is applied to a value, i.e., the levels of nested templating.
+// It is the same as the default of the command line tool.
+const DefaultTTL = internal.DefaultNestedTemplatingLevels
+
+// Format is the format of a document given to RenderBytes.
+// Besides the constants, the extension of a loader given by WithLoader without the dot (e.g. "ini" for ".ini") selects
+// the loader.
+type Format string
+
+const (
+	// FormatAuto detects the format from the extension of the name of a document, preferring the loaders given by
+	// WithLoader to the built-in ones.
+	FormatAuto  Format = ""
+	FormatJSON  Format = "json"
+	FormatYAML  Format = "yaml"
+	FormatTOML  Format = "toml"
+	FormatJSON5 Format = "json5"
+	FormatHOCON Format = "hocon"
+	FormatHCL   Format = "hcl"
+)
+
+// Loader parses the content of a file into a JSON-compatible map. name is the path of the file.
+type Loader func(data []byte, name string) (map[string]any, error)
+
+// LocatedError is implemented by errors that tell where in the input they occurred, such as syntax errors in a file
+// and errors in an "eval:" expression.
+// Use errors.As to find one in an error returned by a Renderer.
+type LocatedError interface {
+	error
+	// Location returns a file, and a line or a path in it, e.g., "app.json:3" or "app.json: .a.b".
+	Location() string
+	// Detail returns the error without its location.
+	Detail() string
+}
+
+// Renderer renders jq++ files. It is safe for concurrent use.
+type Renderer struct {
+	searchPaths      []string
+	variables        map[string]any
+	allowedEnv       []string
+	ttl              int
+	mergeRule        internal.MergeRule
+	loaders          map[string]internal.FileLoader
+	tracksProvenance bool
+	fileSystem       internal.FileSystem
+}
+
+// Option configures a Renderer.
+type Option func(r *Renderer) error
+
+// NewRenderer creates a Renderer configured by options.
+// Unless WithSearchPaths is given, files to be inherited are searched for in the directories in JF_PATH, as the
+// command line tool does.
+func NewRenderer(options ...Option) (*Renderer, error) {
+	ret := &Renderer{
+		searchPaths: internal.SearchPaths(),
+		variables:   map[string]any{},
+		ttl:         DefaultTTL,
+		loaders:     map[string]internal.FileLoader{},
+	}
+	for _, each := range options {
+		if err := each(ret); err != nil {
+			return nil, err
+		}
+	}
+	return ret, nil
+}
+
+// WithSearchPaths sets the directories in which files to be inherited are searched for, after the directory of the
+// file inheriting them.
+func WithSearchPaths(paths ...string) Option {
+	return func(r *Renderer) error {
+		r.searchPaths = append([]string{}, paths...)
+		return nil
+	}
+}
+
+// WithVariable makes value available to "eval:" expressions as the variable $name. name must not start with "$".
+func WithVariable(name string, value any) Option {
+	return func(r *Renderer) error {
+		if name == "" || strings.HasPrefix(name, "$") {
+			return fmt.Errorf("invalid variable name: %q", name)
+		}
+		r.variables[name] = value
+		return nil
+	}
+}
+
+// WithAllowedEnv makes the environment variables whose names match any of patterns (names or globs such as "APP_*")
+// visible to "eval:" expressions through $ENV and env. No environment variable is visible by default.
+func WithAllowedEnv(patterns ...string) Option {
+	return func(r *Renderer) error {
+		if _, err := internal.AllowedEnviron(nil, patterns); err != nil {
+			return err
+		}
+		r.allowedEnv = append(r.allowedEnv, patterns...)
+		return nil
+	}
+}
+
+// WithTTL sets the number of times templating is applied to a value. See DefaultTTL.
+func WithTTL(ttl int) Option {
+	return func(r *Renderer) error {
+		if ttl < 1 {
+			return fmt.Errorf("invalid TTL: %d", ttl)
+		}
+		r.ttl = ttl
+		return nil
+	}
+}
+
+// WithMergePolicy sets the policy for merging parents into nodes whose "$merge" directive gives none for the node
+// itself. policy is one of the values allowed in "$merge", e.g., "append" or "mergeByKey:name".
+func WithMergePolicy(policy string) Option {
+	return func(r *Renderer) error {
+		rule, err := internal.ParseMergeRule(policy)
+		if err != nil {
+			return err
+		}
+		r.mergeRule = rule
+		return nil
+	}
+}
+
+// WithLoader makes files with the extension ext (e.g. ".ini") loaded by loader, in preference to the built-in ones.
+func WithLoader(ext string, loader Loader) Option {
+	return func(r *Renderer) error {
+		if !strings.HasPrefix(ext, ".") {
+			return fmt.Errorf("extension must start with a dot: %q", ext)
+		}
+		r.loaders[strings.ToLower(ext)] = internal.FileLoader(loader)
+		return nil
+	}
+}
+
+// WithProvenance makes results carry where their values come from. See Result.Provenance.
+func WithProvenance() Option {
+	return func(r *Renderer) error {
+		r.tracksProvenance = true
+		return nil
+	}
+}
+
+// WithFS makes files loaded from fsys, such as an embed.FS, instead of the OS's file system.
+// Paths, including the ones given to Render and WithSearchPaths, are resolved in fsys as if its root were "/" and the
+// working directory, e.g., both "/conf/app.json" and "conf/app.json" refer to "conf/app.json" in fsys. Dependencies
+// of results are reported in the former form.
+// Programs of script directives are still run from the OS's file system.
+func WithFS(fsys fs.FS) Option {
+	return func(r *Renderer) error {
+		r.fileSystem = internal.NewFileSystem(fsys)
+		return nil
+	}
+}
+
+// Render renders the file at path.
+// ctx is checked between the stages of rendering, i.e., loading files, templating keys, and templating values.
+// A "$schema" key is kept as it is, since a Renderer does not validate results.
+//
+// Each call loads files afresh, sharing nothing cached by previous ones, so that changes to the files are always
+// reflected. Files referenced more than once within a call are still loaded only once.
+func (r *Renderer) Render(ctx context.Context, path string) (*Result, error) {
+	return r.render(ctx, path, func(session *internal.Session) (*internal.NodeEntryValue, []string, error) {
+		return session.LoadAndResolveInheritances(filepath.Dir(path), filepath.Base(path))
+	})
+}
+
+// RenderBytes renders a document given as data.
+// name is the path the document is supposed to be at. Parents referenced by relative paths are resolved against its
+// directory, and it appears in errors and provenance. It does not need to exist.
+func (r *Renderer) RenderBytes(ctx context.Context, name string, data []byte, format Format) (*Result, error) {
+	ft, ok := internal.FileType(format), true
+	if ext := strings.ToLower(filepath.Ext(name)); format == FormatAuto && r.loaders[ext] != nil {
+		ft = internal.FileType(strings.TrimPrefix(ext, "."))
+	} else if format == FormatAuto {
+		ft, ok = internal.DetectFileType(name)
+	}
+	if !ok {
+		return nil, fmt.Errorf("cannot tell the format of %s", name)
+	}
+	return r.render(ctx, name, func(session *internal.Session) (*internal.NodeEntryValue, []string, error) {
+		return session.LoadAndResolveInheritancesOfData(name, data, ft)
+	})
+}
+
+func (r *Renderer) render(ctx context.Context, name string, load func(session *internal.Session) (*internal.NodeEntryValue, []string, error)) (*Result, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	session := internal.NewSession(r.searchPaths, internal.SessionOptions{
+		TracksProvenance: r.tracksProvenance,
+		DefaultMergeRule: r.mergeRule,
+		Loaders:          r.loaders,
+		FileSystem:       r.fileSystem,
+	})
+
+	nodeEntryValue, dependencies, err := load(session)
+	if err != nil {
+		return nil, err
+	}
+	environ, err := internal.AllowedEnviron(os.Environ(), r.allowedEnv)
+	if err != nil {
+		return nil, err
+	}
+	builder := internal.NewInvocationSpecBuilder().AddModules(nodeEntryValue.CompilerOptions...).SetEnviron(environ)
+	for k, v := range r.variables {
+		builder.AddVariable("$"+k, v)
+	}
+	invocationSpec := builder.Build()
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	obj, keyOrder, err := internal.ProcessKeySideWithKeyOrder(nodeEntryValue.Obj, nodeEntryValue.KeyOrder, r.ttl, *invocationSpec)
+	if err != nil {
+		return nil, internal.WithSourceFile(err, name)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if obj, err = internal.ProcessValueSide(obj, r.ttl, *invocationSpec); err != nil {
+		return nil, internal.WithSourceFile(err, name)
+	}
+	document, root := internal.UnwrapDocument(obj)
+	value, _ := document.(map[string]any)
+	return &Result{Value: value, Document: document, Dependencies: dependencies, provenance: nodeEntryValue.Provenance.Subtree(root), keyOrder: keyOrder.Subtree(root)}, nil
+}
@@ -0,0 +1,282 @@
+package jqpp
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/dakusui/jqplusplus/internal/testutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestRenderer_Render(t *testing.T) {
+	dir := t.TempDir()
+	lib := t.TempDir()
+	parent := testutil.WriteTempJSON(t, lib, "parent.json", `{"a": [1], "b": "eval:$greeting + \", \" + $ENV.JQPP_TEST_NAME"}`)
+	child := testutil.WriteTempJSON(t, dir, "child.json", "{\n  \"$extends\": [\"parent.json\"],\n  \"a\": [2]\n}")
+	t.Setenv("JQPP_TEST_NAME", "world")
+	r, err := NewRenderer(
+		WithSearchPaths(lib),
+		WithVariable("greeting", "hello"),
+		WithAllowedEnv("JQPP_TEST_*"),
+		WithMergePolicy("append"),
+		WithProvenance(),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	result, err := r.Render(context.Background(), child)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if expected := map[string]any{"a": []any{json.Number("1"), json.Number("2")}, "b": "hello, world"}; !reflect.DeepEqual(result.Value, expected) {
+		t.Errorf("expected %v, got %v", expected, result.Value)
+	}
+	if expected := []string{child, parent}; !reflect.DeepEqual(result.Dependencies, expected) {
+		t.Errorf("expected %v, got %v", expected, result.Dependencies)
+	}
+	origins, ok, err := result.Origins(".a")
+	if err != nil || !ok {
+		t.Fatalf("unexpected result: %v, %v", ok, err)
+	}
+	// The origins of an array are the ones of its elements.
+	if expected := []Origin{{File: parent, Line: 1}, {File: child, Line: 3}}; !reflect.DeepEqual(origins, expected) {
+		t.Errorf("expected %v, got %v", expected, origins)
+	}
+	entries, err := result.Provenance()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(entries) != 3 || entries[0].Path != ".a[0]" || entries[1].Path != ".a[1]" || entries[2].Path != ".b" {
+		t.Errorf("unexpected provenance: %+v", entries)
+	}
+}
+
+func TestRenderer_RenderBytes(t *testing.T) {
+	dir := t.TempDir()
+	_ = testutil.WriteTempJSON(t, dir, "parent.json", `{"a": 1, "b": 2}`)
+	r, err := NewRenderer(WithSearchPaths())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// The document does not exist as a file, while its parent is resolved against its directory.
+	result, err := r.RenderBytes(context.Background(), filepath.Join(dir, "stdin.yaml"), []byte("$extends: [parent.json]\nb: eval:number:.a + 10\n"), FormatAuto)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if expected := map[string]any{"a": json.Number("1"), "b": json.Number("11")}; !reflect.DeepEqual(result.Value, expected) {
+		t.Errorf("expected %v, got %v", expected, result.Value)
+	}
+	result, err = r.RenderBytes(context.Background(), filepath.Join(dir, "input"), []byte(`a = "x"`), FormatTOML)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if expected := map[string]any{"a": "x"}; !reflect.DeepEqual(result.Value, expected) {
+		t.Errorf("expected %v, got %v", expected, result.Value)
+	}
+}
+
+func TestRenderer_WithLoader(t *testing.T) {
+	dir := t.TempDir()
+	_ = testutil.WriteTempJSON(t, dir, "parent.kv", "a=1\nb=2\n")
+	child := testutil.WriteTempJSON(t, dir, "child.json", `{"$extends": ["parent.kv"], "b": "3"}`)
+	r, err := NewRenderer(WithSearchPaths(), WithLoader(".kv", func(data []byte, name string) (map[string]any, error) {
+		ret := map[string]any{}
+		for _, line := range strings.Fields(string(data)) {
+			k, v, _ := strings.Cut(line, "=")
+			ret[k] = v
+		}
+		return ret, nil
+	}))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	result, err := r.Render(context.Background(), child)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if expected := map[string]any{"a": "1", "b": "3"}; !reflect.DeepEqual(result.Value, expected) {
+		t.Errorf("expected %v, got %v", expected, result.Value)
+	}
+}
+
+func TestRenderer_RenderBytesWithLoader(t *testing.T) {
+	dir := t.TempDir()
+	r, err := NewRenderer(WithSearchPaths(), WithLoader(".kv", func(data []byte, name string) (map[string]any, error) {
+		ret := map[string]any{}
+		for _, line := range strings.Fields(string(data)) {
+			k, v, _ := strings.Cut(line, "=")
+			ret[k] = v
+		}
+		return ret, nil
+	}))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	result, err := r.RenderBytes(context.Background(), filepath.Join(dir, "x.kv"), []byte("a=1\n"), FormatAuto)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if expected := map[string]any{"a": "1"}; !reflect.DeepEqual(result.Value, expected) {
+		t.Errorf("expected %v, got %v", expected, result.Value)
+	}
+	result, err = r.RenderBytes(context.Background(), filepath.Join(dir, "input"), []byte("b=2\n"), Format("kv"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if expected := map[string]any{"b": "2"}; !reflect.DeepEqual(result.Value, expected) {
+		t.Errorf("expected %v, got %v", expected, result.Value)
+	}
+}
+
+func TestRenderer_SchemaKept(t *testing.T) {
+	dir := t.TempDir()
+	child := testutil.WriteTempJSON(t, dir, "child.json", `{"$schema": "schema.json", "a": 1}`)
+	r, err := NewRenderer(WithSearchPaths())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	result, err := r.Render(context.Background(), child)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if expected := map[string]any{"$schema": "schema.json", "a": json.Number("1")}; !reflect.DeepEqual(result.Value, expected) {
+		t.Errorf("expected %v, got %v", expected, result.Value)
+	}
+}
+
+func TestRenderer_KeysInOrder(t *testing.T) {
+	dir := t.TempDir()
+	_ = testutil.WriteTempJSON(t, dir, "parent.json", `{"z": 1, "a": {"y": 2, "b": 3}}`)
+	child := testutil.WriteTempJSON(t, dir, "child.json", `{"$extends": ["parent.json"], "m": 4, "c": 5}`)
+	r, err := NewRenderer(WithSearchPaths())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	result, err := r.Render(context.Background(), child)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	keys, err := result.Keys(".")
+	if expected := []string{"z", "a", "m", "c"}; err != nil || !reflect.DeepEqual(keys, expected) {
+		t.Errorf("expected %v, got %v (%v)", expected, keys, err)
+	}
+	keys, err = result.Keys(".a")
+	if expected := []string{"y", "b"}; err != nil || !reflect.DeepEqual(keys, expected) {
+		t.Errorf("expected %v, got %v (%v)", expected, keys, err)
+	}
+	if _, err := result.Keys(".z"); err == nil {
+		t.Errorf("expected an error for a non-object")
+	}
+	data, err := json.Marshal(result)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if expected := `{"z":1,"a":{"y":2,"b":3},"m":4,"c":5}`; string(data) != expected {
+		t.Errorf("expected %v, got %v", expected, string(data))
+	}
+}
+
+func TestRenderer_BrokenExpression_ThenLocatedError(t *testing.T) {
+	dir := t.TempDir()
+	child := testutil.WriteTempJSON(t, dir, "child.json", `{"a": "eval:.x | foo"}`)
+	r, err := NewRenderer(WithTTL(3))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	_, err = r.Render(context.Background(), child)
+	var located LocatedError
+	if !errors.As(err, &located) {
+		t.Fatalf("expected a located error, got %v", err)
+	}
+	if expected := child + ": .a"; located.Location() != expected {
+		t.Errorf("expected %q, got %q", expected, located.Location())
+	}
+}
+
+func TestRenderer_CanceledContext_ThenError(t *testing.T) {
+	dir := t.TempDir()
+	child := testutil.WriteTempJSON(t, dir, "child.json", `{}`)
+	r, err := NewRenderer()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := r.Render(ctx, child); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+}
+
+func TestNewRenderer_InvalidOptions_ThenError(t *testing.T) {
+	for _, each := range []Option{
+		WithVariable("$x", 1),
+		WithTTL(0),
+		WithMergePolicy("sometimes"),
+		WithLoader("kv", nil),
+		WithAllowedEnv("["),
+	} {
+		if _, err := NewRenderer(each); err == nil {
+			t.Errorf("expected an error")
+		}
+	}
+}
+
+func TestRenderer_MissingFile_ThenError(t *testing.T) {
+	r, err := NewRenderer()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := r.Render(context.Background(), filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Errorf("expected an error")
+	}
+}
+
+func TestRenderer_WithFS(t *testing.T) {
+	fsys := fstest.MapFS{
+		"conf/app.yaml": {Data: []byte("$extends: [base.json]\nx:\n  $extends: [local.json]\n$local:\n  local.json: {l: 1}\n")},
+		"lib/base.json": {Data: []byte(`{"a": "eval:\"b\" + \"c\""}`)},
+	}
+	r, err := NewRenderer(WithFS(fsys), WithSearchPaths("lib"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	result, err := r.Render(context.Background(), "conf/app.yaml")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if expected := map[string]any{"a": "bc", "x": map[string]any{"l": json.Number("1")}}; !reflect.DeepEqual(result.Value, expected) {
+		t.Errorf("expected %v, got %v", expected, result.Value)
+	}
+	if expected := []string{"/conf/app.yaml", "/lib/base.json"}; !reflect.DeepEqual(result.Dependencies, expected) {
+		t.Errorf("expected %v, got %v", expected, result.Dependencies)
+	}
+}
+
+func TestRenderer_NonObjectDocument(t *testing.T) {
+	dir := t.TempDir()
+	_ = testutil.WriteTempJSON(t, dir, "hosts.yaml", "- a\n- b\n")
+	file := testutil.WriteTempJSON(t, dir, "all.json", `{"$extends": ["hosts.yaml"], "$merge": {".": "append"}, "$value": ["eval:\"c\""]}`)
+	r, err := NewRenderer(WithSearchPaths(), WithProvenance())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	result, err := r.Render(context.Background(), file)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if expected := []any{"a", "b", "c"}; result.Value != nil || !reflect.DeepEqual(result.Document, expected) {
+		t.Errorf("expected %v, got %v (%v)", expected, result.Document, result.Value)
+	}
+	origins, ok, err := result.Origins(".[0]")
+	if err != nil || !ok || !reflect.DeepEqual(origins, []Origin{{File: filepath.Join(dir, "hosts.yaml"), Line: 1}}) {
+		t.Errorf("unexpected origins: %v, %v, %v", origins, ok, err)
+	}
+	origins, ok, err = result.Origins(".[2]")
+	if err != nil || !ok || len(origins) != 1 || origins[0].File != file {
+		t.Errorf("unexpected origins: %v, %v, %v", origins, ok, err)
+	}
+}
@@ -0,0 +1,99 @@
+package jqpp
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/dakusui/jqplusplus/internal"
+)
+
+// Result is a rendered document.
+type Result struct {
+	// Value is the rendered object. Numbers in it are json.Number, which holds them as they are written, e.g., IDs
+	// beyond 2^53 and decimals such as 19.99.
+	// It is nil if the rendered document is not an object.
+	// Being a map, it does not keep the order of keys. Use Keys or MarshalJSON for it.
+	Value map[string]any
+	// Document is the rendered document, i.e., Value if it is an object, or else an array or a scalar.
+	Document any
+	// Dependencies are the absolute paths of the files the result depends on, sorted, i.e., the rendered file, the
+	// files it inherits from, directly or indirectly, jq modules, and programs of script directives.
+	Dependencies []string
+	provenance   *internal.Provenance
+	keyOrder     *internal.KeyOrder
+}
+
+// Keys returns the keys of the object at the path expression p in Document, in the order the command line tool
+// prints them, i.e., the keys a node inherits first, each in the order it is written.
+func (r *Result) Keys(p string) ([]string, error) {
+	path, err := internal.PathExpressionToPathArray(p)
+	if err != nil {
+		return nil, err
+	}
+	v, _ := internal.GetAtPath(r.Document, path)
+	obj, ok := v.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("not an object: %s", p)
+	}
+	return r.keyOrder.Keys(path, obj), nil
+}
+
+// MarshalJSON renders Document as JSON, with the keys of its objects in the order Keys returns.
+func (r *Result) MarshalJSON() ([]byte, error) {
+	return json.Marshal(r.keyOrder.Ordered(r.Document))
+}
+
+// Origin tells where a value was defined.
+type Origin struct {
+	// File is the path of the file (or the script directive) that defined the value.
+	File string
+	// Line is the 1-based line number of the value in File, or 0 if it is not known.
+	Line int
+}
+
+// ProvenanceEntry is the origin chain of a leaf, i.e., a scalar, an empty object, or an empty array.
+// The elements of an array are recorded one by one, e.g., ".a[0]" and ".a[1]".
+type ProvenanceEntry struct {
+	// Path is the path expression of the leaf, e.g., ".a.b".
+	Path string
+	// Origins lists the origins of the values given to the leaf, the effective one first, followed by the ones it
+	// overrides.
+	Origins []Origin
+}
+
+// Provenance returns the origin chains of the leaves, sorted by their paths.
+// It is empty unless the Renderer is created with WithProvenance.
+func (r *Result) Provenance() ([]ProvenanceEntry, error) {
+	var ret []ProvenanceEntry
+	for _, e := range r.provenance.Entries() {
+		p, err := internal.PathArrayToPathExpression(e.Path)
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(p, ".") {
+			p = "." + p
+		}
+		ret = append(ret, ProvenanceEntry{Path: p, Origins: toOrigins(e.Origins)})
+	}
+	return ret, nil
+}
+
+// Origins returns the origin chain of the value at the path expression p, or false if it is not known.
+// If p is not a leaf, the chain of its nearest ancestor that is, if any, is returned. This happens when templating
+// turns a leaf into an object or an array. Otherwise, the origins of the leaves under p are returned, each once.
+// It always returns false unless the Renderer is created with WithProvenance.
+func (r *Result) Origins(p string) ([]Origin, bool, error) {
+	path, err := internal.PathExpressionToPathArray(p)
+	if err != nil {
+		return nil, false, err
+	}
+	origins, ok := r.provenance.Lookup(path)
+	return toOrigins(origins), ok, nil
+}
+
+func toOrigins(origins []internal.Origin) []Origin {
+	return internal.Map(origins, func(o internal.Origin) Origin {
+		return Origin{File: o.File, Line: o.Line}
+	})
+}